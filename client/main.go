@@ -5,6 +5,8 @@ import (
 	"flag"
 	"log"
 	"strconv"
+	"strings"
+	"time"
 )
 
 var host = flag.String("host", "localhost", "Discovery service host.")
@@ -12,10 +14,69 @@ var port = flag.Int(
 	"port",
 	int(discovery.DefaultPort),
 	"Discovery service port.")
+var protocol = flag.String(
+	"protocol", "json", "Wire protocol to use: json or protobuf.")
+var ttl = flag.Int(
+	"ttl",
+	0,
+	"Lease in seconds for join. Heartbeats are sent until the client exits.")
+var persistent = flag.Bool(
+	"persistent", false, "Join a service that outlives the connection.")
+var labels = flag.String(
+	"labels", "", "Comma separated key=value labels for join.")
+var tags = flag.String("tags", "", "Comma separated tags for join.")
+var selector = flag.String("selector", "",
+	"Label selector of snapshot and watch, e.g. zone in (a,b),!tag:canary.")
+var check = flag.String(
+	"check",
+	"",
+	"Health check for join: tcp, http:<path> or script:<command> [args...].")
+var checkInterval = flag.Int(
+	"checkInterval",
+	discovery.DefaultCheckInterval,
+	"Seconds between health checks.")
+var useTLS = flag.Bool(
+	"tls", false, "Connect using TLS. Implied by the other -tls flags.")
+var tlsCert = flag.String(
+	"tlsCert", "", "PEM client certificate file for mutual TLS.")
+var tlsKey = flag.String("tlsKey", "", "PEM private key file of -tlsCert.")
+var tlsCA = flag.String(
+	"tlsCA",
+	"",
+	"PEM file of the CAs that sign the server certificate. Defaults to the "+
+		"system roots.")
+var token = flag.String(
+	"token", "", "Token to authenticate with when the server requires one.")
+var reconnect = flag.Bool(
+	"reconnect",
+	true,
+	"Reconnect when the connection is lost and restore joins and watches.")
 
 func main() {
 	flag.Parse()
 	var client discovery.Client
+	switch *protocol {
+	case "json":
+		client.Protocol = discovery.JSON
+	case "protobuf":
+		client.Protocol = discovery.Protobuf
+	default:
+		log.Println("Unknown protocol:", *protocol)
+		return
+	}
+	if *useTLS || *tlsCert != "" || *tlsKey != "" || *tlsCA != "" {
+		config, err := discovery.NewClientTLSConfig(*tlsCert, *tlsKey, *tlsCA)
+		if err != nil {
+			log.Println("Error loading TLS configuration:", err)
+			return
+		}
+		client.TLSConfig = config
+	}
+	client.Token = *token
+	client.Reconnect = *reconnect
+	client.StateChanged = func(state discovery.ConnState) {
+		log.Println("Connection", state)
+	}
 	err := client.Connect(*host, uint16(*port))
 	if err != nil {
 		log.Println("Error connecting:", err)
@@ -40,22 +101,102 @@ func main() {
 			log.Println("Invalid port:", args[3])
 			return
 		}
-		err = client.Join(&discovery.ServiceDef{
-			Group: args[1], Host: args[2], Port: uint16(port)})
+		service := &discovery.ServiceDef{
+			Group: args[1], Host: args[2], Port: uint16(port), TTL: uint32(*ttl),
+			Persistent: *persistent}
+		if *labels != "" {
+			service.Labels = make(map[string]string)
+			for _, label := range strings.Split(*labels, ",") {
+				kv := strings.SplitN(label, "=", 2)
+				if len(kv) != 2 || kv[0] == "" {
+					log.Println("Invalid label:", label)
+					return
+				}
+				service.Labels[kv[0]] = kv[1]
+			}
+		}
+		if *tags != "" {
+			service.Tags = strings.Split(*tags, ",")
+		}
+		if *check != "" {
+			if service.Check = parseCheck(*check); service.Check == nil {
+				log.Println("Invalid check:", *check)
+				return
+			}
+		}
+		err = client.Join(service)
+		if err == nil && *ttl > 0 {
+			go heartbeat(&client, service)
+		}
+	case "state":
+		if len(args) < 5 {
+			log.Println(
+				"client state requires <group> <host> <port> " +
+					"<active|draining|maintenance>")
+			return
+		}
+		var port int64
+		port, err = strconv.ParseInt(args[3], 10, 16)
+		if err != nil {
+			log.Println("Invalid port:", args[3])
+			return
+		}
+		service := &discovery.ServiceDef{
+			Group: args[1], Host: args[2], Port: uint16(port)}
+		if err = client.SetState(service, args[4]); err != nil {
+			log.Println("Error:", err)
+		}
+		return
 	case "snapshot":
 		if len(args) < 2 {
 			log.Println("client snapshot requires <group>")
 			return
 		}
-		snapshot, err := client.Snapshot(args[1])
+		snapshot, err := client.SnapshotSelector(args[1], *selector)
 		if err != nil {
 			log.Println("Error:", err)
 			return
 		}
-		for _, def := range snapshot {
+		log.Println("Revision", snapshot.Revision)
+		for _, def := range snapshot.Services {
 			log.Println(def)
 		}
 		return
+	case "groups":
+		prefix := ""
+		if len(args) > 1 {
+			prefix = args[1]
+		}
+		list, err := client.ListGroups(prefix)
+		if err != nil {
+			log.Println("Error:", err)
+			return
+		}
+		log.Println("Revision", list.Revision)
+		for _, group := range list.Groups {
+			log.Printf("%s services=%d unhealthy=%d revision=%d\n", group.Name,
+				group.Services, group.Unhealthy, group.Revision)
+		}
+		return
+	case "watch":
+		if len(args) < 2 {
+			log.Println("client watch requires <group>")
+			return
+		}
+		snapshot, events, err := client.WatchSelector(args[1], *selector)
+		if err != nil {
+			log.Println("Error:", err)
+			return
+		}
+		log.Println("Revision", snapshot.Revision)
+		for _, def := range snapshot.Services {
+			log.Println(def)
+		}
+		for event := range events {
+			log.Println(event)
+		}
+		log.Println("Connection closed")
+		return
 	default:
 	}
 	if err != nil {
@@ -65,3 +206,36 @@ func main() {
 	log.Println("Ctrl-C to exit...")
 	<-make(chan int)
 }
+
+// Parses a -check flag. Returns nil if it is invalid.
+func parseCheck(spec string) *discovery.HealthCheck {
+	check := &discovery.HealthCheck{Interval: uint32(*checkInterval)}
+	kind, arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+	switch kind {
+	case discovery.CheckTCP:
+		check.Type = discovery.CheckTCP
+	case discovery.CheckHTTP:
+		check.Type, check.Path = discovery.CheckHTTP, arg
+	case discovery.CheckScript:
+		check.Type, check.Script = discovery.CheckScript, strings.Fields(arg)
+		if len(check.Script) == 0 {
+			return nil
+		}
+	default:
+		return nil
+	}
+	return check
+}
+
+// Renews the lease of service well before it expires.
+func heartbeat(client *discovery.Client, service *discovery.ServiceDef) {
+	interval := time.Duration(service.TTL) * time.Second / 3
+	for _ = range time.Tick(interval) {
+		if err := client.Heartbeat(service); err != nil {
+			log.Println("Heartbeat failed:", err)
+		}
+	}
+}
@@ -1,16 +1,191 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"discovery"
 	"flag"
 	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var port = flag.Int("port", int(discovery.DefaultPort), "Port to listen on.")
+var dataDir = flag.String(
+	"dataDir",
+	"",
+	"Directory used to store persistent services. Disabled if empty.")
+var compactInterval = flag.Duration(
+	"compactInterval",
+	10*time.Minute,
+	"How often the persistent service log is compacted.")
+var historySize = flag.Int(
+	"historySize",
+	discovery.DefaultHistorySize,
+	"Number of changes kept for watchers resuming from a revision.")
+var peers = flag.String(
+	"peers",
+	"",
+	"Comma separated cluster addresses (host:port) of every cluster member. "+
+		"Runs a standalone server if empty.")
+var self = flag.Int("self", 0, "Index of this server in -peers.")
+var httpPort = flag.Int(
+	"httpPort", 0, "Port to serve the HTTP API on. Disabled when 0.")
+var dnsPort = flag.Int(
+	"dnsPort", 0, "UDP port to answer DNS queries on. Disabled when 0.")
+var dnsDomain = flag.String(
+	"dnsDomain", "discovery.", "Domain the DNS records are served under.")
+var tlsCert = flag.String(
+	"tlsCert", "", "PEM certificate file. Enables TLS when set with -tlsKey.")
+var tlsKey = flag.String("tlsKey", "", "PEM private key file of -tlsCert.")
+var tlsCA = flag.String(
+	"tlsCA",
+	"",
+	"PEM file of the CAs that sign client certificates. Enables mutual TLS.")
+var policy = flag.String(
+	"policy",
+	"",
+	"JSON file of rules deciding which clients may use which groups.")
+var tokens = flag.String(
+	"tokens",
+	"",
+	"File of \"<token> <principal>\" lines. When set, clients must "+
+		"authenticate with a token or a client certificate.")
+var verifyHost = flag.Bool(
+	"verifyHost",
+	false,
+	"Only let clients join hosts their certificate is valid for. Requires "+
+		"-tlsCA.")
+var leaveOnShutdown = flag.Bool(
+	"leaveOnShutdown",
+	false,
+	"Tell watchers that the services of the connected clients leave when the "+
+		"server shuts down.")
 
 func main() {
 	flag.Parse()
 	server := discovery.NewServer()
-	err := server.Serve(uint16(*port))
-	fmt.Println("Error running server", err)
+	server.SetHistorySize(*historySize)
+	server.SetLeaveOnShutdown(*leaveOnShutdown)
+	if *dataDir != "" {
+		if err := server.OpenStore(*dataDir, *compactInterval); err != nil {
+			fmt.Println("Error opening store", err)
+			return
+		}
+	}
+	if *policy != "" {
+		p, err := discovery.LoadPolicy(*policy)
+		if err != nil {
+			fmt.Println("Error loading policy", err)
+			return
+		}
+		server.SetPolicy(p)
+	}
+	if *tokens != "" {
+		verifier, err := discovery.LoadTokens(*tokens)
+		if err != nil {
+			fmt.Println("Error loading tokens", err)
+			return
+		}
+		server.SetTokenVerifier(verifier)
+	}
+	var config *tls.Config
+	if *tlsCert != "" || *tlsKey != "" {
+		var err error
+		config, err = discovery.NewServerTLSConfig(*tlsCert, *tlsKey, *tlsCA)
+		if err != nil {
+			fmt.Println("Error loading TLS configuration", err)
+			return
+		}
+		server.SetVerifyHost(*verifyHost)
+	} else if *tlsCA != "" || *verifyHost {
+		fmt.Println("-tlsCA and -verifyHost require -tlsCert and -tlsKey")
+		return
+	}
+	if *peers != "" {
+		members := strings.Split(*peers, ",")
+		if *self < 0 || *self >= len(members) {
+			fmt.Println("Invalid -self", *self)
+			return
+		}
+		if config == nil {
+			fmt.Fprintln(os.Stderr, "WARNING: cluster members talk without "+
+				"TLS. Anyone reaching "+members[*self]+" can change the "+
+				"registry. Set -tlsCert, -tlsKey and -tlsCA.")
+		} else if err := server.SetClusterTLSConfig(config); err != nil {
+			fmt.Println("Clusters over TLS require -tlsCA:", err)
+			return
+		}
+		listener, err := net.Listen("tcp", members[*self])
+		if err != nil {
+			fmt.Println("Error listening for cluster members", err)
+			return
+		}
+		if err = server.StartCluster(listener, members, *self); err != nil {
+			fmt.Println("Error starting cluster", err)
+			return
+		}
+	}
+	// Shut down cleanly on SIGINT and SIGTERM.
+	ctx, stop := signal.NotifyContext(
+		context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	httpDone := make(chan bool)
+	if *httpPort != 0 {
+		go serveHTTP(ctx, server, config, httpDone)
+	} else {
+		close(httpDone)
+	}
+	if *dnsPort != 0 {
+		// Stops once the server shuts down.
+		go func() {
+			err := server.ServeDNS(uint16(*dnsPort), *dnsDomain)
+			if err != discovery.ErrServerClosed {
+				fmt.Println("Error serving DNS", err)
+			}
+		}()
+	}
+	var err error
+	if config != nil {
+		err = server.ServeTLS(ctx, uint16(*port), config)
+	} else {
+		err = server.Serve(ctx, uint16(*port))
+	}
+	if err != discovery.ErrServerClosed {
+		fmt.Println("Error running server", err)
+	}
+	stop()
+	<-httpDone
+}
+
+// Serves the HTTP API, over TLS when config is set, until ctx is done. Closes
+// done once the API is shut down.
+func serveHTTP(ctx context.Context, server *discovery.Server,
+	config *tls.Config, done chan bool) {
+	httpServer := &http.Server{Handler: server.HTTPHandler()}
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := httpServer.Shutdown(ctx); err != nil {
+			fmt.Println("Error shutting down HTTP", err)
+		}
+	}()
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(*httpPort))
+	if err == nil {
+		if config != nil {
+			listener = tls.NewListener(listener, config)
+		}
+		err = httpServer.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
+		fmt.Println("Error serving HTTP", err)
+	}
 }
@@ -0,0 +1,112 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Operations controlled by a Policy.
+const (
+	opJoin     = "join"
+	opLeave    = "leave"
+	opSnapshot = "snapshot"
+	opWatch    = "watch"
+	// Changing the state of services joined by other connections.
+	opAdmin = "admin"
+)
+
+// Matches any group, principal or operation in a Rule.
+const anyName = "*"
+
+// A Rule allows, or denies, principals an operation on groups.
+type Rule struct {
+	// Name of a group, or a prefix of group names when it ends in "*". "*"
+	// matches every group. Requests for a prefix of the group hierarchy, e.g.
+	// "prod/", are checked against the prefix and then against each group
+	// under it.
+	Group string `json:"group"`
+	// Names of the principals the rule applies to. "*" matches every
+	// connection, including ones without a principal.
+	Principals []string `json:"principals"`
+	// Any of join, leave, snapshot, watch, admin or "*" for all of them.
+	Operations []string `json:"operations"`
+	Deny       bool     `json:"deny,omitempty"`
+}
+
+func (r *Rule) matchGroup(group string) bool {
+	if strings.HasSuffix(r.Group, anyName) {
+		return strings.HasPrefix(group, r.Group[:len(r.Group)-1])
+	}
+	return r.Group == group
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == anyName || n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matches(principal, op, group string) bool {
+	return r.matchGroup(group) && contains(r.Operations, op) &&
+		contains(r.Principals, principal)
+}
+
+// A Policy decides which principals may join, leave, snapshot, watch and
+// administer which groups. Rules are checked in order and the first rule
+// matching a request decides it. Requests no rule matches are denied.
+//
+// The principal of a connection is the common name of its client certificate.
+type Policy struct {
+	Rules []*Rule `json:"rules"`
+}
+
+// Reads a Policy from a JSON file of the form
+//
+//	{"rules": [{"group": "payments", "principals": ["pay.example"],
+//	            "operations": ["join", "leave"]},
+//	           {"group": "*", "principals": ["*"],
+//	            "operations": ["snapshot", "watch"]}]}
+func LoadPolicy(file string) (*Policy, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	policy := &Policy{}
+	if err = json.NewDecoder(f).Decode(policy); err != nil {
+		return nil, fmt.Errorf("Invalid policy %s: %s", file, err)
+	}
+	for i, rule := range policy.Rules {
+		for _, op := range rule.Operations {
+			switch op {
+			case opJoin, opLeave, opSnapshot, opWatch, opAdmin, anyName:
+			default:
+				return nil, fmt.Errorf("Invalid policy %s: rule %d: "+
+					"unknown operation %s", file, i, op)
+			}
+		}
+	}
+	return policy, nil
+}
+
+// Returns an error unless principal may perform op on group.
+func (p *Policy) check(principal, op, group string) error {
+	for _, rule := range p.Rules {
+		if rule.matches(principal, op, group) {
+			if rule.Deny {
+				break
+			}
+			return nil
+		}
+	}
+	if principal == "" {
+		principal = "anonymous"
+	}
+	return fmt.Errorf("Permission denied: %s may not %s group %s",
+		principal, op, group)
+}
@@ -0,0 +1,145 @@
+package discovery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	policy := &Policy{Rules: []*Rule{
+		{Group: "payments", Principals: []string{"staging"},
+			Operations: []string{"*"}, Deny: true},
+		{Group: "payments", Principals: []string{"pay", "staging"},
+			Operations: []string{"join", "leave"}},
+		{Group: "test/*", Principals: []string{"*"}, Operations: []string{"*"}},
+		{Group: "*", Principals: []string{"*"}, Operations: []string{"snapshot"}},
+	}}
+	tests := []struct {
+		principal, op, group string
+		allowed              bool
+	}{
+		{"pay", opJoin, "payments", true},
+		{"pay", opLeave, "payments", true},
+		{"pay", opWatch, "payments", false},
+		{"staging", opJoin, "payments", false},
+		// Deny rules apply before later rules.
+		{"staging", opSnapshot, "payments", false},
+		{"other", opSnapshot, "payments", true},
+		{"", opSnapshot, "payments", true},
+		{"", opJoin, "payments", false},
+		{"", opJoin, "test/a", true},
+		{"other", opWatch, "test/", true},
+		{"other", opWatch, "test", false},
+		{"pay", opJoin, "paymentsx", false},
+	}
+	for _, test := range tests {
+		err := policy.check(test.principal, test.op, test.group)
+		if (err == nil) != test.allowed {
+			t.Error("Wrong decision for", test.principal, test.op, test.group,
+				err)
+		}
+	}
+	err := policy.check("", opJoin, "payments")
+	if err == nil ||
+		err.Error() != "Permission denied: anonymous may not join group payments" {
+		t.Error("Wrong error", err)
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "policy.json")
+
+	ioutil.WriteFile(file, []byte(`{"rules": [{"group": "g",
+		"principals": ["p"], "operations": ["join", "watch"]}]}`), 0600)
+	policy, err := LoadPolicy(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policy.Rules) != 1 || policy.Rules[0].Group != "g" ||
+		len(policy.Rules[0].Operations) != 2 || policy.Rules[0].Deny {
+		t.Error("Wrong policy", policy.Rules)
+	}
+
+	ioutil.WriteFile(file, []byte(`{"rules": [{"group": "g",
+		"principals": ["ops"], "operations": ["admin"]}]}`), 0600)
+	if policy, err = LoadPolicy(file); err != nil {
+		t.Fatal(err)
+	}
+	if err = policy.check("ops", opAdmin, "g"); err != nil {
+		t.Error(err)
+	}
+
+	ioutil.WriteFile(file, []byte(`{"rules": [{"group": "g",
+		"principals": ["p"], "operations": ["delete"]}]}`), 0600)
+	if _, err = LoadPolicy(file); err == nil {
+		t.Error("Expected an error for an unknown operation")
+	}
+	ioutil.WriteFile(file, []byte(`{"rules": [`), 0600)
+	if _, err = LoadPolicy(file); err == nil {
+		t.Error("Expected an error for invalid JSON")
+	}
+}
+
+func TestServerPolicy(t *testing.T) {
+	server := NewServer()
+	server.SetPolicy(&Policy{Rules: []*Rule{
+		{Group: "open", Principals: []string{"*"}, Operations: []string{"*"}},
+		{Group: "*", Principals: []string{"*"}, Operations: []string{"snapshot"}},
+	}})
+	go server.processEvents()
+	for _, protocol := range []Protocol{JSON, Protobuf} {
+		client := connectTestClient(server, protocol)
+		if err := client.Join(&ServiceDef{Host: "h", Group: "open"}); err != nil {
+			t.Error(err)
+		}
+		err := client.Join(&ServiceDef{Host: "h", Group: "payments"})
+		if err == nil ||
+			err.Error() != "Permission denied: anonymous may not join group payments" {
+			t.Error("Expected join to be denied", err)
+		}
+		if _, err = client.Snapshot("payments"); err != nil {
+			t.Error(err)
+		}
+		if _, _, err = client.Watch("payments"); err == nil {
+			t.Error("Expected watch to be denied")
+		}
+		client.Close()
+	}
+}
+
+func TestServerPolicyPrefix(t *testing.T) {
+	server := NewServer()
+	server.SetPolicy(&Policy{Rules: []*Rule{
+		{Group: "prod/secret", Principals: []string{"*"},
+			Operations: []string{"snapshot", "watch"}, Deny: true},
+		{Group: "*", Principals: []string{"*"}, Operations: []string{"*"}},
+	}})
+	go server.processEvents()
+	client := connectTestClient(server, JSON)
+	defer client.Close()
+	client.Join(&ServiceDef{Host: "a", Group: "prod/api"})
+	client.Join(&ServiceDef{Host: "b", Group: "prod/secret"})
+
+	// Groups under a prefix are left out if the policy denies them.
+	snapshot, err := client.Snapshot("prod/")
+	if err != nil || len(snapshot) != 1 ||
+		snapshot[0].Group != "prod/api" {
+		t.Error("Wrong snapshot", snapshot, err)
+	}
+	_, events, err := client.Watch("prod/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Join(&ServiceDef{Host: "c", Group: "prod/secret"})
+	client.Join(&ServiceDef{Host: "d", Group: "prod/api"})
+	if event := nextEvent(t, events); event.Service.Host != "d" {
+		t.Error("Expected join of d", event)
+	}
+}
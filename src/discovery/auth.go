@@ -0,0 +1,71 @@
+package discovery
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// How long a connection may stay open without authenticating when the server
+// requires tokens. Variable so tests can shorten it.
+var authTimeout = 10 * time.Second
+
+// A TokenVerifier checks the bearer tokens clients authenticate with.
+type TokenVerifier interface {
+	// Returns the principal the token belongs to, or an error if the token is
+	// not valid. The principal is what a Policy matches against.
+	Verify(token string) (principal string, err error)
+}
+
+type tokenFile struct {
+	tokens     [][]byte
+	principals []string
+}
+
+// Returns a TokenVerifier for the tokens in file. Each line holds a token and
+// the principal it belongs to, separated by white space. Empty lines and lines
+// starting with # are ignored.
+func LoadTokens(file string) (TokenVerifier, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tokens := &tokenFile{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Invalid token file %s: line %d", file, line)
+		}
+		tokens.tokens = append(tokens.tokens, []byte(fields[0]))
+		tokens.principals = append(tokens.principals, fields[1])
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (f *tokenFile) Verify(token string) (string, error) {
+	// Compare every token in constant time so the time taken does not tell how
+	// close a guess is.
+	principal := ""
+	for i, t := range f.tokens {
+		if subtle.ConstantTimeCompare(t, []byte(token)) == 1 {
+			principal = f.principals[i]
+		}
+	}
+	if principal == "" {
+		return "", errors.New("Invalid token")
+	}
+	return principal, nil
+}
@@ -0,0 +1,148 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testTokens map[string]string
+
+func (t testTokens) Verify(token string) (string, error) {
+	if principal, ok := t[token]; ok {
+		return principal, nil
+	}
+	return "", errors.New("Invalid token")
+}
+
+func TestLoadTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "tokens")
+
+	ioutil.WriteFile(file, []byte("# token principal\n\nsecret pay.example\n"+
+		"  other\tstaging  \n"), 0600)
+	tokens, err := LoadTokens(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal, err := tokens.Verify("secret"); err != nil ||
+		principal != "pay.example" {
+		t.Error("Wrong principal", principal, err)
+	}
+	if principal, err := tokens.Verify("other"); err != nil ||
+		principal != "staging" {
+		t.Error("Wrong principal", principal, err)
+	}
+	for _, token := range []string{"", "secre", "secrets", "pay.example"} {
+		if _, err := tokens.Verify(token); err == nil {
+			t.Error("Expected token to be rejected", token)
+		}
+	}
+
+	ioutil.WriteFile(file, []byte("secret\n"), 0600)
+	if _, err = LoadTokens(file); err == nil {
+		t.Error("Expected an error for a line without a principal")
+	}
+}
+
+func TestServerRequiresAuthentication(t *testing.T) {
+	server := NewServer()
+	server.SetTokenVerifier(testTokens{"secret": "pay"})
+	server.SetPolicy(&Policy{Rules: []*Rule{
+		{Group: "payments", Principals: []string{"pay"}, Operations: []string{"*"}},
+	}})
+	go server.processEvents()
+	for _, protocol := range []Protocol{JSON, Protobuf} {
+		client := connectTestClient(server, protocol)
+		service := &ServiceDef{Host: "h", Group: "payments"}
+		err := client.Join(service)
+		if err == nil || err.Error() != "Authentication required" {
+			t.Error("Expected join to require authentication", err)
+		}
+		err = client.call("Discovery.Authenticate", "wrong", &Void{})
+		if err == nil || err.Error() != "Invalid token" {
+			t.Error("Expected the token to be rejected", err)
+		}
+		if err = client.call(
+			"Discovery.Authenticate", "secret", &Void{}); err != nil {
+			t.Fatal(err)
+		}
+		// The policy applies to the principal of the token.
+		if err = client.Join(service); err != nil {
+			t.Error(err)
+		}
+		if err = client.Leave(service); err != nil {
+			t.Error(err)
+		}
+		client.Close()
+	}
+}
+
+func TestAuthenticateNotEnabled(t *testing.T) {
+	server := NewServer()
+	go server.processEvents()
+	client := connectTestClient(server, JSON)
+	defer client.Close()
+	if err := client.call(
+		"Discovery.Authenticate", "secret", &Void{}); err == nil {
+		t.Error("Expected an error")
+	}
+}
+
+func TestServerClosesUnauthenticatedConnections(t *testing.T) {
+	defer func(timeout time.Duration) { authTimeout = timeout }(authTimeout)
+	authTimeout = 50 * time.Millisecond
+	server := NewServer()
+	server.SetTokenVerifier(testTokens{"secret": "pay"})
+	go server.processEvents()
+
+	client := connectTestClient(server, Protobuf)
+	defer client.Close()
+	authenticated := connectTestClient(server, Protobuf)
+	defer authenticated.Close()
+	if err := authenticated.call(
+		"Discovery.Authenticate", "secret", &Void{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(4 * authTimeout)
+	if _, err := client.Snapshot("g"); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+	if _, err := authenticated.Snapshot("g"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientToken(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer()
+	server.SetTokenVerifier(testTokens{"secret": "pay"})
+	go server.ServeListener(context.Background(), listener)
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+
+	client := &Client{Protocol: Protobuf, Token: "secret"}
+	if err = client.Connect("127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Snapshot("g"); err != nil {
+		t.Error(err)
+	}
+	client.Close()
+
+	client = &Client{Token: "wrong"}
+	if err = client.Connect("127.0.0.1", port); err == nil {
+		t.Error("Expected Connect to fail with an invalid token")
+	}
+}
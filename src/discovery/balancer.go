@@ -0,0 +1,301 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Strategy selects how a Balancer picks services.
+type Strategy int
+
+const (
+	// Picks the services in turn.
+	RoundRobin Strategy = iota
+	// Picks a service at random.
+	Random
+	// Picks the service with the fewest requests that are not done yet.
+	LeastOutstanding
+	// Picks services in turn in proportion to their weight label.
+	Weighted
+)
+
+// Label holding the weight of a service for the Weighted strategy, a positive
+// integer. Services without a valid weight have weight 1, larger weights count
+// as MaxWeight.
+const WeightLabel = "weight"
+
+// Largest weight of a service. Anyone who joins a service sets its weight, so
+// it is bounded to keep the points of a Ring in check.
+const MaxWeight = 100
+
+// A service is ejected for balancerEjectTime after balancerMaxFailures failed
+// requests in a row. The time is variable so tests can shorten it.
+const balancerMaxFailures = 3
+
+var balancerEjectTime = 10 * time.Second
+
+// Returned by Pick when the group has no active services.
+var ErrNoServices = errors.New("No services to pick from")
+
+// A Balancer spreads requests over the members of a watched group. It keeps
+// the members up to date from the watch and picks one of the active ones for
+// each request with its Strategy. Callers report the outcome of each request
+// with Done: a service whose requests keep failing is ejected for a while,
+// unless every service is.
+//
+// Use Transport to balance the requests of an http.Client.
+type Balancer struct {
+	client   *Client
+	group    string
+	strategy Strategy
+
+	lock sync.Mutex
+	// Members of the group in ServiceDef.compare order.
+	members []*member
+	// Position of the next round-robin pick.
+	next int
+	rand *rand.Rand
+}
+
+type member struct {
+	service *ServiceDef
+	weight  int
+	// Current weight of the smooth weighted round-robin.
+	current int
+	// Number of picks not done yet.
+	outstanding int
+	// Failed requests in a row and, when there were too many, until when the
+	// service is ejected.
+	failures     int
+	ejectedUntil time.Time
+}
+
+// Returns a balancer over the members of group. The balancer watches group on
+// client until it is closed. A client has a single watch per group, so this
+// fails if client already watches group, or a prefix above or a group under
+// it, e.g. for another Balancer, Ring or Resolver. Use one Client per watcher
+// of a group.
+func NewBalancer(client *Client, group string, strategy Strategy) (
+	*Balancer, error) {
+	snapshot, events, err := client.Watch(group)
+	if err != nil {
+		return nil, err
+	}
+	b := &Balancer{client: client, group: group, strategy: strategy,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	for _, service := range snapshot.Services {
+		b.join(service)
+	}
+	go b.follow(events)
+	return b, nil
+}
+
+// Applies the events of the watch until it is closed.
+func (b *Balancer) follow(events <-chan *Event) {
+	for event := range events {
+		b.lock.Lock()
+		if event.Type == Joined {
+			b.join(event.Service)
+		} else {
+			b.leave(event.Service)
+		}
+		b.lock.Unlock()
+	}
+}
+
+// Returns the position of service in members and true if it is there.
+func (b *Balancer) search(service *ServiceDef) (int, bool) {
+	i := sort.Search(len(b.members), func(i int) bool {
+		return service.compare(b.members[i].service) <= 0
+	})
+	return i, i < len(b.members) && service.compare(b.members[i].service) == 0
+}
+
+func weightOf(service *ServiceDef) int {
+	weight, err := strconv.Atoi(service.Labels[WeightLabel])
+	if err != nil || weight < 1 {
+		return 1
+	}
+	if weight > MaxWeight {
+		return MaxWeight
+	}
+	return weight
+}
+
+// Adds service or replaces the member it updates.
+func (b *Balancer) join(service *ServiceDef) {
+	i, found := b.search(service)
+	if found {
+		b.members[i].service = service
+		b.members[i].weight = weightOf(service)
+		return
+	}
+	b.members = append(b.members, nil)
+	copy(b.members[i+1:], b.members[i:])
+	b.members[i] = &member{service: service, weight: weightOf(service)}
+}
+
+func (b *Balancer) leave(service *ServiceDef) {
+	if i, found := b.search(service); found {
+		b.members = append(b.members[:i], b.members[i+1:]...)
+	}
+}
+
+// Returns the current members of the group.
+func (b *Balancer) Services() []*ServiceDef {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	services := make([]*ServiceDef, len(b.members))
+	for i, m := range b.members {
+		services[i] = m.service
+	}
+	return services
+}
+
+// Picks the service to send a request to. Every successful Pick must be
+// followed by a call to Done once the request is over.
+func (b *Balancer) Pick() (*ServiceDef, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	active := make([]*member, 0, len(b.members))
+	for _, m := range b.members {
+		if m.service.active() {
+			active = append(active, m)
+		}
+	}
+	if len(active) == 0 {
+		return nil, ErrNoServices
+	}
+	now := time.Now()
+	candidates := make([]*member, 0, len(active))
+	for _, m := range active {
+		if now.After(m.ejectedUntil) {
+			candidates = append(candidates, m)
+		}
+	}
+	if len(candidates) == 0 {
+		// Some service is better than none.
+		candidates = active
+	}
+
+	var picked *member
+	switch b.strategy {
+	case Random:
+		picked = candidates[b.rand.Intn(len(candidates))]
+	case LeastOutstanding:
+		// Ties are broken in turn.
+		for i := range candidates {
+			m := candidates[(b.next+i)%len(candidates)]
+			if picked == nil || m.outstanding < picked.outstanding {
+				picked = m
+			}
+		}
+		b.next++
+	case Weighted:
+		total := 0
+		for _, m := range candidates {
+			m.current += m.weight
+			total += m.weight
+			if picked == nil || m.current > picked.current {
+				picked = m
+			}
+		}
+		picked.current -= total
+	default:
+		picked = candidates[b.next%len(candidates)]
+		b.next++
+	}
+	picked.outstanding++
+	return picked.service, nil
+}
+
+// Reports that the request sent to service by Pick is over. err is nil if it
+// succeeded.
+func (b *Balancer) Done(service *ServiceDef, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	i, found := b.search(service)
+	if !found {
+		// Left since it was picked.
+		return
+	}
+	m := b.members[i]
+	if m.outstanding > 0 {
+		m.outstanding--
+	}
+	if err == nil {
+		m.failures = 0
+		return
+	}
+	if m.failures++; m.failures >= balancerMaxFailures {
+		m.failures = 0
+		m.ejectedUntil = time.Now().Add(balancerEjectTime)
+	}
+}
+
+// Stops watching the group. Pick keeps using the last members.
+func (b *Balancer) Close() error {
+	return b.client.Ignore(b.group)
+}
+
+// Returns an http.RoundTripper sending each request to a service picked by the
+// balancer. The host and port of the service replace the host of the request
+// URL, the Host header is kept. base, or http.DefaultTransport when nil, sends
+// the requests. Errors and 5xx responses count as failures of the service.
+func (b *Balancer) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &balancerTransport{b, base}
+}
+
+type balancerTransport struct {
+	balancer *Balancer
+	base     http.RoundTripper
+}
+
+func (t *balancerTransport) RoundTrip(req *http.Request) (
+	*http.Response, error) {
+	service, err := t.balancer.Pick()
+	if err != nil {
+		return nil, err
+	}
+	// A RoundTripper may not modify the request.
+	out := new(http.Request)
+	*out = *req
+	url := *req.URL
+	url.Host = net.JoinHostPort(service.Host, strconv.Itoa(int(service.Port)))
+	out.URL = &url
+	res, err := t.base.RoundTrip(out)
+	if err != nil {
+		t.balancer.Done(service, err)
+		return nil, err
+	}
+	if res.StatusCode >= 500 {
+		err = fmt.Errorf("HTTP status %s", res.Status)
+	}
+	// The request is over once the body is closed.
+	res.Body = &balancerBody{ReadCloser: res.Body, done: func() {
+		t.balancer.Done(service, err)
+	}}
+	return res, nil
+}
+
+type balancerBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *balancerBody) Close() error {
+	b.once.Do(b.done)
+	return b.ReadCloser.Close()
+}
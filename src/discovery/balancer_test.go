@@ -0,0 +1,196 @@
+package discovery
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func newTestBalancer(strategy Strategy, services ...*ServiceDef) *Balancer {
+	b := &Balancer{strategy: strategy}
+	for _, service := range services {
+		b.join(service)
+	}
+	return b
+}
+
+// Returns the hosts of n picks, reporting each as done with err.
+func pickHosts(t *testing.T, b *Balancer, n int, err error) string {
+	hosts := ""
+	for i := 0; i < n; i++ {
+		service, e := b.Pick()
+		if e != nil {
+			t.Fatal(e)
+		}
+		b.Done(service, err)
+		hosts += service.Host
+	}
+	return hosts
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	b := newTestBalancer(RoundRobin, &ServiceDef{Host: "b", Group: "g"},
+		&ServiceDef{Host: "a", Group: "g"}, &ServiceDef{Host: "c", Group: "g"})
+	if hosts := pickHosts(t, b, 4, nil); hosts != "abca" {
+		t.Error("Wrong picks", hosts)
+	}
+	b.leave(&ServiceDef{Host: "b", Group: "g"})
+	if hosts := pickHosts(t, b, 2, nil); hosts != "ac" && hosts != "ca" {
+		t.Error("Wrong picks after leave", hosts)
+	}
+	if _, err := newTestBalancer(RoundRobin).Pick(); err != ErrNoServices {
+		t.Error("Expected no services", err)
+	}
+}
+
+func TestBalancerState(t *testing.T) {
+	b := newTestBalancer(RoundRobin, &ServiceDef{Host: "a", Group: "g"},
+		&ServiceDef{Host: "b", Group: "g", State: StateDraining})
+	if hosts := pickHosts(t, b, 2, nil); hosts != "aa" {
+		t.Error("Draining services should not be picked", hosts)
+	}
+	b.join(&ServiceDef{Host: "a", Group: "g", State: StateMaintenance})
+	if _, err := b.Pick(); err != ErrNoServices {
+		t.Error("Expected no active services", err)
+	}
+}
+
+func TestBalancerWeighted(t *testing.T) {
+	b := newTestBalancer(Weighted,
+		&ServiceDef{Host: "a", Group: "g",
+			Labels: map[string]string{WeightLabel: "3"}},
+		&ServiceDef{Host: "b", Group: "g"})
+	if hosts := pickHosts(t, b, 8, nil); hosts != "aabaaaba" {
+		t.Error("Wrong picks", hosts)
+	}
+}
+
+func TestBalancerLeastOutstanding(t *testing.T) {
+	b := newTestBalancer(LeastOutstanding, &ServiceDef{Host: "a", Group: "g"},
+		&ServiceDef{Host: "b", Group: "g"})
+	a, _ := b.Pick()
+	if picked, _ := b.Pick(); picked.Host != "b" {
+		t.Error("Expected b", picked)
+	}
+	b.Done(a, nil)
+	if picked, _ := b.Pick(); picked.Host != "a" {
+		t.Error("Expected a", picked)
+	}
+	if picked, _ := b.Pick(); picked.Host == "" {
+		t.Error("Expected a pick", picked)
+	}
+}
+
+func TestBalancerEject(t *testing.T) {
+	b := newTestBalancer(RoundRobin, &ServiceDef{Host: "a", Group: "g"},
+		&ServiceDef{Host: "b", Group: "g"})
+	a := &ServiceDef{Host: "a", Group: "g"}
+	for i := 0; i < balancerMaxFailures; i++ {
+		b.Pick()
+		b.Done(a, errors.New("Failed"))
+	}
+	if hosts := pickHosts(t, b, 3, nil); hosts != "bbb" {
+		t.Error("Expected a to be ejected", hosts)
+	}
+	// With every service ejected, all of them are picked again.
+	pickHosts(t, b, balancerMaxFailures, errors.New("Failed"))
+	if hosts := pickHosts(t, b, 2, nil); hosts != "ab" && hosts != "ba" {
+		t.Error("Expected both services", hosts)
+	}
+}
+
+func TestBalancerWatch(t *testing.T) {
+	server := NewServer()
+	go server.processEvents()
+	client := connectTestClient(server, JSON)
+	defer client.Close()
+	other := connectTestClient(server, JSON)
+	defer other.Close()
+
+	other.Join(&ServiceDef{Host: "a", Group: "web"})
+	b, err := NewBalancer(client, "web", Random)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Services()) != 1 {
+		t.Error("Wrong services", b.Services())
+	}
+	other.Join(&ServiceDef{Host: "b", Group: "web"})
+	if !waitFor(func() bool { return len(b.Services()) == 2 }) {
+		t.Error("Join not seen", b.Services())
+	}
+	other.Leave(&ServiceDef{Host: "a", Group: "web"})
+	if !waitFor(func() bool { return len(b.Services()) == 1 }) {
+		t.Error("Leave not seen", b.Services())
+	}
+	if service, err := b.Pick(); err != nil || service.Host != "b" {
+		t.Error("Expected b", service, err)
+	}
+	if err = b.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Joins an HTTP test server to group.
+func joinHTTPServer(t *testing.T, client *Client, group string,
+	s *httptest.Server) {
+	host, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	if err := client.Join(
+		&ServiceDef{Host: host, Port: uint16(p), Group: group}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBalancerTransport(t *testing.T) {
+	good := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("good"))
+		}))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "bad", http.StatusServiceUnavailable)
+		}))
+	defer bad.Close()
+
+	server := NewServer()
+	go server.processEvents()
+	client := connectTestClient(server, JSON)
+	defer client.Close()
+	joinHTTPServer(t, client, "web", good)
+	joinHTTPServer(t, client, "web", bad)
+	b, err := NewBalancer(client, "web", RoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	httpClient := &http.Client{Transport: b.Transport(nil)}
+	get := func() string {
+		res, err := httpClient.Get("http://web/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return string(body)
+	}
+	bodies := map[string]int{}
+	for i := 0; i < 2*balancerMaxFailures; i++ {
+		bodies[get()]++
+	}
+	if bodies["good"] != balancerMaxFailures {
+		t.Error("Expected requests to both services", bodies)
+	}
+	// The failing service is ejected.
+	for i := 0; i < 3; i++ {
+		if body := get(); body != "good" {
+			t.Error("Expected the good service", body)
+		}
+	}
+}
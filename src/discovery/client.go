@@ -1,33 +1,648 @@
 package discovery
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net"
 	"net/rpc"
 	"net/rpc/jsonrpc"
+	"strconv"
+	"sync"
+	"time"
 )
 
 const DefaultPort uint16 = 3472 /* DISC */
 
+// Protocol selects the encoding used on a connection. The server detects the
+// protocol of each connection so clients are free to use either.
+type Protocol int
+
+const (
+	// Go's net/rpc json encoding. This is the default.
+	JSON Protocol = iota
+	// Length prefixed protocol buffer messages as defined in discovery.proto.
+	Protobuf
+)
+
+// Returns codecs for serving requests from, and sending requests to, the other
+// end of a single connection. Incoming requests are dispatched to methods of
+// service.
+func newCodecs(rwc io.ReadWriteCloser, protocol Protocol, service string) (
+	rpc.ServerCodec, rpc.ClientCodec) {
+	if protocol == Protobuf {
+		mux := newMultiplexCodec(rwc, service)
+		return mux, mux
+	}
+	mux := newJsonMux(rwc)
+	return jsonrpc.NewServerCodec(mux.requests()),
+		jsonrpc.NewClientCodec(mux.responses())
+}
+
+type EventType int
+
+const (
+	// A service joined a watched group.
+	Joined EventType = iota
+	// A service left a watched group.
+	Left
+)
+
+func (t EventType) String() string {
+	switch t {
+	case Joined:
+		return "joined"
+	case Left:
+		return "left"
+	}
+	return "unknown"
+}
+
+// An Event describes a change to a watched group.
+type Event struct {
+	Type    EventType
+	Service *ServiceDef
+}
+
+func (e *Event) String() string {
+	return fmt.Sprintf("%s %s", e.Type, e.Service)
+}
+
+// ConnState describes the connection of a Client.
+type ConnState int
+
+const (
+	// The client is connected. Reported again after a reconnect, once services
+	// and watches are restored.
+	Connected ConnState = iota
+	// The connection was lost and the client is reconnecting.
+	Disconnected
+	// The client is closed and will not reconnect.
+	Closed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case Connected:
+		return "connected"
+	case Disconnected:
+		return "disconnected"
+	case Closed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// Delay between reconnect attempts. Doubles after every failed attempt up to
+// the maximum. Variables so tests can speed things up.
+var (
+	reconnectMinBackoff = 100 * time.Millisecond
+	reconnectMaxBackoff = 30 * time.Second
+)
+
 type Client struct {
+	// Protocol used by Connect.
+	Protocol Protocol
+	// When set, Connect uses TLS. See NewClientTLSConfig.
+	TLSConfig *tls.Config
+	// When set, the client authenticates with this bearer token on every
+	// connection before making any other call.
+	Token string
+	// When set, a client that loses its connection reconnects with backoff,
+	// joins the services it had joined again and restores its watches, retrying
+	// those the server rejects. It is Connected again once all are restored.
+	// Calls made while disconnected fail. Only a connection made by a
+	// successful Connect is restored, a failed Connect is not retried.
+	Reconnect bool
+	// Called, when set, every time the state of the connection changes.
+	StateChanged func(state ConnState)
+
+	// Guards the fields below.
+	lock   sync.Mutex
 	client *rpc.Client
+	// Opens a new connection to the server. Set by Connect.
+	dial func() (net.Conn, error)
+	// Watched groups.
+	watches map[string]*watch
+	// Services joined through this client, by key.
+	services map[serviceKey]*ServiceDef
+	// Closed to stop the script check of a service, by key.
+	checks map[serviceKey]chan bool
+	closed bool
+	// Last state reported by setState.
+	state ConnState
+	// Delay before the next reconnect attempt. Reset once Connected.
+	backoff time.Duration
+	// Closed by Close to stop reconnecting.
+	quit chan bool
 }
 
+// clientService receives the requests sent by the server on the client's
+// connection.
+type clientService struct {
+	client *Client
+}
+
+func (s *clientService) Join(service *ServiceDef, v *Void) error {
+	s.client.dispatch(&Event{Joined, service})
+	return nil
+}
+
+func (s *clientService) Leave(service *ServiceDef, v *Void) error {
+	s.client.dispatch(&Event{Left, service})
+	return nil
+}
+
+// Connects to the server at host:port. When Token is set, the client also
+// authenticates and is closed if that fails. Errors are returned without
+// retrying, even when Reconnect is set.
 func (c *Client) Connect(host string, port uint16) error {
-	client, err := jsonrpc.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
+	address := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	c.dial = func() (net.Conn, error) {
+		if c.TLSConfig != nil {
+			return tls.Dial("tcp", address, c.TLSConfig)
+		}
+		return net.Dial("tcp", address)
+	}
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	c.attach(conn)
+	if err = c.authenticate(); err != nil {
+		c.Close()
+		return err
+	}
+	return nil
+}
+
+// Presents the token of the client on the current connection.
+func (c *Client) authenticate() error {
+	if c.Token == "" {
+		return nil
+	}
+	return c.call("Discovery.Authenticate", c.Token, &Void{})
+}
+
+// Sets up the rpc client on an established connection. The server may also
+// send requests to the client, e.g. when watching a group, so the connection
+// is served as well.
+func (c *Client) attach(conn net.Conn) {
+	serverCodec, clientCodec := newCodecs(conn, c.Protocol, "DiscoveryClient")
+	client := rpc.NewClientWithCodec(clientCodec)
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		client.Close()
+		return
+	}
 	c.client = client
-	return err
+	if c.quit == nil {
+		c.quit = make(chan bool)
+	}
+	c.lock.Unlock()
+
+	server := rpc.NewServer()
+	server.RegisterName("DiscoveryClient", &clientService{c})
+	go func() {
+		server.ServeCodec(serverCodec)
+		client.Close()
+		c.disconnected()
+	}()
+}
+
+func (c *Client) setState(state ConnState) {
+	c.lock.Lock()
+	c.state = state
+	c.lock.Unlock()
+	if c.StateChanged != nil {
+		c.StateChanged(state)
+	}
+}
+
+// Returns the state of the connection, Connected until it is first lost.
+func (c *Client) State() ConnState {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.state
+}
+
+// Called when the connection closes.
+func (c *Client) disconnected() {
+	c.lock.Lock()
+	if !c.Reconnect || c.dial == nil {
+		c.closed = true
+	}
+	closed := c.closed
+	c.lock.Unlock()
+	if closed {
+		// No more events will arrive.
+		c.closeWatches()
+		c.setState(Closed)
+		return
+	}
+	c.setState(Disconnected)
+	c.reconnect()
+}
+
+// Connects again, waiting longer after every failed attempt, then restores the
+// services and watches of the client. The delay keeps growing when the new
+// connection is lost before the client is Connected.
+func (c *Client) reconnect() {
+	for {
+		select {
+		case <-c.quit:
+			return
+		case <-time.After(c.nextBackoff()):
+		}
+		conn, err := c.dial()
+		if err != nil {
+			log.Println("Reconnect failed:", err)
+			continue
+		}
+		c.attach(conn)
+		err = c.authenticate()
+		if _, ok := err.(rpc.ServerError); ok {
+			// The token is no longer accepted. Retrying will not help.
+			log.Println("Authentication failed:", err)
+			c.Close()
+			return
+		}
+		if err == nil && c.restore() {
+			c.lock.Lock()
+			c.backoff = 0
+			c.lock.Unlock()
+			c.setState(Connected)
+		}
+		// Otherwise the connection was lost and the client reconnects once it
+		// is closed.
+		return
+	}
+}
+
+// Returns the delay before the next reconnect attempt and doubles it.
+func (c *Client) nextBackoff() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	backoff := c.backoff
+	if backoff == 0 {
+		backoff = reconnectMinBackoff
+	}
+	if c.backoff = backoff * 2; c.backoff > reconnectMaxBackoff {
+		c.backoff = reconnectMaxBackoff
+	}
+	return backoff
+}
+
+// Joins the services of the client again and restarts its watches after the
+// last revision they have seen. Joins and watches the server rejects, e.g.
+// while a cluster elects a leader, are retried with backoff until they
+// succeed. Returns false if the connection is lost or the client is closed
+// first.
+func (c *Client) restore() bool {
+	c.lock.Lock()
+	services := make(map[serviceKey]*ServiceDef, len(c.services))
+	for key, service := range c.services {
+		services[key] = service
+	}
+	watches := make(map[string]*watch, len(c.watches))
+	for group, w := range c.watches {
+		watches[group] = w
+	}
+	c.lock.Unlock()
+
+	backoff := reconnectMinBackoff
+	for {
+		if !c.restoreServices(services) || !c.restoreWatches(watches) {
+			return false
+		}
+		if len(services) == 0 && len(watches) == 0 {
+			return true
+		}
+		select {
+		case <-c.quit:
+			return false
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > reconnectMaxBackoff {
+			backoff = reconnectMaxBackoff
+		}
+	}
+}
+
+// Joins services again, removing the ones that joined or left in the meantime.
+// Returns false if the connection is lost.
+func (c *Client) restoreServices(services map[serviceKey]*ServiceDef) bool {
+	for key, service := range services {
+		c.lock.Lock()
+		current := c.services[key]
+		c.lock.Unlock()
+		if current != service {
+			// Left, or joined again by the application.
+			delete(services, key)
+			continue
+		}
+		err := c.call("Discovery.Join", service, &Void{})
+		if err == nil {
+			delete(services, key)
+		} else if _, ok := err.(rpc.ServerError); ok {
+			log.Println("Unable to join", service, "again:", err)
+		} else {
+			return false
+		}
+	}
+	return true
+}
+
+// Watches groups again, removing the ones that are restored or ignored in the
+// meantime. Returns false if the connection is lost.
+func (c *Client) restoreWatches(watches map[string]*watch) bool {
+	for group, w := range watches {
+		c.lock.Lock()
+		current := c.watches[group]
+		c.lock.Unlock()
+		if current != w {
+			delete(watches, group)
+			continue
+		}
+		w.begin()
+		var snapshot Snapshot
+		err := c.call("Discovery.WatchGroup",
+			&WatchArgs{group, w.lastRevision(), w.selector}, &snapshot)
+		if err == nil {
+			w.established(&snapshot, false)
+			delete(watches, group)
+		} else if _, ok := err.(rpc.ServerError); ok {
+			log.Println("Unable to watch", group, "again:", err)
+		} else {
+			return false
+		}
+	}
+	return true
 }
 
+// Calls method on the current connection.
+func (c *Client) call(method string, args interface{}, reply interface{}) error {
+	c.lock.Lock()
+	client := c.client
+	c.lock.Unlock()
+	if client == nil {
+		return rpc.ErrShutdown
+	}
+	return client.Call(method, args, reply)
+}
+
+// Closes the connection. The client does not reconnect after Close.
+func (c *Client) Close() error {
+	c.lock.Lock()
+	client := c.client
+	if !c.closed {
+		c.closed = true
+		if c.quit != nil {
+			close(c.quit)
+		}
+	}
+	c.lock.Unlock()
+	if client == nil {
+		return nil
+	}
+	return client.Close()
+}
+
+// Joins service to its group. If the service has a script check, the client
+// runs it until the service leaves and reports the results to the server.
 func (c *Client) Join(service *ServiceDef) error {
-	return c.client.Call("Discovery.Join", service, &Void{})
+	err := c.call("Discovery.Join", service, &Void{})
+	if err == nil {
+		def := *service
+		key := keyOf(&def)
+		c.lock.Lock()
+		if c.services == nil {
+			c.services = make(map[serviceKey]*ServiceDef)
+			c.checks = make(map[serviceKey]chan bool)
+		}
+		c.services[key] = &def
+		if stop, ok := c.checks[key]; ok {
+			close(stop)
+			delete(c.checks, key)
+		}
+		if def.Check != nil && def.Check.Type == CheckScript {
+			stop := make(chan bool)
+			c.checks[key] = stop
+			go c.runScriptCheck(&def, stop, c.quit)
+		}
+		c.lock.Unlock()
+	}
+	return err
 }
 
 func (c *Client) Leave(service *ServiceDef) error {
-	return c.client.Call("Discovery.Leave", service, &Void{})
+	err := c.call("Discovery.Leave", service, &Void{})
+	if err == nil {
+		key := keyOf(service)
+		c.lock.Lock()
+		delete(c.services, key)
+		if stop, ok := c.checks[key]; ok {
+			close(stop)
+			delete(c.checks, key)
+		}
+		c.lock.Unlock()
+	}
+	return err
 }
 
+// Reports the health of a service joined through this client, e.g. the result
+// of a check run by an agent.
+func (c *Client) SetHealth(service *ServiceDef, healthy bool) error {
+	def := *service
+	def.Unhealthy = !healthy
+	return c.call("Discovery.SetHealth", &def, &Void{})
+}
+
+// Sets the state of a service, one of StateActive, StateDraining or
+// StateMaintenance. A service joined through this client keeps the state when
+// it is joined again after a reconnect. Other services may be changed when the
+// policy of the server allows the admin operation.
+func (c *Client) SetState(service *ServiceDef, state string) error {
+	def := *service
+	def.State = state
+	err := c.call("Discovery.SetState", &def, &Void{})
+	if err == nil {
+		c.lock.Lock()
+		if joined, ok := c.services[keyOf(&def)]; ok {
+			joined.State = state
+		}
+		c.lock.Unlock()
+	}
+	return err
+}
+
+// Runs the script check of service on its interval and reports the results
+// until stop or quit is closed.
+func (c *Client) runScriptCheck(service *ServiceDef, stop, quit chan bool) {
+	for {
+		err := service.Check.run(context.Background(), service.Host,
+			service.Port)
+		if err != nil {
+			log.Println("Check failed:", service, err)
+		}
+		if err = c.SetHealth(service, err == nil); err != nil {
+			log.Println("Unable to report health of", service, err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-quit:
+			return
+		case <-time.After(service.Check.interval()):
+		}
+	}
+}
+
+// Renews the lease of a service joined with a non-zero TTL. Must be called
+// more often than the TTL for the service to stay registered.
+func (c *Client) Heartbeat(service *ServiceDef) error {
+	return c.call("Discovery.Heartbeat", service, &Void{})
+}
+
+// Returns the services in group. When group is a prefix ending in "/", e.g.
+// "prod/", returns the services of every group under it.
 func (c *Client) Snapshot(group string) ([]*ServiceDef, error) {
-	var services []*ServiceDef
-	err := c.client.Call("Discovery.Snapshot", group, &services)
-	return services, err
+	snapshot, err := c.SnapshotSelector(group, "")
+	return snapshot.Services, err
+}
+
+// Like Snapshot, but also returns the revision of the snapshot, which Watch
+// can resume from.
+func (c *Client) SnapshotRevision(group string) (*Snapshot, error) {
+	return c.SnapshotSelector(group, "")
+}
+
+// Returns the services in group that match selector. See Selector for the
+// syntax.
+func (c *Client) SnapshotSelector(group, selector string) (*Snapshot, error) {
+	var snapshot Snapshot
+	err := c.call("Discovery.SnapshotGroup", &SnapshotArgs{group, selector},
+		&snapshot)
+	return &snapshot, err
+}
+
+// Lists the groups with at least one service whose name starts with prefix.
+// An empty prefix lists every group.
+func (c *Client) ListGroups(prefix string) (*GroupList, error) {
+	var list GroupList
+	err := c.call("Discovery.ListGroups", &ListGroupsArgs{prefix}, &list)
+	return &list, err
+}
+
+// Starts watching group. Returns the current members of the group and a
+// channel of the changes that happen after the snapshot was taken. The channel
+// is closed by Ignore or when the connection is closed.
+//
+// When group is a prefix ending in "/", the watch covers every group under it
+// and events hold the group of each service. Watches may not overlap: a
+// client has a single watch per group, and watching a group again, or a
+// prefix above or a group under a watched one, fails until it is ignored. This
+// includes the watches of the Balancers, Rings and Resolvers using the client.
+func (c *Client) Watch(group string) (*Snapshot, <-chan *Event, error) {
+	return c.watch(&WatchArgs{Group: group})
+}
+
+// Starts watching the services in group that match selector. A service that
+// stops matching when it joins again with other labels is sent as a Left
+// event, one that starts matching as a Joined event.
+func (c *Client) WatchSelector(group, selector string) (
+	*Snapshot, <-chan *Event, error) {
+	return c.watch(&WatchArgs{Group: group, Selector: selector})
+}
+
+// Starts watching group after revision, typically the revision of the last
+// event seen before a reconnect. If the server still knows every change since
+// revision, the returned snapshot is marked Resumed and those changes are sent
+// on the channel first. Otherwise it holds the current members of the group as
+// Watch does.
+func (c *Client) WatchFrom(group string, revision uint64) (
+	*Snapshot, <-chan *Event, error) {
+	return c.watch(&WatchArgs{Group: group, Revision: revision})
+}
+
+func (c *Client) watch(args *WatchArgs) (*Snapshot, <-chan *Event, error) {
+	group := args.Group
+	w := newWatch()
+	w.selector = args.Selector
+	c.lock.Lock()
+	if c.watches == nil {
+		c.watches = make(map[string]*watch)
+	}
+	if _, ok := c.watches[group]; ok {
+		c.lock.Unlock()
+		return nil, nil, errors.New("Already watching group: " + group)
+	}
+	// Events are dispatched by group, so a service must belong to one watch.
+	for name := range c.watches {
+		if inGroup(name, group) || inGroup(group, name) {
+			c.lock.Unlock()
+			return nil, nil, fmt.Errorf("Watch of %s overlaps watch of %s",
+				group, name)
+		}
+	}
+	// Register before calling the server as events may arrive before the reply.
+	c.watches[group] = w
+	c.lock.Unlock()
+
+	w.setRevision(args.Revision)
+	w.begin()
+	var snapshot Snapshot
+	err := c.call("Discovery.WatchGroup", args, &snapshot)
+	if err != nil {
+		c.removeWatch(group)
+		return nil, nil, err
+	}
+	w.established(&snapshot, true)
+	return &snapshot, w.events, nil
+}
+
+// Stops watching group and closes the channel returned by Watch.
+func (c *Client) Ignore(group string) error {
+	err := c.call("Discovery.Ignore", group, &Void{})
+	c.removeWatch(group)
+	return err
+}
+
+func (c *Client) removeWatch(group string) {
+	c.lock.Lock()
+	w, ok := c.watches[group]
+	delete(c.watches, group)
+	c.lock.Unlock()
+	if ok {
+		w.close()
+	}
+}
+
+func (c *Client) closeWatches() {
+	c.lock.Lock()
+	watches := c.watches
+	c.watches = nil
+	c.lock.Unlock()
+	for _, w := range watches {
+		w.close()
+	}
+}
+
+// Sends an event to the watch of the service's group, or of a prefix above it.
+func (c *Client) dispatch(event *Event) {
+	var w *watch
+	c.lock.Lock()
+	for _, group := range groupAndPrefixes(event.Service.Group) {
+		if w = c.watches[group]; w != nil {
+			break
+		}
+	}
+	c.lock.Unlock()
+	if w != nil {
+		w.push(event)
+	}
 }
@@ -0,0 +1,606 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Returns the next event or fails the test if the channel is closed.
+func nextEvent(t *testing.T, events <-chan *Event) *Event {
+	event, ok := <-events
+	if !ok {
+		t.Fatal("Event channel closed")
+	}
+	return event
+}
+
+func testClientWatch(t *testing.T, protocol Protocol) {
+	server := NewServer()
+	go server.processEvents()
+	client := connectTestClient(server, protocol)
+	defer client.Close()
+	other := connectTestClient(server, protocol)
+	defer other.Close()
+
+	if err := other.Join(&ServiceDef{Host: "a", Group: "group"}); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, events, err := client.Watch("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Services) != 1 || snapshot.Services[0].Host != "a" {
+		t.Error("Wrong snapshot", snapshot)
+	}
+	if _, _, err = client.Watch("group"); err == nil {
+		t.Error("Duplicate watch should fail")
+	}
+
+	other.Join(&ServiceDef{Host: "b", Group: "group"})
+	other.Join(&ServiceDef{Host: "c", Group: "other"})
+	other.Leave(&ServiceDef{Host: "a", Group: "group"})
+
+	event := nextEvent(t, events)
+	if event.Type != Joined || event.Service.Host != "b" {
+		t.Error("Expected join of b", event)
+	}
+	event = nextEvent(t, events)
+	if event.Type != Left || event.Service.Host != "a" ||
+		event.Service.Group != "group" {
+		t.Error("Expected leave of a", event)
+	}
+
+	if err = client.Ignore("group"); err != nil {
+		t.Error(err)
+	}
+	if _, ok := <-events; ok {
+		t.Error("Ignore should close the event channel")
+	}
+
+	_, events, err = client.Watch("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Close()
+	// Closing the connection of other leaves its services.
+	event = nextEvent(t, events)
+	if event.Type != Left || event.Service.Host != "c" {
+		t.Error("Expected leave of c", event)
+	}
+	client.Close()
+	for _ = range events {
+	}
+}
+
+func TestClientWatchJSON(t *testing.T) {
+	testClientWatch(t, JSON)
+}
+
+func TestClientWatchProtobuf(t *testing.T) {
+	testClientWatch(t, Protobuf)
+}
+
+func TestClientWatchBuffer(t *testing.T) {
+	server := NewServer()
+	go server.processEvents()
+	client := connectTestClient(server, JSON)
+	defer client.Close()
+	other := connectTestClient(server, JSON)
+	defer other.Close()
+	_, events, err := client.Watch("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := client.watches["group"]
+
+	// The application does not receive events, the client buffers at most
+	// eventBufferSize of them in the channel and as many in the queue.
+	joins := 3 * eventBufferSize
+	for i := 0; i < joins; i++ {
+		other.Join(&ServiceDef{Host: "h", Port: uint16(i), Group: "group"})
+	}
+	queued := func() int {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		return len(w.queue)
+	}
+	if !waitFor(func() bool { return queued() == eventBufferSize }) {
+		t.Fatal("Queue not filled", queued())
+	}
+	time.Sleep(50 * time.Millisecond)
+	if queued() != eventBufferSize || len(events) != eventBufferSize {
+		t.Error("Too many events buffered", queued(), len(events))
+	}
+
+	// The rest follows once the application catches up.
+	for i := 0; i < joins; i++ {
+		if event := nextEvent(t, events); event.Service.Port != uint16(i) {
+			t.Fatal("Wrong event", i, event)
+		}
+	}
+}
+
+func testClientLabels(t *testing.T, protocol Protocol) {
+	server := NewServer()
+	go server.processEvents()
+	client := connectTestClient(server, protocol)
+	defer client.Close()
+	_, events, err := client.Watch("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := &ServiceDef{Host: "a", Group: "group", CustomData: []byte{1},
+		Labels: map[string]string{"version": "1.2", "zone": "us-east-1a"},
+		Tags:   []string{"canary", "blue"}}
+	if err = client.Join(service); err != nil {
+		t.Fatal(err)
+	}
+	check := func(def *ServiceDef) {
+		if len(def.Labels) != 2 || def.Labels["version"] != "1.2" ||
+			def.Labels["zone"] != "us-east-1a" || len(def.Tags) != 2 ||
+			def.Tags[0] != "canary" || def.Tags[1] != "blue" ||
+			len(def.CustomData) != 1 {
+			t.Error("Wrong metadata", def)
+		}
+	}
+	check(nextEvent(t, events).Service)
+	snapshot, err := client.Snapshot("group")
+	if err != nil || len(snapshot) != 1 {
+		t.Fatal("Wrong snapshot", snapshot, err)
+	}
+	check(snapshot[0])
+}
+
+func TestClientLabelsJSON(t *testing.T) {
+	testClientLabels(t, JSON)
+}
+
+func TestClientLabelsProtobuf(t *testing.T) {
+	testClientLabels(t, Protobuf)
+}
+
+func testClientSelector(t *testing.T, protocol Protocol) {
+	server := NewServer()
+	go server.processEvents()
+	client := connectTestClient(server, protocol)
+	defer client.Close()
+	other := connectTestClient(server, protocol)
+	defer other.Close()
+
+	zone := func(host, zone string) *ServiceDef {
+		return &ServiceDef{Host: host, Group: "group",
+			Labels: map[string]string{"zone": zone}}
+	}
+	other.Join(zone("a", "a"))
+	other.Join(zone("b", "b"))
+	snapshot, err := client.SnapshotSelector("group", "zone=a")
+	if err != nil || len(snapshot.Services) != 1 ||
+		snapshot.Services[0].Host != "a" {
+		t.Fatal("Wrong snapshot", snapshot, err)
+	}
+	if _, err = client.SnapshotSelector("group", "zone in (a"); err == nil {
+		t.Error("Invalid selector should fail")
+	}
+	snapshot, events, err := client.WatchSelector("group", "zone=a")
+	if err != nil || len(snapshot.Services) != 1 {
+		t.Fatal("Wrong watch snapshot", snapshot, err)
+	}
+
+	// Services entering and leaving the selection by changing labels are
+	// sent as joins and leaves.
+	other.Join(zone("b", "a"))
+	other.Join(zone("a", "b"))
+	other.Join(zone("c", "b"))
+	other.Leave(zone("b", "a"))
+	other.Join(zone("d", "a"))
+
+	expected := []struct {
+		eventType EventType
+		host      string
+	}{{Joined, "b"}, {Left, "a"}, {Left, "b"}, {Joined, "d"}}
+	for _, e := range expected {
+		event := nextEvent(t, events)
+		if event.Type != e.eventType || event.Service.Host != e.host {
+			t.Error("Expected", e.eventType, "of", e.host, "got", event)
+		}
+	}
+}
+
+func TestClientSelectorJSON(t *testing.T) {
+	testClientSelector(t, JSON)
+}
+
+func TestClientSelectorProtobuf(t *testing.T) {
+	testClientSelector(t, Protobuf)
+}
+
+func testClientWatchPrefix(t *testing.T, protocol Protocol) {
+	server := NewServer()
+	go server.processEvents()
+	client := connectTestClient(server, protocol)
+	defer client.Close()
+	other := connectTestClient(server, protocol)
+	defer other.Close()
+
+	other.Join(&ServiceDef{Host: "a", Group: "prod/us/api"})
+	other.Join(&ServiceDef{Host: "b", Group: "dev/us/api"})
+	if err := other.Join(&ServiceDef{Host: "c", Group: "prod/"}); err == nil {
+		t.Error("Joining a prefix should fail")
+	}
+	snapshot, events, err := client.Watch("prod/")
+	if err != nil || len(snapshot.Services) != 1 ||
+		snapshot.Services[0].Group != "prod/us/api" {
+		t.Fatal("Wrong snapshot", snapshot, err)
+	}
+	if _, _, err = client.Watch("prod/us/api"); err == nil {
+		t.Error("Overlapping watch should fail")
+	}
+
+	other.Join(&ServiceDef{Host: "c", Group: "dev/eu/api"})
+	other.Join(&ServiceDef{Host: "d", Group: "prod/eu/web"})
+	other.Leave(&ServiceDef{Host: "a", Group: "prod/us/api"})
+	event := nextEvent(t, events)
+	if event.Type != Joined || event.Service.Group != "prod/eu/web" {
+		t.Error("Expected join to prod/eu/web", event)
+	}
+	event = nextEvent(t, events)
+	if event.Type != Left || event.Service.Group != "prod/us/api" {
+		t.Error("Expected leave of prod/us/api", event)
+	}
+
+	services, err := client.Snapshot("dev/")
+	if err != nil || len(services) != 2 {
+		t.Error("Wrong snapshot of dev/", services, err)
+	}
+}
+
+func TestClientWatchPrefixJSON(t *testing.T) {
+	testClientWatchPrefix(t, JSON)
+}
+
+func TestClientWatchPrefixProtobuf(t *testing.T) {
+	testClientWatchPrefix(t, Protobuf)
+}
+
+func testClientListGroups(t *testing.T, protocol Protocol) {
+	server := NewServer()
+	go server.processEvents()
+	client := connectTestClient(server, protocol)
+	defer client.Close()
+
+	client.Join(&ServiceDef{Host: "a", Group: "prod/api"})
+	client.Join(&ServiceDef{Host: "b", Group: "prod/api"})
+	client.Join(&ServiceDef{Host: "c", Group: "dev/api"})
+	client.Join(&ServiceDef{Host: "d", Group: "prod/web"})
+	client.Leave(&ServiceDef{Host: "d", Group: "prod/web"})
+	client.Join(&ServiceDef{Host: "e", Group: "prod/web"})
+
+	list, err := client.ListGroups("")
+	if err != nil || len(list.Groups) != 3 || list.Revision == 0 {
+		t.Fatal("Wrong groups", list, err)
+	}
+	if list.Groups[0].Name != "dev/api" || list.Groups[1].Name != "prod/api" ||
+		list.Groups[1].Services != 2 || list.Groups[2].Name != "prod/web" ||
+		list.Groups[2].Revision != list.Revision {
+		t.Error("Wrong groups", list.Groups[0], list.Groups[1], list.Groups[2])
+	}
+	if list.Groups[0].Revision <= list.Groups[1].Revision {
+		t.Error("Wrong revisions", list.Groups[0], list.Groups[1])
+	}
+
+	list, err = client.ListGroups("prod/")
+	if err != nil || len(list.Groups) != 2 || list.Groups[0].Name != "prod/api" {
+		t.Error("Wrong groups under prod/", list, err)
+	}
+	list, err = client.ListGroups("test/")
+	if err != nil || len(list.Groups) != 0 {
+		t.Error("Expected no groups", list, err)
+	}
+}
+
+func TestClientListGroupsJSON(t *testing.T) {
+	testClientListGroups(t, JSON)
+}
+
+func TestClientListGroupsProtobuf(t *testing.T) {
+	testClientListGroups(t, Protobuf)
+}
+
+func testClientWatchFrom(t *testing.T, protocol Protocol) {
+	server := NewServer()
+	server.SetHistorySize(3)
+	go server.processEvents()
+	client := connectTestClient(server, protocol)
+	defer client.Close()
+	other := connectTestClient(server, protocol)
+	defer other.Close()
+
+	other.Join(&ServiceDef{Host: "a", Group: "group"})
+	snapshot, err := client.SnapshotRevision("group")
+	if err != nil || len(snapshot.Services) != 1 {
+		t.Fatal("Wrong snapshot", snapshot, err)
+	}
+	revision := snapshot.Revision
+	if snapshot.Services[0].Revision != revision {
+		t.Error("Wrong service revision", snapshot.Services[0].Revision)
+	}
+	other.Join(&ServiceDef{Host: "b", Group: "group"})
+	other.Leave(&ServiceDef{Host: "a", Group: "group"})
+
+	// Resumes with the changes since the snapshot.
+	snapshot, events, err := client.WatchFrom("group", revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !snapshot.Resumed || len(snapshot.Services) != 0 ||
+		snapshot.Revision != revision+2 {
+		t.Error("Expected to resume", snapshot)
+	}
+	event := nextEvent(t, events)
+	if event.Type != Joined || event.Service.Host != "b" ||
+		event.Service.Revision != revision+1 {
+		t.Error("Expected join of b", event)
+	}
+	event = nextEvent(t, events)
+	if event.Type != Left || event.Service.Host != "a" ||
+		event.Service.Revision != revision+2 {
+		t.Error("Expected leave of a", event)
+	}
+	client.Ignore("group")
+
+	// Falls back to a snapshot once the history no longer has the changes.
+	other.Join(&ServiceDef{Host: "c", Group: "other"})
+	other.Join(&ServiceDef{Host: "d", Group: "other"})
+	snapshot, _, err = client.WatchFrom("group", revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Resumed || len(snapshot.Services) != 1 ||
+		snapshot.Services[0].Host != "b" {
+		t.Error("Expected a snapshot", snapshot)
+	}
+	client.Ignore("group")
+
+	// Revisions from the future are unknown.
+	snapshot, _, err = client.WatchFrom("group", revision+100)
+	if err != nil || snapshot.Resumed || len(snapshot.Services) != 1 {
+		t.Error("Expected a snapshot", snapshot, err)
+	}
+}
+
+func TestClientWatchFromJSON(t *testing.T) {
+	testClientWatchFrom(t, JSON)
+}
+
+func TestClientWatchFromProtobuf(t *testing.T) {
+	testClientWatchFrom(t, Protobuf)
+}
+
+// Connects a client that reconnects to server. The client only dials again
+// after a value is sent on the returned channel. The returned function closes
+// the current connection.
+func connectReconnectingClient(server *Server, protocol Protocol,
+	states chan ConnState) (*Client, chan bool, func()) {
+	reconnectMinBackoff = time.Millisecond
+	conns := make(chan net.Conn, 1)
+	dial := make(chan bool)
+	client := &Client{
+		Protocol:     protocol,
+		Reconnect:    true,
+		StateChanged: func(state ConnState) { states <- state }}
+	client.dial = func() (net.Conn, error) {
+		read, write := net.Pipe()
+		go server.handleConnection(read)
+		conns <- write
+		return write, nil
+	}
+	conn, _ := client.dial()
+	client.attach(conn)
+	client.dial = func() (net.Conn, error) {
+		<-dial
+		read, write := net.Pipe()
+		go server.handleConnection(read)
+		conns <- write
+		return write, nil
+	}
+	return client, dial, func() { (<-conns).Close() }
+}
+
+func nextState(t *testing.T, states chan ConnState) ConnState {
+	select {
+	case state := <-states:
+		return state
+	case <-time.After(5 * time.Second):
+		t.Fatal("No state change")
+	}
+	return 0
+}
+
+func testClientReconnect(t *testing.T, protocol Protocol, historySize int) {
+	server := NewServer()
+	server.SetHistorySize(historySize)
+	go server.processEvents()
+	states := make(chan ConnState, 4)
+	client, dial, disconnect :=
+		connectReconnectingClient(server, protocol, states)
+	other := connectTestClient(server, protocol)
+	defer other.Close()
+
+	if err := client.Join(&ServiceDef{Host: "self", Group: "self"}); err != nil {
+		t.Fatal(err)
+	}
+	other.Join(&ServiceDef{Host: "a", Group: "group"})
+	other.Join(&ServiceDef{Host: "b", Group: "group"})
+	_, events, err := client.Watch("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	disconnect()
+	if state := nextState(t, states); state != Disconnected {
+		t.Error("Expected to be disconnected", state)
+	}
+	if _, err = client.Snapshot("group"); err == nil {
+		t.Error("Calls should fail while disconnected")
+	}
+	other.Leave(&ServiceDef{Host: "a", Group: "group"})
+	other.Join(&ServiceDef{Host: "c", Group: "group"})
+	dial <- true
+	if state := nextState(t, states); state != Connected {
+		t.Error("Expected to be connected", state)
+	}
+
+	// The changes made while disconnected are delivered.
+	event := nextEvent(t, events)
+	if event.Type != Left || event.Service.Host != "a" {
+		t.Error("Expected leave of a", event)
+	}
+	event = nextEvent(t, events)
+	if event.Type != Joined || event.Service.Host != "c" {
+		t.Error("Expected join of c", event)
+	}
+	other.Leave(&ServiceDef{Host: "b", Group: "group"})
+	event = nextEvent(t, events)
+	if event.Type != Left || event.Service.Host != "b" {
+		t.Error("Expected leave of b", event)
+	}
+
+	// The service was joined again.
+	snapshot, err := other.Snapshot("self")
+	if err != nil || len(snapshot) != 1 {
+		t.Error("Service not joined again", snapshot, err)
+	}
+
+	client.Close()
+	if state := nextState(t, states); state != Closed {
+		t.Error("Expected to be closed", state)
+	}
+	for _ = range events {
+	}
+}
+
+func TestClientReconnectJSON(t *testing.T) {
+	testClientReconnect(t, JSON, DefaultHistorySize)
+}
+
+func TestClientReconnectProtobuf(t *testing.T) {
+	testClientReconnect(t, Protobuf, DefaultHistorySize)
+}
+
+// Without a history the watch is restored from a snapshot.
+func TestClientReconnectSnapshot(t *testing.T) {
+	testClientReconnect(t, JSON, 0)
+}
+
+// Joins and watches the server fails to restore are retried before the client
+// is connected again.
+func TestClientReconnectRetry(t *testing.T) {
+	server := NewServer()
+	go server.processEvents()
+	states := make(chan ConnState, 4)
+	client, dial, disconnect := connectReconnectingClient(server, JSON, states)
+	defer client.Close()
+	other := connectTestClient(server, JSON)
+	defer other.Close()
+
+	if err := client.Join(&ServiceDef{Host: "self", Group: "self"}); err != nil {
+		t.Fatal(err)
+	}
+	_, events, err := client.Watch("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	disconnect()
+	if state := nextState(t, states); state != Disconnected {
+		t.Error("Expected to be disconnected", state)
+	}
+	if !waitFor(func() bool {
+		snapshot, err := other.Snapshot("self")
+		return err == nil && len(snapshot) == 0
+	}) {
+		t.Fatal("Service not removed")
+	}
+
+	// Requests time out while the event loop is blocked.
+	release := make(chan bool)
+	server.eventChan <- func() { <-release }
+	dial <- true
+	time.Sleep(methodTimeout + 100*time.Millisecond)
+	select {
+	case state := <-states:
+		t.Error("Connected before the service joined again", state)
+	default:
+	}
+	close(release)
+	if state := nextState(t, states); state != Connected {
+		t.Error("Expected to be connected", state)
+	}
+	snapshot, err := other.Snapshot("self")
+	if err != nil || len(snapshot) != 1 {
+		t.Error("Service not joined again", snapshot, err)
+	}
+	other.Join(&ServiceDef{Host: "a", Group: "group"})
+	if event := nextEvent(t, events); event.Service.Host != "a" {
+		t.Error("Expected join of a", event)
+	}
+}
+
+// A client keeps reconnecting when the connection is lost while it
+// authenticates, and gives up once the server rejects its token.
+func TestClientReconnectAuthentication(t *testing.T) {
+	reconnectMinBackoff = time.Millisecond
+	server := NewServer()
+	server.SetTokenVerifier(testTokens{"secret": "pay"})
+	go server.processEvents()
+	rejecting := NewServer()
+	rejecting.SetTokenVerifier(testTokens{})
+	go rejecting.processEvents()
+
+	states := make(chan ConnState, 4)
+	conns := make(chan net.Conn, 1)
+	connect := func(server *Server) (net.Conn, error) {
+		read, write := net.Pipe()
+		go server.handleConnection(read)
+		conns <- write
+		return write, nil
+	}
+	client := &Client{
+		Token:        "secret",
+		Reconnect:    true,
+		StateChanged: func(state ConnState) { states <- state }}
+	defer client.Close()
+	conn, _ := connect(server)
+	client.attach(conn)
+	if err := client.authenticate(); err != nil {
+		t.Fatal(err)
+	}
+	dial := make(chan func() (net.Conn, error))
+	client.dial = func() (net.Conn, error) { return (<-dial)() }
+
+	(<-conns).Close()
+	if state := nextState(t, states); state != Disconnected {
+		t.Error("Expected to be disconnected", state)
+	}
+	dial <- func() (net.Conn, error) {
+		read, write := net.Pipe()
+		read.Close()
+		return write, nil
+	}
+	if state := nextState(t, states); state != Disconnected {
+		t.Error("Expected to reconnect again", state)
+	}
+	dial <- func() (net.Conn, error) { return connect(server) }
+	if state := nextState(t, states); state != Connected {
+		t.Error("Expected to be connected", state)
+	}
+
+	(<-conns).Close()
+	if state := nextState(t, states); state != Disconnected {
+		t.Error("Expected to be disconnected", state)
+	}
+	dial <- func() (net.Conn, error) { return connect(rejecting) }
+	if state := nextState(t, states); state != Closed {
+		t.Error("Expected to be closed", state)
+	}
+}
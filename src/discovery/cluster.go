@@ -0,0 +1,360 @@
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"time"
+)
+
+// Commands change the registry. A standalone server applies them directly while
+// a cluster replicates them to every member first so all members apply the same
+// commands in the same order.
+const (
+	cmdNoop       = "noop"
+	cmdJoin       = "join"
+	cmdLeave      = "leave"
+	cmdHeartbeat  = "heartbeat"
+	cmdDisconnect = "disconnect"
+	cmdExpire     = "expire"
+	cmdDropNode   = "drop_node"
+	cmdHealth     = "health"
+	cmdState      = "state"
+)
+
+type command struct {
+	Op      string      `json:"op"`
+	Service *ServiceDef `json:"service,omitempty"`
+	// Connection the command was received on.
+	ConnId int32 `json:"conn_id,omitempty"`
+	// Cluster member affected by cmdDropNode.
+	Node int `json:"node,omitempty"`
+	// Lease of the service expired by cmdExpire. For cmdHealth, the lease the
+	// checked service joined with.
+	Lease uint64 `json:"lease,omitempty"`
+	// Set when cmdState comes from an operator, who may change the state of
+	// services the connection does not own.
+	Admin bool `json:"admin,omitempty"`
+}
+
+// Connection ids of cluster members hold the member's index plus one in the
+// top bits so that connections are unique across the cluster.
+const (
+	connIdNodeShift = 24
+	maxClusterSize  = 126
+)
+
+// Returns the index of the cluster member that owns the connection, or -1 for
+// a standalone server.
+func nodeOf(connId int32) int {
+	return int(connId>>connIdNodeShift) - 1
+}
+
+// The changes made by the log entry at index i have revisions starting after i
+// shifted by revisionIndexShift. Revisions are then the same on every member
+// and keep increasing with the log, whichever member leads. An entry making
+// more changes, e.g. dropping a member with that many services, only pushes
+// back the revisions of the entries after it.
+const revisionIndexShift = 20
+
+// How long the leader waits for a member to respond before removing the
+// services joined on its connections. Clients of that member are disconnected
+// so they re-join through another member.
+var clusterPeerTimeout = 5 * time.Second
+
+// Applies cmd to the registry. Must be called in the event loop.
+func (s *Server) apply(cmd *command) error {
+	var service *ServiceDef
+	if cmd.Service != nil {
+		// The registry keeps the definition, never share it with the caller.
+		def := *cmd.Service
+		def.connId = cmd.ConnId
+		service = &def
+	}
+	switch cmd.Op {
+	case cmdNoop:
+		// Only commits the entries of previous terms, see becomeLeader.
+	case cmdJoin:
+		if !s.join(service) {
+			return errors.New("Unable to add service")
+		}
+	case cmdLeave:
+		if !s.leave(service) {
+			return errors.New("Unable to remove service")
+		}
+	case cmdHeartbeat:
+		if !s.heartbeat(service) {
+			return errors.New("Unable to renew service")
+		}
+	case cmdDisconnect:
+		s.removeServices(s.services.Connection(cmd.ConnId))
+	case cmdExpire:
+		s.expireService(service, cmd.Lease)
+	case cmdDropNode:
+		s.dropNode(cmd.Node)
+	case cmdHealth:
+		if !s.setHealth(service, cmd.Lease) {
+			return errors.New("Unable to update service")
+		}
+	case cmdState:
+		if !s.setState(service, cmd.Admin) {
+			return errors.New("Unable to update service")
+		}
+	default:
+		return errors.New("Unknown command: " + cmd.Op)
+	}
+	return nil
+}
+
+// Applies cmd to the registry, replicating it first when the server is part of
+// a cluster.
+func (s *Server) submit(cmd *command) error {
+	if s.cluster != nil {
+		return s.cluster.submit(cmd, methodTimeout)
+	}
+	return s.run(func() error { return s.apply(cmd) })
+}
+
+// Submits cmd without waiting for the result. Safe to call from the event loop.
+func (s *Server) submitAsync(cmd *command) {
+	go func() {
+		if err := s.submit(cmd); err != nil {
+			log.Printf("Error submitting %s: %s\n", cmd.Op, err)
+		}
+	}()
+}
+
+// Makes the server a member of a cluster. peers holds the cluster address of
+// every member, in the same order on every member, and self is the index of
+// this server. listener accepts connections from the other members on
+// peers[self]. When OpenStore was called first, the state of the member is
+// kept in the directory of the store so that it survives restarts. Must be
+// called before Serve.
+//
+// Without SetClusterTLSConfig, members talk over plain TCP and any client that
+// reaches the cluster port can change the registry.
+func (s *Server) StartCluster(
+	listener net.Listener, peers []string, self int) error {
+	if len(peers) > maxClusterSize {
+		return fmt.Errorf("Clusters are limited to %d members", maxClusterSize)
+	}
+	if self < 0 || self >= len(peers) {
+		return fmt.Errorf("Invalid cluster member index: %d", self)
+	}
+	s.cluster = newRaftNode(listener, peers, self, s.applyEntry)
+	s.cluster.restore = s.restoreEntry
+	s.cluster.tlsConfig = s.clusterTLS
+	if s.store != nil {
+		store, err := openRaftStore(s.store.dir, s.cluster)
+		if err != nil {
+			return err
+		}
+		s.cluster.store = store
+	}
+	s.cluster.peerTimeout = clusterPeerTimeout
+	s.cluster.peerDown = func(peer int) {
+		s.submitAsync(&command{Op: cmdDropNode, Node: peer})
+	}
+	s.nextConnId = int32(self+1) << connIdNodeShift
+	s.startRevisions(0)
+	s.ready = make(chan bool)
+	s.cluster.start()
+	go s.joinCluster()
+	return nil
+}
+
+// Removes any services left over from a previous run of this member before
+// accepting connections. The connection ids are reused after a restart.
+func (s *Server) joinCluster() {
+	cmd := &command{Op: cmdDropNode, Node: s.cluster.self}
+	for !s.cluster.isStopped() {
+		err := s.submit(cmd)
+		if err == nil {
+			log.Println("Joined cluster")
+			close(s.ready)
+			return
+		}
+		time.Sleep(raftElectionTimeout)
+	}
+}
+
+// Called by the raft node, in log order, for each committed entry.
+func (s *Server) applyEntry(entry *raftEntry) {
+	s.eventChan <- func() {
+		s.revisionBase = entry.Index << revisionIndexShift
+		var err error
+		if entry.Command != nil {
+			err = s.apply(entry.Command)
+		}
+		s.cluster.applied(entry, err)
+		if s.cluster.shouldCompact(entry.Index) {
+			s.compactCluster(entry)
+		}
+	}
+}
+
+// State of the registry that a cluster replaces compacted entries with.
+type clusterSnapshot struct {
+	Revision uint64 `json:"revision"`
+	// Revision of the last change to each group with services.
+	Groups   map[string]uint64 `json:"groups"`
+	LeaseSeq uint64            `json:"lease_seq"`
+	Services []*clusterService `json:"services"`
+}
+
+// A service with the internal fields that are the same on every member.
+type clusterService struct {
+	*ServiceDef
+	ConnId int32  `json:"conn_id,omitempty"`
+	Lease  uint64 `json:"lease,omitempty"`
+	Joined uint64 `json:"joined,omitempty"`
+}
+
+// Replaces the entries up to entry, the last one applied, with a snapshot of
+// the registry. Must be called in the event loop.
+func (s *Server) compactCluster(entry *raftEntry) {
+	snapshot := &clusterSnapshot{Revision: s.revision,
+		Groups: s.groupRevisions, LeaseSeq: s.leaseSeq}
+	iter := s.services.Iterator()
+	for service := iter.Next(); service != nil; service = iter.Next() {
+		snapshot.Services = append(snapshot.Services,
+			&clusterService{service, service.connId, service.lease,
+				service.joined})
+	}
+	data, err := json.Marshal(snapshot)
+	if err == nil {
+		err = s.cluster.compact(entry.Index, data)
+	}
+	if err != nil {
+		log.Println("Error compacting cluster log:", err)
+	}
+}
+
+// Called by the raft node instead of applyEntry for the entries up to entry
+// when they were replaced by a snapshot.
+func (s *Server) restoreEntry(entry *raftEntry, data json.RawMessage) {
+	s.eventChan <- func() {
+		if err := s.restore(data); err != nil {
+			log.Println("Error restoring cluster snapshot:", err)
+		}
+		s.cluster.restored(entry)
+	}
+}
+
+// Replaces the registry with a snapshot. Watchers are sent the differences in
+// revision order. Services that left no longer have the revision of their
+// leave, they take the highest revisions of the snapshot no other difference
+// has: those belonged to changes this member missed. The history starts over
+// at the revision of the snapshot. Must be called in the event loop.
+func (s *Server) restore(data json.RawMessage) error {
+	var snapshot clusterSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	old := make(map[serviceKey]*ServiceDef, s.services.Len())
+	iter := s.services.Iterator()
+	for service := iter.Next(); service != nil; service = iter.Next() {
+		old[keyOf(service)] = service
+	}
+	s.services.Clear()
+	s.startRevisions(snapshot.Revision)
+	if snapshot.Groups != nil {
+		s.groupRevisions = snapshot.Groups
+	}
+	s.leaseSeq = snapshot.LeaseSeq
+
+	var changes changesByRevision
+	used := make(map[uint64]bool)
+	for _, e := range snapshot.Services {
+		service := e.ServiceDef
+		service.connId = e.ConnId
+		service.lease = e.Lease
+		service.joined = e.Joined
+		service.renew(s.now())
+		s.services.Add(service)
+		prev := old[keyOf(service)]
+		delete(old, keyOf(service))
+		if prev != nil && prev.Revision == service.Revision {
+			continue
+		}
+		if service.Persistent {
+			s.persist(storeJoin, service)
+		} else if prev != nil && prev.Persistent {
+			s.persist(storeLeave, prev)
+		}
+		// Watchers only see healthy services.
+		if !service.Unhealthy {
+			if prev != nil && prev.Unhealthy {
+				prev = nil
+			}
+			changes = append(changes,
+				change{"DiscoveryClient.Join", service, prev})
+		} else if prev != nil && !prev.Unhealthy {
+			changes = append(changes,
+				change{"DiscoveryClient.Leave", service, nil})
+		} else {
+			continue
+		}
+		used[service.Revision] = true
+	}
+	revision := snapshot.Revision
+	for _, service := range old {
+		if service.Persistent {
+			s.persist(storeLeave, service)
+		}
+		if service.Unhealthy {
+			continue
+		}
+		for used[revision] && revision > 1 {
+			revision--
+		}
+		used[revision] = true
+		left := *service
+		left.Revision = revision
+		changes = append(changes, change{"DiscoveryClient.Leave", &left, nil})
+	}
+	sort.Sort(changes)
+	for _, c := range changes {
+		s.notify(c.method, c.service, c.prev)
+	}
+	return nil
+}
+
+type changesByRevision []change
+
+func (c changesByRevision) Len() int      { return len(c) }
+func (c changesByRevision) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c changesByRevision) Less(i, j int) bool {
+	return c[i].service.Revision < c[j].service.Revision
+}
+
+// Removes the service if its lease has not been renewed since the leader found
+// it expired.
+func (s *Server) expireService(service *ServiceDef, lease uint64) {
+	e := s.services.Find(service)
+	if e == nil || e.lease != lease {
+		return
+	}
+	s.services.Remove(e)
+	if e.Persistent {
+		s.persist(storeLeave, e)
+	}
+	log.Println("Expired:", e.toString())
+	s.sendLeave(e)
+}
+
+// Removes the services joined on the connections of a cluster member. If the
+// member is this server, its connections are closed so that clients re-join.
+func (s *Server) dropNode(node int) {
+	for _, connId := range s.services.Connections() {
+		if nodeOf(connId) == node {
+			s.removeServices(s.services.Connection(connId))
+		}
+	}
+	if s.cluster != nil && node == s.cluster.self {
+		s.closeConnections()
+	}
+}
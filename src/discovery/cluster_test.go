@@ -0,0 +1,529 @@
+package discovery
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/rpc/jsonrpc"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var fastRaft sync.Once
+
+// Speeds up the timing of clusters for tests.
+func useFastRaft() {
+	fastRaft.Do(func() {
+		raftHeartbeat = 10 * time.Millisecond
+		raftElectionTimeout = 50 * time.Millisecond
+		raftRpcTimeout = 50 * time.Millisecond
+		clusterPeerTimeout = 300 * time.Millisecond
+		raftSnapshotTimeout = time.Second
+		raftMaxAppendEntries = 4
+		raftCompactEntries = 16
+	})
+}
+
+// Starts a cluster of n servers listening on local ports.
+func startTestCluster(t *testing.T, n int) []*Server {
+	useFastRaft()
+	listeners := make([]net.Listener, n)
+	peers := make([]string, n)
+	for i := range listeners {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = listener
+		peers[i] = listener.Addr().String()
+	}
+	servers := make([]*Server, n)
+	for i := range servers {
+		servers[i] = startTestMember(t, listeners[i], peers, i, "")
+	}
+	return servers
+}
+
+// Starts member self of a cluster, keeping its state in dir unless it is
+// empty.
+func startTestMember(t *testing.T, listener net.Listener, peers []string,
+	self int, dir string) *Server {
+	server := NewServer()
+	if dir != "" {
+		if err := server.OpenStore(dir, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := server.StartCluster(listener, peers, self); err != nil {
+		t.Fatal(err)
+	}
+	go server.processEvents()
+	return server
+}
+
+func stopTestCluster(servers []*Server) {
+	for _, server := range servers {
+		server.cluster.stop()
+	}
+}
+
+// Polls f until it returns true or a few seconds have passed.
+func waitFor(f func() bool) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if f() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// Returns the index of the only leader among the running servers, or -1.
+func findLeader(servers []*Server) int {
+	found := -1
+	for i, server := range servers {
+		if server.cluster.isStopped() || !server.cluster.isLeader() {
+			continue
+		}
+		if found != -1 {
+			return -1
+		}
+		found = i
+	}
+	return found
+}
+
+// Returns the number of services in group as seen by server.
+func countServices(server *Server, group string) int {
+	count := 0
+	server.run(func() error {
+		count = len(server.snapshot(group))
+		return nil
+	})
+	return count
+}
+
+func TestStartClusterInvalidMember(t *testing.T) {
+	server := NewServer()
+	if err := server.StartCluster(nil, []string{"a", "b"}, 2); err == nil {
+		t.Error("Expected an error for an invalid member index")
+	}
+}
+
+func TestClusterReplicatesJoins(t *testing.T) {
+	servers := startTestCluster(t, 3)
+	defer stopTestCluster(servers)
+	if !waitFor(func() bool { return findLeader(servers) != -1 }) {
+		t.Fatal("No leader elected")
+	}
+	follower := (findLeader(servers) + 1) % len(servers)
+
+	client := connectTestClient(servers[follower], JSON)
+	defer client.Close()
+	if err := client.Join(&ServiceDef{Host: "host", Port: 80,
+		Group: "group"}); err != nil {
+		t.Fatal(err)
+	}
+	// The change is visible on the member it was sent to as soon as Join
+	// returns.
+	snapshot, err := client.SnapshotRevision("group")
+	if err != nil || len(snapshot.Services) != 1 {
+		t.Error("Join not applied", snapshot, err)
+	}
+	for i, server := range servers {
+		if !waitFor(func() bool { return countServices(server, "group") == 1 }) {
+			t.Error("Join not replicated to", i)
+		}
+	}
+	// Every member numbers changes the same way.
+	for i, server := range servers {
+		var revision uint64
+		server.run(func() error {
+			revision = server.revision
+			return nil
+		})
+		if revision != snapshot.Revision {
+			t.Error("Wrong revision on", i, revision, snapshot.Revision)
+		}
+	}
+	// Revisions follow the index of the entry that made the change.
+	r := servers[follower].cluster
+	r.lock.Lock()
+	index := snapshot.Revision >> revisionIndexShift
+	if index == 0 || index > r.lastIndex() ||
+		r.entry(index).Command == nil || r.entry(index).Command.Op != cmdJoin {
+		t.Error("Revision not derived from the log", snapshot.Revision)
+	}
+	r.lock.Unlock()
+
+	// Errors are returned from the leader.
+	other := connectTestClient(servers[(follower+1)%len(servers)], JSON)
+	defer other.Close()
+	err = other.Join(&ServiceDef{Host: "host", Port: 80, Group: "group"})
+	if err == nil || err.Error() != "Unable to add service" {
+		t.Error("Expected an error", err)
+	}
+
+	// Services are removed from every member when the connection closes.
+	client.Close()
+	for i, server := range servers {
+		if !waitFor(func() bool { return countServices(server, "group") == 0 }) {
+			t.Error("Disconnect not replicated to", i)
+		}
+	}
+}
+
+func TestClusterLeaderFailure(t *testing.T) {
+	servers := startTestCluster(t, 3)
+	defer stopTestCluster(servers)
+	if !waitFor(func() bool { return findLeader(servers) != -1 }) {
+		t.Fatal("No leader elected")
+	}
+	old := findLeader(servers)
+	client := connectTestClient(servers[old], JSON)
+	defer client.Close()
+	if err := client.Join(&ServiceDef{Host: "host", Group: "group"}); err != nil {
+		t.Fatal(err)
+	}
+
+	servers[old].cluster.stop()
+	if !waitFor(func() bool {
+		leader := findLeader(servers)
+		return leader != -1 && leader != old
+	}) {
+		t.Fatal("No new leader elected")
+	}
+
+	// Writes still succeed through the remaining members.
+	other := connectTestClient(servers[(old+1)%len(servers)], JSON)
+	defer other.Close()
+	if err := other.Join(&ServiceDef{Host: "other", Group: "group"}); err != nil {
+		t.Error(err)
+	}
+
+	// The services of the failed member are removed once it is considered down.
+	for i, server := range servers {
+		if i == old {
+			continue
+		}
+		if !waitFor(func() bool {
+			var snapshot []*ServiceDef
+			server.run(func() error {
+				snapshot = server.snapshot("group")
+				return nil
+			})
+			return len(snapshot) == 1 && snapshot[0].Host == "other"
+		}) {
+			t.Error("Services of the failed member not removed on", i)
+		}
+	}
+}
+
+func TestClusterMemberRestart(t *testing.T) {
+	servers := startTestCluster(t, 3)
+	defer stopTestCluster(servers)
+	if !waitFor(func() bool { return findLeader(servers) != -1 }) {
+		t.Fatal("No leader elected")
+	}
+	follower := (findLeader(servers) + 1) % len(servers)
+	dir, err := ioutil.TempDir("", "cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	peers := servers[follower].cluster.peers
+
+	// Restart the follower with a store so that its state is kept.
+	restart := func() {
+		servers[follower].cluster.stop()
+		listener, err := net.Listen("tcp", peers[follower])
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers[follower] = startTestMember(t, listener, peers, follower, dir)
+	}
+	restart()
+	client := connectTestClient(servers[findLeader(servers)], JSON)
+	defer client.Close()
+	err = client.Join(&ServiceDef{Host: "host", Group: "group"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool {
+		return countServices(servers[follower], "group") == 1
+	}) {
+		t.Fatal("Join not replicated")
+	}
+	r := servers[follower].cluster
+	r.lock.Lock()
+	term, last := r.term, r.lastIndex()
+	r.lock.Unlock()
+
+	restart()
+	r = servers[follower].cluster
+	r.lock.Lock()
+	if r.term < term || r.lastIndex() < last {
+		t.Error("State not kept across the restart", r.term, r.lastIndex())
+	}
+	r.lock.Unlock()
+	if !waitFor(func() bool {
+		return countServices(servers[follower], "group") == 1
+	}) {
+		t.Error("Log not applied after the restart")
+	}
+}
+
+// A follower missing more entries than fit in one request catches up.
+func TestClusterCatchUp(t *testing.T) {
+	servers := startTestCluster(t, 3)
+	defer stopTestCluster(servers)
+	if !waitFor(func() bool { return findLeader(servers) != -1 }) {
+		t.Fatal("No leader elected")
+	}
+	leader := findLeader(servers)
+	follower := (leader + 1) % len(servers)
+	peers := servers[follower].cluster.peers
+
+	servers[follower].cluster.stop()
+	client := connectTestClient(servers[leader], JSON)
+	defer client.Close()
+	services := 2 * raftMaxAppendEntries
+	for i := 0; i < services; i++ {
+		err := client.Join(&ServiceDef{Host: "host", Port: uint16(i + 1),
+			Group: "group"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	listener, err := net.Listen("tcp", peers[follower])
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers[follower] = startTestMember(t, listener, peers, follower, "")
+	if !waitFor(func() bool {
+		return countServices(servers[follower], "group") == services
+	}) {
+		t.Error("Follower did not catch up")
+	}
+}
+
+func TestClusterCompaction(t *testing.T) {
+	servers := startTestCluster(t, 3)
+	defer stopTestCluster(servers)
+	if !waitFor(func() bool { return findLeader(servers) != -1 }) {
+		t.Fatal("No leader elected")
+	}
+	leader := findLeader(servers)
+	follower := (leader + 1) % len(servers)
+	peers := servers[follower].cluster.peers
+	dir, err := ioutil.TempDir("", "cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	restart := func() {
+		listener, err := net.Listen("tcp", peers[follower])
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers[follower] = startTestMember(t, listener, peers, follower, dir)
+	}
+	first := func(server *Server) uint64 {
+		r := server.cluster
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		return r.log[0].Index
+	}
+
+	// The follower misses enough entries for the leader to compact them.
+	servers[follower].cluster.stop()
+	client := connectTestClient(servers[leader], JSON)
+	defer client.Close()
+	for i := 0; i < 2*int(raftCompactEntries); i++ {
+		err := client.Join(&ServiceDef{Host: "host", Port: uint16(i + 1),
+			Group: "group"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if first(servers[leader]) == 0 {
+		t.Fatal("Leader log not compacted")
+	}
+	services := 2 * int(raftCompactEntries)
+
+	// It is sent the snapshot of the leader when it comes back.
+	restart()
+	if !waitFor(func() bool {
+		return countServices(servers[follower], "group") == services
+	}) {
+		t.Fatal("Snapshot not installed")
+	}
+	revision := func(server *Server) uint64 {
+		var revision uint64
+		server.run(func() error {
+			revision = server.revision
+			return nil
+		})
+		return revision
+	}
+	if !waitFor(func() bool {
+		return revision(servers[follower]) == revision(servers[leader])
+	}) {
+		t.Error("Wrong revision after the snapshot")
+	}
+
+	// And starts from the snapshot on disk after a restart.
+	servers[follower].cluster.stop()
+	restart()
+	if first(servers[follower]) == 0 {
+		t.Error("Snapshot not kept across the restart")
+	}
+	if !waitFor(func() bool {
+		return countServices(servers[follower], "group") == services
+	}) {
+		t.Error("Snapshot not restored after the restart")
+	}
+}
+
+func TestServerRestore(t *testing.T) {
+	server := NewServer()
+	go server.processEvents()
+	client := connectTestClient(server, JSON)
+	defer client.Close()
+	watcher := connectTestClient(server, JSON)
+	defer watcher.Close()
+	client.Join(&ServiceDef{Host: "a", Group: "g"})
+	client.Join(&ServiceDef{Host: "b", Group: "g"})
+	client.Join(&ServiceDef{Host: "c", Group: "g"})
+	snapshot, events, err := watcher.Watch("g")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// b changed, c left and e joined while this member was behind.
+	revision := snapshot.Revision
+	data, err := json.Marshal(&clusterSnapshot{
+		Revision: revision + 10,
+		Services: []*clusterService{
+			{ServiceDef: &ServiceDef{Host: "a", Group: "g",
+				Revision: revision - 2}},
+			{ServiceDef: &ServiceDef{Host: "b", Group: "g",
+				Labels: map[string]string{"v": "2"}, Revision: revision + 6}},
+			{ServiceDef: &ServiceDef{Host: "e", Group: "g",
+				Revision: revision + 10}},
+		}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.run(func() error { return server.restore(data) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(t, events); event.Type != Joined ||
+		event.Service.Host != "b" || event.Service.Labels["v"] != "2" {
+		t.Error("Expected b to change", event)
+	}
+	if event := nextEvent(t, events); event.Type != Left ||
+		event.Service.Host != "c" || event.Service.Revision != revision+9 {
+		t.Error("Expected c to leave", event)
+	}
+	if event := nextEvent(t, events); event.Type != Joined ||
+		event.Service.Host != "e" {
+		t.Error("Expected e to join", event)
+	}
+	if snapshot, err = watcher.SnapshotRevision("g"); err != nil ||
+		len(snapshot.Services) != 3 || snapshot.Revision != revision+10 {
+		t.Error("Wrong snapshot after the restore", snapshot, err)
+	}
+}
+
+func TestClusterTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestCerts(t, dir)
+	config, err := NewServerTLSConfig(filepath.Join(dir, "server.pem"),
+		filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	useFastRaft()
+	listeners := make([]net.Listener, 3)
+	peers := make([]string, len(listeners))
+	for i := range listeners {
+		if listeners[i], err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		peers[i] = listeners[i].Addr().String()
+	}
+	servers := make([]*Server, len(listeners))
+	for i := range servers {
+		servers[i] = NewServer()
+		if err = servers[i].SetClusterTLSConfig(config); err != nil {
+			t.Fatal(err)
+		}
+		if err = servers[i].StartCluster(listeners[i], peers, i); err != nil {
+			t.Fatal(err)
+		}
+		go servers[i].processEvents()
+	}
+	defer stopTestCluster(servers)
+	if !waitFor(func() bool { return findLeader(servers) != -1 }) {
+		t.Fatal("No leader elected")
+	}
+	client := connectTestClient(servers[0], JSON)
+	defer client.Close()
+	if err = client.Join(&ServiceDef{Host: "h", Group: "g"}); err != nil {
+		t.Fatal(err)
+	}
+	for i, server := range servers {
+		if !waitFor(func() bool { return countServices(server, "g") == 1 }) {
+			t.Error("Join not replicated to", i)
+		}
+	}
+
+	// Connections without a certificate of a member are refused.
+	forward := func(conn net.Conn) error {
+		rpcClient := jsonrpc.NewClient(conn)
+		defer rpcClient.Close()
+		var reply RaftForwardReply
+		return rpcClient.Call("Raft.Forward", &RaftForwardArgs{
+			&command{Op: cmdJoin, Service: &ServiceDef{Host: "x", Group: "g"}}},
+			&reply)
+	}
+	conn, err := net.Dial("tcp", peers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = forward(conn); err == nil {
+		t.Error("Plain connection accepted")
+	}
+	clientConfig, err := NewClientTLSConfig(filepath.Join(dir, "client.pem"),
+		filepath.Join(dir, "client.key"), filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConn, err := tls.Dial("tcp", peers[0], clientConfig)
+	if err == nil {
+		err = forward(tlsConn)
+	}
+	if err == nil {
+		t.Error("Connection of a client certificate accepted")
+	}
+	if countServices(servers[0], "g") != 1 {
+		t.Error("Forwarded join applied")
+	}
+}
+
+func TestClusterTLSRequiresClientCertificates(t *testing.T) {
+	server := NewServer()
+	if err := server.SetClusterTLSConfig(&tls.Config{}); err == nil {
+		t.Error("Expected an error without client certificates")
+	}
+}
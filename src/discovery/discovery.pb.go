@@ -16,14 +16,21 @@ var _ = math.Inf
 type MessageType int32
 
 const (
-	MessageType_JOIN_REQUEST      MessageType = 0
-	MessageType_LEAVE_REQUEST     MessageType = 1
-	MessageType_SNAPSHOT_REQUEST  MessageType = 2
-	MessageType_WATCH_REQUEST     MessageType = 3
-	MessageType_IGNORE_REQUEST    MessageType = 4
-	MessageType___LAST_REQUEST    MessageType = 99
-	MessageType_ERROR_RESPONSE    MessageType = 100
-	MessageType_SNAPSHOT_RESPONSE MessageType = 101
+	MessageType_JOIN_REQUEST         MessageType = 0
+	MessageType_LEAVE_REQUEST        MessageType = 1
+	MessageType_SNAPSHOT_REQUEST     MessageType = 2
+	MessageType_WATCH_REQUEST        MessageType = 3
+	MessageType_IGNORE_REQUEST       MessageType = 4
+	MessageType_HEARTBEAT_REQUEST    MessageType = 5
+	MessageType_AUTHENTICATE_REQUEST MessageType = 6
+	MessageType_HEALTH_REQUEST       MessageType = 7
+	MessageType_LIST_GROUPS_REQUEST  MessageType = 8
+	MessageType_STATE_REQUEST        MessageType = 9
+	MessageType___LAST_REQUEST       MessageType = 99
+	MessageType_ERROR_RESPONSE       MessageType = 100
+	MessageType_SNAPSHOT_RESPONSE    MessageType = 101
+	MessageType_EMPTY_RESPONSE       MessageType = 102
+	MessageType_GROUPS_RESPONSE      MessageType = 103
 )
 
 var MessageType_name = map[int32]string{
@@ -32,19 +39,33 @@ var MessageType_name = map[int32]string{
 	2:   "SNAPSHOT_REQUEST",
 	3:   "WATCH_REQUEST",
 	4:   "IGNORE_REQUEST",
+	5:   "HEARTBEAT_REQUEST",
+	6:   "AUTHENTICATE_REQUEST",
+	7:   "HEALTH_REQUEST",
+	8:   "LIST_GROUPS_REQUEST",
+	9:   "STATE_REQUEST",
 	99:  "__LAST_REQUEST",
 	100: "ERROR_RESPONSE",
 	101: "SNAPSHOT_RESPONSE",
+	102: "EMPTY_RESPONSE",
+	103: "GROUPS_RESPONSE",
 }
 var MessageType_value = map[string]int32{
-	"JOIN_REQUEST":      0,
-	"LEAVE_REQUEST":     1,
-	"SNAPSHOT_REQUEST":  2,
-	"WATCH_REQUEST":     3,
-	"IGNORE_REQUEST":    4,
-	"__LAST_REQUEST":    99,
-	"ERROR_RESPONSE":    100,
-	"SNAPSHOT_RESPONSE": 101,
+	"JOIN_REQUEST":         0,
+	"LEAVE_REQUEST":        1,
+	"SNAPSHOT_REQUEST":     2,
+	"WATCH_REQUEST":        3,
+	"IGNORE_REQUEST":       4,
+	"HEARTBEAT_REQUEST":    5,
+	"AUTHENTICATE_REQUEST": 6,
+	"HEALTH_REQUEST":       7,
+	"LIST_GROUPS_REQUEST":  8,
+	"STATE_REQUEST":        9,
+	"__LAST_REQUEST":       99,
+	"ERROR_RESPONSE":       100,
+	"SNAPSHOT_RESPONSE":    101,
+	"EMPTY_RESPONSE":       102,
+	"GROUPS_RESPONSE":      103,
 }
 
 func (x MessageType) Enum() *MessageType {
@@ -68,10 +89,19 @@ func (x *MessageType) UnmarshalJSON(data []byte) error {
 }
 
 type ServiceDefinition struct {
-	Host             *string `protobuf:"bytes,1,req,name=host" json:"host,omitempty"`
-	Port             *int32  `protobuf:"varint,2,req,name=port" json:"port,omitempty"`
-	CustomData       []byte  `protobuf:"bytes,3,opt,name=custom_data" json:"custom_data,omitempty"`
-	XXX_unrecognized []byte  `json:"-"`
+	Host             *string                `protobuf:"bytes,1,req,name=host" json:"host,omitempty"`
+	Port             *int32                 `protobuf:"varint,2,req,name=port" json:"port,omitempty"`
+	CustomData       []byte                 `protobuf:"bytes,3,opt,name=custom_data" json:"custom_data,omitempty"`
+	Group            *string                `protobuf:"bytes,4,opt,name=group" json:"group,omitempty"`
+	Ttl              *uint32                `protobuf:"varint,5,opt,name=ttl" json:"ttl,omitempty"`
+	Persistent       *bool                  `protobuf:"varint,6,opt,name=persistent" json:"persistent,omitempty"`
+	Revision         *uint64                `protobuf:"varint,7,opt,name=revision" json:"revision,omitempty"`
+	Check            *HealthCheckDefinition `protobuf:"bytes,8,opt,name=check" json:"check,omitempty"`
+	Unhealthy        *bool                  `protobuf:"varint,9,opt,name=unhealthy" json:"unhealthy,omitempty"`
+	Labels           []*Label               `protobuf:"bytes,10,rep,name=labels" json:"labels,omitempty"`
+	Tags             []string               `protobuf:"bytes,11,rep,name=tags" json:"tags,omitempty"`
+	State            *string                `protobuf:"bytes,12,opt,name=state" json:"state,omitempty"`
+	XXX_unrecognized []byte                 `json:"-"`
 }
 
 func (this *ServiceDefinition) Reset()         { *this = ServiceDefinition{} }
@@ -99,6 +129,141 @@ func (this *ServiceDefinition) GetCustomData() []byte {
 	return nil
 }
 
+func (this *ServiceDefinition) GetGroup() string {
+	if this != nil && this.Group != nil {
+		return *this.Group
+	}
+	return ""
+}
+
+func (this *ServiceDefinition) GetTtl() uint32 {
+	if this != nil && this.Ttl != nil {
+		return *this.Ttl
+	}
+	return 0
+}
+
+func (this *ServiceDefinition) GetPersistent() bool {
+	if this != nil && this.Persistent != nil {
+		return *this.Persistent
+	}
+	return false
+}
+
+func (this *ServiceDefinition) GetRevision() uint64 {
+	if this != nil && this.Revision != nil {
+		return *this.Revision
+	}
+	return 0
+}
+
+func (this *ServiceDefinition) GetCheck() *HealthCheckDefinition {
+	if this != nil {
+		return this.Check
+	}
+	return nil
+}
+
+func (this *ServiceDefinition) GetUnhealthy() bool {
+	if this != nil && this.Unhealthy != nil {
+		return *this.Unhealthy
+	}
+	return false
+}
+
+func (this *ServiceDefinition) GetLabels() []*Label {
+	if this != nil {
+		return this.Labels
+	}
+	return nil
+}
+
+func (this *ServiceDefinition) GetTags() []string {
+	if this != nil {
+		return this.Tags
+	}
+	return nil
+}
+
+func (this *ServiceDefinition) GetState() string {
+	if this != nil && this.State != nil {
+		return *this.State
+	}
+	return ""
+}
+
+type Label struct {
+	Key              *string `protobuf:"bytes,1,req,name=key" json:"key,omitempty"`
+	Value            *string `protobuf:"bytes,2,req,name=value" json:"value,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (this *Label) Reset()         { *this = Label{} }
+func (this *Label) String() string { return proto.CompactTextString(this) }
+func (*Label) ProtoMessage()       {}
+
+func (this *Label) GetKey() string {
+	if this != nil && this.Key != nil {
+		return *this.Key
+	}
+	return ""
+}
+
+func (this *Label) GetValue() string {
+	if this != nil && this.Value != nil {
+		return *this.Value
+	}
+	return ""
+}
+
+type HealthCheckDefinition struct {
+	Type             *string  `protobuf:"bytes,1,req,name=type" json:"type,omitempty"`
+	Interval         *uint32  `protobuf:"varint,2,opt,name=interval" json:"interval,omitempty"`
+	Timeout          *uint32  `protobuf:"varint,3,opt,name=timeout" json:"timeout,omitempty"`
+	Path             *string  `protobuf:"bytes,4,opt,name=path" json:"path,omitempty"`
+	Script           []string `protobuf:"bytes,5,rep,name=script" json:"script,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (this *HealthCheckDefinition) Reset()         { *this = HealthCheckDefinition{} }
+func (this *HealthCheckDefinition) String() string { return proto.CompactTextString(this) }
+func (*HealthCheckDefinition) ProtoMessage()       {}
+
+func (this *HealthCheckDefinition) GetType() string {
+	if this != nil && this.Type != nil {
+		return *this.Type
+	}
+	return ""
+}
+
+func (this *HealthCheckDefinition) GetInterval() uint32 {
+	if this != nil && this.Interval != nil {
+		return *this.Interval
+	}
+	return 0
+}
+
+func (this *HealthCheckDefinition) GetTimeout() uint32 {
+	if this != nil && this.Timeout != nil {
+		return *this.Timeout
+	}
+	return 0
+}
+
+func (this *HealthCheckDefinition) GetPath() string {
+	if this != nil && this.Path != nil {
+		return *this.Path
+	}
+	return ""
+}
+
+func (this *HealthCheckDefinition) GetScript() []string {
+	if this != nil {
+		return this.Script
+	}
+	return nil
+}
+
 type JoinRequest struct {
 	Group            *string            `protobuf:"bytes,1,req,name=group" json:"group,omitempty"`
 	Service          *ServiceDefinition `protobuf:"bytes,2,req,name=service" json:"service,omitempty"`
@@ -149,6 +314,7 @@ func (this *LeaveRequest) GetService() *ServiceDefinition {
 
 type SnapshotRequest struct {
 	Group            *string `protobuf:"bytes,1,req,name=group" json:"group,omitempty"`
+	Selector         *string `protobuf:"bytes,2,opt,name=selector" json:"selector,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -163,8 +329,17 @@ func (this *SnapshotRequest) GetGroup() string {
 	return ""
 }
 
+func (this *SnapshotRequest) GetSelector() string {
+	if this != nil && this.Selector != nil {
+		return *this.Selector
+	}
+	return ""
+}
+
 type WatchRequest struct {
 	Group            *string `protobuf:"bytes,1,req,name=group" json:"group,omitempty"`
+	Revision         *uint64 `protobuf:"varint,2,opt,name=revision" json:"revision,omitempty"`
+	Selector         *string `protobuf:"bytes,3,opt,name=selector" json:"selector,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -179,6 +354,20 @@ func (this *WatchRequest) GetGroup() string {
 	return ""
 }
 
+func (this *WatchRequest) GetRevision() uint64 {
+	if this != nil && this.Revision != nil {
+		return *this.Revision
+	}
+	return 0
+}
+
+func (this *WatchRequest) GetSelector() string {
+	if this != nil && this.Selector != nil {
+		return *this.Selector
+	}
+	return ""
+}
+
 type IgnoreRequest struct {
 	Group            *string `protobuf:"bytes,1,req,name=group" json:"group,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
@@ -195,8 +384,114 @@ func (this *IgnoreRequest) GetGroup() string {
 	return ""
 }
 
+type HeartbeatRequest struct {
+	Group            *string            `protobuf:"bytes,1,req,name=group" json:"group,omitempty"`
+	Service          *ServiceDefinition `protobuf:"bytes,2,req,name=service" json:"service,omitempty"`
+	XXX_unrecognized []byte             `json:"-"`
+}
+
+func (this *HeartbeatRequest) Reset()         { *this = HeartbeatRequest{} }
+func (this *HeartbeatRequest) String() string { return proto.CompactTextString(this) }
+func (*HeartbeatRequest) ProtoMessage()       {}
+
+func (this *HeartbeatRequest) GetGroup() string {
+	if this != nil && this.Group != nil {
+		return *this.Group
+	}
+	return ""
+}
+
+func (this *HeartbeatRequest) GetService() *ServiceDefinition {
+	if this != nil {
+		return this.Service
+	}
+	return nil
+}
+
+type HealthRequest struct {
+	Group            *string            `protobuf:"bytes,1,req,name=group" json:"group,omitempty"`
+	Service          *ServiceDefinition `protobuf:"bytes,2,req,name=service" json:"service,omitempty"`
+	XXX_unrecognized []byte             `json:"-"`
+}
+
+func (this *HealthRequest) Reset()         { *this = HealthRequest{} }
+func (this *HealthRequest) String() string { return proto.CompactTextString(this) }
+func (*HealthRequest) ProtoMessage()       {}
+
+func (this *HealthRequest) GetGroup() string {
+	if this != nil && this.Group != nil {
+		return *this.Group
+	}
+	return ""
+}
+
+func (this *HealthRequest) GetService() *ServiceDefinition {
+	if this != nil {
+		return this.Service
+	}
+	return nil
+}
+
+type StateRequest struct {
+	Group            *string            `protobuf:"bytes,1,req,name=group" json:"group,omitempty"`
+	Service          *ServiceDefinition `protobuf:"bytes,2,req,name=service" json:"service,omitempty"`
+	XXX_unrecognized []byte             `json:"-"`
+}
+
+func (this *StateRequest) Reset()         { *this = StateRequest{} }
+func (this *StateRequest) String() string { return proto.CompactTextString(this) }
+func (*StateRequest) ProtoMessage()       {}
+
+func (this *StateRequest) GetGroup() string {
+	if this != nil && this.Group != nil {
+		return *this.Group
+	}
+	return ""
+}
+
+func (this *StateRequest) GetService() *ServiceDefinition {
+	if this != nil {
+		return this.Service
+	}
+	return nil
+}
+
+type AuthenticateRequest struct {
+	Token            *string `protobuf:"bytes,1,req,name=token" json:"token,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (this *AuthenticateRequest) Reset()         { *this = AuthenticateRequest{} }
+func (this *AuthenticateRequest) String() string { return proto.CompactTextString(this) }
+func (*AuthenticateRequest) ProtoMessage()       {}
+
+func (this *AuthenticateRequest) GetToken() string {
+	if this != nil && this.Token != nil {
+		return *this.Token
+	}
+	return ""
+}
+
+type ListGroupsRequest struct {
+	Prefix           *string `protobuf:"bytes,1,opt,name=prefix" json:"prefix,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (this *ListGroupsRequest) Reset()         { *this = ListGroupsRequest{} }
+func (this *ListGroupsRequest) String() string { return proto.CompactTextString(this) }
+func (*ListGroupsRequest) ProtoMessage()       {}
+
+func (this *ListGroupsRequest) GetPrefix() string {
+	if this != nil && this.Prefix != nil {
+		return *this.Prefix
+	}
+	return ""
+}
+
 type SnapshotResponse struct {
 	Services         []*ServiceDefinition `protobuf:"bytes,1,rep,name=services" json:"services,omitempty"`
+	Revision         *uint64              `protobuf:"varint,2,opt,name=revision" json:"revision,omitempty"`
+	Resumed          *bool                `protobuf:"varint,3,opt,name=resumed" json:"resumed,omitempty"`
 	XXX_unrecognized []byte               `json:"-"`
 }
 
@@ -204,6 +499,77 @@ func (this *SnapshotResponse) Reset()         { *this = SnapshotResponse{} }
 func (this *SnapshotResponse) String() string { return proto.CompactTextString(this) }
 func (*SnapshotResponse) ProtoMessage()       {}
 
+func (this *SnapshotResponse) GetRevision() uint64 {
+	if this != nil && this.Revision != nil {
+		return *this.Revision
+	}
+	return 0
+}
+
+func (this *SnapshotResponse) GetResumed() bool {
+	if this != nil && this.Resumed != nil {
+		return *this.Resumed
+	}
+	return false
+}
+
+type GroupDescription struct {
+	Name             *string `protobuf:"bytes,1,req,name=name" json:"name,omitempty"`
+	Services         *uint32 `protobuf:"varint,2,opt,name=services" json:"services,omitempty"`
+	Unhealthy        *uint32 `protobuf:"varint,3,opt,name=unhealthy" json:"unhealthy,omitempty"`
+	Revision         *uint64 `protobuf:"varint,4,opt,name=revision" json:"revision,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (this *GroupDescription) Reset()         { *this = GroupDescription{} }
+func (this *GroupDescription) String() string { return proto.CompactTextString(this) }
+func (*GroupDescription) ProtoMessage()       {}
+
+func (this *GroupDescription) GetName() string {
+	if this != nil && this.Name != nil {
+		return *this.Name
+	}
+	return ""
+}
+
+func (this *GroupDescription) GetServices() uint32 {
+	if this != nil && this.Services != nil {
+		return *this.Services
+	}
+	return 0
+}
+
+func (this *GroupDescription) GetUnhealthy() uint32 {
+	if this != nil && this.Unhealthy != nil {
+		return *this.Unhealthy
+	}
+	return 0
+}
+
+func (this *GroupDescription) GetRevision() uint64 {
+	if this != nil && this.Revision != nil {
+		return *this.Revision
+	}
+	return 0
+}
+
+type GroupsResponse struct {
+	Groups           []*GroupDescription `protobuf:"bytes,1,rep,name=groups" json:"groups,omitempty"`
+	Revision         *uint64             `protobuf:"varint,2,opt,name=revision" json:"revision,omitempty"`
+	XXX_unrecognized []byte              `json:"-"`
+}
+
+func (this *GroupsResponse) Reset()         { *this = GroupsResponse{} }
+func (this *GroupsResponse) String() string { return proto.CompactTextString(this) }
+func (*GroupsResponse) ProtoMessage()       {}
+
+func (this *GroupsResponse) GetRevision() uint64 {
+	if this != nil && this.Revision != nil {
+		return *this.Revision
+	}
+	return 0
+}
+
 type ErrorResponse struct {
 	Description      *string `protobuf:"bytes,2,req,name=description" json:"description,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
@@ -220,6 +586,14 @@ func (this *ErrorResponse) GetDescription() string {
 	return ""
 }
 
+type EmptyResponse struct {
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (this *EmptyResponse) Reset()         { *this = EmptyResponse{} }
+func (this *EmptyResponse) String() string { return proto.CompactTextString(this) }
+func (*EmptyResponse) ProtoMessage()       {}
+
 type Message struct {
 	Sequence         *uint64      `protobuf:"varint,1,req,name=sequence" json:"sequence,omitempty"`
 	Type             *MessageType `protobuf:"varint,2,req,name=type,enum=discovery.MessageType" json:"type,omitempty"`
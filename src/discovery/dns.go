@@ -0,0 +1,446 @@
+package discovery
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// TTL in seconds of the records served over DNS. Kept short since the
+// registry changes often.
+const dnsTTL = 5
+
+// DNS record types, classes and response codes used by the DNS front-end.
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+	dnsTypeOPT  = 41
+	dnsClassIN  = 1
+
+	dnsNoError  = 0
+	dnsFormErr  = 1
+	dnsNXDomain = 3
+	dnsNotImp   = 4
+	dnsRefused  = 5
+)
+
+// Size of the DNS header, of the largest UDP message sent to clients that do
+// not advertise a larger one with EDNS0 and of the largest one sent at all.
+const (
+	dnsHeaderSize = 12
+	dnsMinUDPSize = 512
+	dnsMaxUDPSize = 4096
+)
+
+// Longest label and longest name in wire format.
+const (
+	dnsMaxLabel = 63
+	dnsMaxName  = 255
+)
+
+// Names of addresses are in this subdomain of the domain.
+const dnsAddrSubzone = "addr"
+
+// Number of queries answered at once. Queries arriving while that many are
+// being answered are dropped and clients retry. Variable so tests can lower
+// it.
+var dnsMaxQueries = 256
+
+// A DNS question, the part of a query we answer.
+type dnsQuestion struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+// A resource record of a DNS response.
+type dnsRecord struct {
+	name  string
+	rtype uint16
+	data  []byte
+}
+
+var errDNSFormat = errors.New("Malformed DNS message")
+
+// Reads the name at offset of msg. Compressed names are not expected in
+// queries and are rejected. Returns the name without the trailing dot and the
+// offset after it.
+func readDNSName(msg []byte, offset int) (string, int, error) {
+	start := offset
+	var labels []string
+	for {
+		if offset >= len(msg) || offset-start >= dnsMaxName {
+			return "", 0, errDNSFormat
+		}
+		size := int(msg[offset])
+		offset++
+		if size == 0 {
+			return strings.Join(labels, "."), offset, nil
+		}
+		if size > dnsMaxLabel || offset+size > len(msg) {
+			return "", 0, errDNSFormat
+		}
+		labels = append(labels, string(msg[offset:offset+size]))
+		offset += size
+	}
+}
+
+// Returns true if name, without the trailing dot, can be sent in a DNS
+// message: its labels are not empty and fit the label and name limits.
+func validDNSName(name string) bool {
+	if name == "" {
+		return true
+	}
+	// The wire format adds a length before the first label and the empty root
+	// label.
+	if len(name)+2 > dnsMaxName {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > dnsMaxLabel {
+			return false
+		}
+	}
+	return true
+}
+
+// Appends name in wire format to b. name must be valid, see validDNSName.
+func appendDNSName(b []byte, name string) []byte {
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// Parses a query holding a single question. Returns the question and the UDP
+// message size the client accepts, which is 0 unless the client uses EDNS0.
+func parseDNSQuery(msg []byte) (*dnsQuestion, int, error) {
+	if binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return nil, 0, errDNSFormat
+	}
+	name, offset, err := readDNSName(msg, dnsHeaderSize)
+	if err != nil || offset+4 > len(msg) {
+		return nil, 0, errDNSFormat
+	}
+	q := &dnsQuestion{name,
+		binary.BigEndian.Uint16(msg[offset:]),
+		binary.BigEndian.Uint16(msg[offset+2:])}
+	offset += 4
+
+	// An EDNS0 OPT record in the additional section advertises a larger size.
+	size := 0
+	answers := binary.BigEndian.Uint16(msg[6:])
+	authorities := binary.BigEndian.Uint16(msg[8:])
+	additional := binary.BigEndian.Uint16(msg[10:])
+	if answers == 0 && authorities == 0 && additional == 1 {
+		_, offset, err = readDNSName(msg, offset)
+		if err == nil && offset+10 <= len(msg) &&
+			binary.BigEndian.Uint16(msg[offset:]) == dnsTypeOPT {
+			size = int(binary.BigEndian.Uint16(msg[offset+2:]))
+			if size < dnsMinUDPSize {
+				size = dnsMinUDPSize
+			} else if size > dnsMaxUDPSize {
+				size = dnsMaxUDPSize
+			}
+		}
+	}
+	return q, size, nil
+}
+
+// Returns the name the DNS front-end gives an IP address, e.g.
+// 10.0.0.1.addr.<domain> or 2001-db8--1.addr.<domain>.
+func dnsAddrName(ip net.IP, domain string) string {
+	return strings.Replace(ip.String(), ":", "-", -1) + "." + dnsAddrSubzone +
+		"." + domain
+}
+
+// Returns the address record of ip for the query type, or nil if the address
+// is of the other family.
+func dnsAddrRecord(name string, qtype uint16, ip net.IP) *dnsRecord {
+	if ip4 := ip.To4(); ip4 != nil {
+		if qtype != dnsTypeA {
+			return nil
+		}
+		return &dnsRecord{name, dnsTypeA, ip4}
+	}
+	if qtype != dnsTypeAAAA {
+		return nil
+	}
+	return &dnsRecord{name, dnsTypeAAAA, ip.To16()}
+}
+
+// Returns the records answering q and the additional records going with them.
+// ok is false if the name does not exist.
+func (s *Server) resolveDNS(q *dnsQuestion, domain string) (
+	answers, extra []*dnsRecord, ok bool) {
+	lower := strings.ToLower(q.name)
+	if lower == domain {
+		return nil, nil, true
+	}
+	if !strings.HasSuffix(lower, "."+domain) {
+		return nil, nil, false
+	}
+	// Keep the case of group names.
+	prefix := q.name[:len(q.name)-len(domain)-1]
+
+	// <address>.addr.<domain>
+	if strings.HasSuffix(strings.ToLower(prefix), "."+dnsAddrSubzone) {
+		addr := prefix[:len(prefix)-len(dnsAddrSubzone)-1]
+		ip := net.ParseIP(strings.Replace(addr, "-", ":", -1))
+		if ip == nil {
+			return nil, nil, false
+		}
+		if record := dnsAddrRecord(q.name, q.qtype, ip); record != nil {
+			answers = append(answers, record)
+		}
+		return answers, nil, true
+	}
+
+	// _<group>._<protocol>.<domain> for SRV records, <group>.<domain> for
+	// addresses.
+	group := prefix
+	srv := false
+	labels := strings.Split(prefix, ".")
+	if len(labels) == 2 && strings.HasPrefix(labels[0], "_") &&
+		strings.HasPrefix(labels[1], "_") {
+		group = labels[0][1:]
+		srv = true
+	}
+	// Queries are anonymous, the policy must let anyone snapshot the group.
+	if s.policy != nil && s.policy.check("", opSnapshot, group) != nil {
+		return nil, nil, false
+	}
+	sub, err := s.subscribe("", opSnapshot, group, "")
+	if err != nil {
+		return nil, nil, false
+	}
+	var services []*ServiceDef
+	err = s.run(func() error {
+		services = sub.filter(s.snapshot(group))
+		return nil
+	})
+	if err != nil || len(services) == 0 {
+		return nil, nil, false
+	}
+
+	for _, service := range services {
+		if !service.active() {
+			// Not meant to receive new requests.
+			continue
+		}
+		ip := net.ParseIP(service.Host)
+		if !srv {
+			if ip == nil || q.qtype != dnsTypeA && q.qtype != dnsTypeAAAA {
+				continue
+			}
+			if record := dnsAddrRecord(q.name, q.qtype, ip); record != nil {
+				answers = append(answers, record)
+			}
+			continue
+		}
+		if q.qtype != dnsTypeSRV {
+			continue
+		}
+		// SRV targets are names. Addresses get a name under the domain and
+		// their address record is added to the response.
+		target := strings.TrimSuffix(service.Host, ".")
+		if ip != nil {
+			target = dnsAddrName(ip, domain)
+		}
+		if !validDNSName(target) {
+			// Too long for DNS, e.g. a long host or domain.
+			continue
+		}
+		if ip != nil {
+			for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+				if record := dnsAddrRecord(target, qtype, ip); record != nil {
+					extra = append(extra, record)
+				}
+			}
+		}
+		// Priority 0, weight 0.
+		data := []byte{0, 0, 0, 0}
+		data = appendUint16(data, service.Port)
+		data = appendDNSName(data, target)
+		answers = append(answers, &dnsRecord{q.name, dnsTypeSRV, data})
+	}
+	return answers, extra, true
+}
+
+// Returns the response to the query msg, or nil if there is none to send.
+func (s *Server) answerDNS(msg []byte, domain string) []byte {
+	if len(msg) < dnsHeaderSize || msg[2]&0x80 != 0 {
+		// Too short to answer or not a query.
+		return nil
+	}
+	// Copy the id, opcode and recursion desired flag of the query.
+	res := []byte{msg[0], msg[1], 0x80 | 0x04 | msg[2]&0x79, 0}
+	res = append(res, make([]byte, dnsHeaderSize-4)...)
+	if opcode := msg[2] >> 3 & 0xf; opcode != 0 {
+		res[3] = dnsNotImp
+		return res
+	}
+	q, size, err := parseDNSQuery(msg)
+	if err != nil {
+		res[3] = dnsFormErr
+		return res
+	}
+	binary.BigEndian.PutUint16(res[4:], 1)
+	res = appendDNSName(res, q.name)
+	res = appendUint16(res, q.qtype)
+	res = appendUint16(res, q.qclass)
+
+	if q.qclass != dnsClassIN {
+		res[3] = dnsRefused
+		return res
+	}
+	answers, extra, ok := s.resolveDNS(q, domain)
+	if !ok {
+		if name := strings.ToLower(q.name); name == domain ||
+			strings.HasSuffix(name, "."+domain) {
+			res[3] = dnsNXDomain
+		} else {
+			// Not our zone.
+			res[2] &^= 0x04
+			res[3] = dnsRefused
+		}
+		return res
+	}
+
+	// Add as many records as fit and mark the response truncated if some do
+	// not. Additional records are optional. Clients using EDNS0 get an OPT
+	// record back.
+	res[3] = dnsNoError
+	limit := size
+	if size == 0 {
+		limit = dnsMinUDPSize
+	} else {
+		limit -= dnsOPTSize
+	}
+	count := func(offset int) {
+		binary.BigEndian.PutUint16(res[offset:],
+			binary.BigEndian.Uint16(res[offset:])+1)
+	}
+	for _, record := range answers {
+		b := appendDNSRecord(res, record)
+		if len(b) > limit {
+			res[2] |= 0x02
+			break
+		}
+		res = b
+		count(6)
+	}
+	for _, record := range extra {
+		b := appendDNSRecord(res, record)
+		if len(b) > limit || res[2]&0x02 != 0 {
+			break
+		}
+		res = b
+		count(10)
+	}
+	if size != 0 {
+		res = append(res, 0)
+		res = appendUint16(res, dnsTypeOPT)
+		res = appendUint16(res, dnsMaxUDPSize)
+		res = appendUint32(res, 0)
+		res = appendUint16(res, 0)
+		count(10)
+	}
+	return res
+}
+
+// Size of an OPT record without options.
+const dnsOPTSize = 11
+
+func appendDNSRecord(b []byte, record *dnsRecord) []byte {
+	b = appendDNSName(b, record.name)
+	b = appendUint16(b, record.rtype)
+	b = appendUint16(b, dnsClassIN)
+	b = appendUint32(b, dnsTTL)
+	b = appendUint16(b, uint16(len(record.data)))
+	return append(b, record.data...)
+}
+
+// Answers DNS queries on UDP port for names under domain:
+//
+//	_<group>._tcp.<domain>  SRV records of the services in group
+//	<group>.<domain>        A and AAAA records of the services in group whose
+//	                        host is an address
+//
+// SRV records of services whose host is an address point to a name under
+// addr.<domain> that resolves to the address. Groups whose name contains a dot
+// only have A and AAAA records. Queries are anonymous: with a policy, only the
+// groups it lets any principal snapshot are answered.
+//
+// Returns ErrServerClosed once the server is shut down.
+func (s *Server) ServeDNS(port uint16, domain string) error {
+	if strings.Trim(domain, ".") == "" {
+		return errors.New("DNS domain must not be empty")
+	}
+	if !validDNSName(strings.Trim(domain, ".")) {
+		return errors.New("Invalid DNS domain: " + domain)
+	}
+	conn, err := net.ListenPacket("udp", ":"+strconv.Itoa(int(port)))
+	if err != nil {
+		return err
+	}
+	return s.serveDNS(conn, domain)
+}
+
+func (s *Server) serveDNS(conn net.PacketConn, domain string) error {
+	domain = strings.ToLower(strings.Trim(domain, "."))
+	// Close the connection when Shutdown starts.
+	served := make(chan bool)
+	defer close(served)
+	go func() {
+		select {
+		case <-s.done:
+			conn.Close()
+		case <-served:
+		}
+	}()
+	// Holds a value for every query being answered.
+	queries := make(chan bool, dnsMaxQueries)
+	buf := make([]byte, dnsMaxUDPSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return ErrServerClosed
+			default:
+			}
+			return err
+		}
+		select {
+		case queries <- true:
+		default:
+			// Too many queries, drop this one.
+			continue
+		}
+		msg := append([]byte(nil), buf[:n]...)
+		go func() {
+			defer func() { <-queries }()
+			if res := s.answerDNS(msg, domain); res != nil {
+				if _, err := conn.WriteTo(res, addr); err != nil {
+					log.Println("Error answering DNS query:", err)
+				}
+			}
+		}()
+	}
+}
@@ -0,0 +1,335 @@
+package discovery
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sends a query for name over UDP to addr and returns the response code and
+// the answer and additional records of the response.
+func queryDNS(t *testing.T, addr net.Addr, name string, qtype uint16) (
+	int, []*dnsRecord, []*dnsRecord) {
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	query := []byte{0x12, 0x34, 0x01, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	query = appendDNSName(query, name)
+	query = appendUint16(query, qtype)
+	query = appendUint16(query, dnsClassIN)
+	if _, err = conn.Write(query); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	res := make([]byte, dnsMaxUDPSize)
+	n, err := conn.Read(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = res[:n]
+	if res[0] != 0x12 || res[1] != 0x34 || res[2]&0x80 == 0 ||
+		res[2]&0x01 == 0 {
+		t.Fatal("Wrong header", res[:4])
+	}
+
+	_, offset, err := readDNSName(res, dnsHeaderSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset += 4
+	readRecords := func(count uint16) []*dnsRecord {
+		var records []*dnsRecord
+		for i := uint16(0); i < count; i++ {
+			var record dnsRecord
+			record.name, offset, err = readDNSName(res, offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			record.rtype = binary.BigEndian.Uint16(res[offset:])
+			if ttl := binary.BigEndian.Uint32(res[offset+4:]); ttl != dnsTTL {
+				t.Error("Wrong TTL", ttl)
+			}
+			size := int(binary.BigEndian.Uint16(res[offset+8:]))
+			offset += 10
+			record.data = res[offset : offset+size]
+			offset += size
+			records = append(records, &record)
+		}
+		return records
+	}
+	answers := readRecords(binary.BigEndian.Uint16(res[6:]))
+	readRecords(binary.BigEndian.Uint16(res[8:]))
+	extra := readRecords(binary.BigEndian.Uint16(res[10:]))
+	return int(res[3] & 0xf), answers, extra
+}
+
+func TestDNS(t *testing.T) {
+	server := NewServer()
+	go server.processEvents()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go server.serveDNS(conn, "Discovery.Example.")
+	addr := conn.LocalAddr()
+
+	client := connectTestClient(server, JSON)
+	defer client.Close()
+	for _, service := range []*ServiceDef{
+		{Host: "10.0.0.1", Port: 80, Group: "web"},
+		{Host: "2001:db8::1", Port: 81, Group: "web"},
+		{Host: "web3.example", Port: 82, Group: "web"},
+	} {
+		if err = client.Join(service); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rcode, answers, extra := queryDNS(t, addr,
+		"_web._tcp.discovery.example", dnsTypeSRV)
+	if rcode != dnsNoError || len(answers) != 3 || len(extra) != 2 {
+		t.Fatal("Wrong SRV response", rcode, len(answers), len(extra))
+	}
+	targets := map[uint16]string{}
+	for _, record := range answers {
+		port := binary.BigEndian.Uint16(record.data[4:])
+		targets[port], _, _ = readDNSName(record.data, 6)
+	}
+	if targets[80] != "10.0.0.1.addr.discovery.example" ||
+		targets[81] != "2001-db8--1.addr.discovery.example" ||
+		targets[82] != "web3.example" {
+		t.Error("Wrong SRV targets", targets)
+	}
+	for _, record := range extra {
+		if record.name == targets[80] && record.rtype == dnsTypeA &&
+			net.IP(record.data).Equal(net.ParseIP("10.0.0.1")) {
+			continue
+		}
+		if record.name == targets[81] && record.rtype == dnsTypeAAAA &&
+			net.IP(record.data).Equal(net.ParseIP("2001:db8::1")) {
+			continue
+		}
+		t.Error("Wrong additional record", record)
+	}
+
+	rcode, answers, _ = queryDNS(t, addr, "web.discovery.example", dnsTypeA)
+	if rcode != dnsNoError || len(answers) != 1 ||
+		!net.IP(answers[0].data).Equal(net.ParseIP("10.0.0.1")) {
+		t.Error("Wrong A response", rcode, answers)
+	}
+	rcode, answers, _ = queryDNS(t, addr, "web.discovery.example", dnsTypeAAAA)
+	if rcode != dnsNoError || len(answers) != 1 ||
+		!net.IP(answers[0].data).Equal(net.ParseIP("2001:db8::1")) {
+		t.Error("Wrong AAAA response", rcode, answers)
+	}
+	rcode, answers, _ = queryDNS(t, addr,
+		"10.0.0.1.addr.discovery.example", dnsTypeA)
+	if rcode != dnsNoError || len(answers) != 1 {
+		t.Error("Wrong address response", rcode, answers)
+	}
+
+	rcode, answers, _ = queryDNS(t, addr,
+		"_other._tcp.discovery.example", dnsTypeSRV)
+	if rcode != dnsNXDomain || len(answers) != 0 {
+		t.Error("Expected NXDOMAIN", rcode, answers)
+	}
+	rcode, _, _ = queryDNS(t, addr, "web.example", dnsTypeA)
+	if rcode != dnsRefused {
+		t.Error("Expected REFUSED", rcode)
+	}
+}
+
+func TestDNSPolicy(t *testing.T) {
+	server := NewServer()
+	server.SetPolicy(&Policy{Rules: []*Rule{
+		{Group: "public/secret", Principals: []string{"*"},
+			Operations: []string{"snapshot"}, Deny: true},
+		{Group: "public/*", Principals: []string{"*"},
+			Operations: []string{"snapshot"}},
+		{Group: "*", Principals: []string{"*"}, Operations: []string{"join"}},
+	}})
+	go server.processEvents()
+	client := connectTestClient(server, JSON)
+	defer client.Close()
+	for _, service := range []*ServiceDef{
+		{Host: "10.0.0.1", Group: "public/web"},
+		{Host: "10.0.0.2", Group: "public/secret"},
+		{Host: "10.0.0.3", Group: "private"},
+	} {
+		if err := client.Join(service); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resolve := func(name string) []*dnsRecord {
+		answers, _, ok := server.resolveDNS(
+			&dnsQuestion{name, dnsTypeA, dnsClassIN}, "d")
+		if !ok {
+			return nil
+		}
+		return answers
+	}
+	if answers := resolve("public/web.d"); len(answers) != 1 {
+		t.Error("Expected the allowed group", answers)
+	}
+	if answers := resolve("private.d"); len(answers) != 0 {
+		t.Error("Expected the group to be denied", answers)
+	}
+	if answers := resolve("public/secret.d"); len(answers) != 0 {
+		t.Error("Expected the group to be denied", answers)
+	}
+	answers := resolve("public/.d")
+	if len(answers) != 1 ||
+		!net.IP(answers[0].data).Equal(net.ParseIP("10.0.0.1")) {
+		t.Error("Expected only the allowed group of the prefix", answers)
+	}
+}
+
+func TestDNSEmptyDomain(t *testing.T) {
+	server := NewServer()
+	if err := server.ServeDNS(0, "."); err == nil {
+		t.Error("Expected an empty domain to be rejected")
+	}
+}
+
+func TestDNSLongNames(t *testing.T) {
+	server := NewServer()
+	go server.processEvents()
+	client := connectTestClient(server, JSON)
+	defer client.Close()
+	long := strings.Repeat("a", dnsMaxLabel+1)
+	client.Join(&ServiceDef{Host: long + ".example", Port: 1, Group: "web"})
+	client.Join(&ServiceDef{Host: "web.example", Port: 2, Group: "web"})
+
+	// Services whose name does not fit are left out.
+	query := []byte{0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	query = appendDNSName(query, "_web._tcp.d")
+	query = appendUint16(query, dnsTypeSRV)
+	query = appendUint16(query, dnsClassIN)
+	res := server.answerDNS(query, "d")
+	if res[3] != dnsNoError || binary.BigEndian.Uint16(res[6:]) != 1 {
+		t.Error("Expected a single answer", res[3],
+			binary.BigEndian.Uint16(res[6:]))
+	}
+
+	if validDNSName(long) || validDNSName("a..b") ||
+		validDNSName(strings.Repeat("a.", 127)+"a") {
+		t.Error("Expected names to be invalid")
+	}
+	if !validDNSName(strings.Repeat("a.", 126) + "a") {
+		t.Error("Expected a name of 255 bytes to be valid")
+	}
+	name := []byte{}
+	for i := 0; i < 5; i++ {
+		name = append(name, dnsMaxLabel)
+		name = append(name, strings.Repeat("a", dnsMaxLabel)...)
+	}
+	if _, _, err := readDNSName(append(name, 0), 0); err == nil {
+		t.Error("Expected a name over 255 bytes to be rejected")
+	}
+	if err := server.ServeDNS(0, long+"."); err == nil {
+		t.Error("Expected an invalid domain to be rejected")
+	}
+}
+
+// Queries arriving while dnsMaxQueries are being answered are dropped.
+func TestDNSDropsQueries(t *testing.T) {
+	defer func(max int) { dnsMaxQueries = max }(dnsMaxQueries)
+	dnsMaxQueries = 1
+	server := NewServer()
+	go server.processEvents()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go server.serveDNS(conn, "discovery.")
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Queries wait while the event loop is blocked.
+	release := make(chan bool)
+	server.eventChan <- func() { <-release }
+	for id := byte(1); id <= 2; id++ {
+		query := []byte{0, id, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+		query = appendDNSName(query, "web.discovery")
+		query = appendUint16(query, dnsTypeA)
+		query = appendUint16(query, dnsClassIN)
+		if _, err = client.Write(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	res := make([]byte, dnsMaxUDPSize)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = client.Read(res); err != nil || res[1] != 1 {
+		t.Error("Expected an answer to the first query", res[1], err)
+	}
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err = client.Read(res); err == nil {
+		t.Error("Expected the second query to be dropped", res[1])
+	}
+}
+
+func TestDNSTruncation(t *testing.T) {
+	server := NewServer()
+	go server.processEvents()
+	client := connectTestClient(server, JSON)
+	defer client.Close()
+	for port := uint16(1); port <= 40; port++ {
+		client.Join(&ServiceDef{Host: "10.0.0.1", Port: port, Group: "web"})
+	}
+	query := []byte{0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	query = appendDNSName(query, "_web._tcp.d")
+	query = appendUint16(query, dnsTypeSRV)
+	query = appendUint16(query, dnsClassIN)
+	res := server.answerDNS(query, "d")
+	if len(res) > dnsMinUDPSize || res[2]&0x02 == 0 {
+		t.Error("Expected a truncated response", len(res))
+	}
+
+	// Clients using EDNS0 get larger responses.
+	query[11] = 1
+	query = append(query, 0)
+	query = appendUint16(query, dnsTypeOPT)
+	query = appendUint16(query, dnsMaxUDPSize)
+	query = appendUint32(query, 0)
+	query = appendUint16(query, 0)
+	res = server.answerDNS(query, "d")
+	if len(res) <= dnsMinUDPSize || res[2]&0x02 != 0 ||
+		binary.BigEndian.Uint16(res[6:]) != 40 {
+		t.Error("Expected a complete response", len(res))
+	}
+}
+
+func TestDNSShutdown(t *testing.T) {
+	server := NewServer()
+	// Started as Serve does, so that Shutdown does not start another loop.
+	server.loopOnce.Do(func() { go server.processEvents() })
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(chan error, 1)
+	go func() { result <- server.serveDNS(conn, "discovery.") }()
+	server.Shutdown(context.Background())
+	select {
+	case err = <-result:
+		if err != ErrServerClosed {
+			t.Error("Expected the server to be closed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("DNS not stopped")
+	}
+}
@@ -0,0 +1,50 @@
+package discovery
+
+import (
+	"errors"
+	"strings"
+)
+
+// Group names form a hierarchy separated by "/", e.g. "prod/us-east/api". A
+// name ending in "/", e.g. "prod/" or "prod/us-east/", is a prefix standing for
+// every group below it. Snapshot and Watch accept prefixes and return the
+// services of all those groups, each with its own Group. Services cannot join
+// a prefix.
+const groupSeparator = "/"
+
+// Returns true if group is a prefix of other groups rather than a group.
+func isPrefix(group string) bool {
+	return strings.HasSuffix(group, groupSeparator)
+}
+
+// Returns true if the group name is group or, when group is a prefix, below
+// it.
+func inGroup(name, group string) bool {
+	if isPrefix(group) {
+		return strings.HasPrefix(name, group)
+	}
+	return name == group
+}
+
+// Returns group followed by every prefix above it, e.g. "a/b/c", "a/", "a/b/".
+// These are the names watchers of changes to group may watch.
+func groupAndPrefixes(group string) []string {
+	names := []string{group}
+	for i := 0; i < len(group); {
+		n := strings.Index(group[i:], groupSeparator)
+		if n < 0 {
+			break
+		}
+		i += n + len(groupSeparator)
+		names = append(names, group[:i])
+	}
+	return names
+}
+
+// Returns an error if services cannot join group.
+func validateGroup(group string) error {
+	if isPrefix(group) {
+		return errors.New("Invalid group: " + group + " is a prefix")
+	}
+	return nil
+}
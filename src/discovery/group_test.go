@@ -0,0 +1,26 @@
+package discovery
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGroupAndPrefixes(t *testing.T) {
+	tests := map[string][]string{
+		"api":         {"api"},
+		"prod/api":    {"prod/api", "prod/"},
+		"prod/us/api": {"prod/us/api", "prod/", "prod/us/"},
+	}
+	for group, expected := range tests {
+		if names := groupAndPrefixes(group); !reflect.DeepEqual(names, expected) {
+			t.Error("Wrong prefixes of", group, names)
+		}
+	}
+	if !inGroup("prod/us/api", "prod/") || inGroup("production", "prod/") ||
+		inGroup("prod/api", "prod") || !inGroup("prod", "prod") {
+		t.Error("Wrong inGroup")
+	}
+	if validateGroup("prod/") == nil || validateGroup("prod/api") != nil {
+		t.Error("Wrong validateGroup")
+	}
+}
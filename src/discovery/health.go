@@ -0,0 +1,217 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// Types of health checks.
+const (
+	// Passes if the server can open a TCP connection to the service.
+	CheckTCP = "tcp"
+	// Passes if an HTTP GET of Path on the service returns a 2xx status.
+	CheckHTTP = "http"
+	// Passes if Script exits with status 0. Run by the client that joined the
+	// service, which reports the result to the server.
+	CheckScript = "script"
+)
+
+// Defaults of the interval and timeout of health checks, in seconds.
+const (
+	DefaultCheckInterval = 10
+	DefaultCheckTimeout  = 5
+)
+
+// A HealthCheck tells how to check that a service is working. A service whose
+// check fails is marked Unhealthy, left out of snapshots and watchers see it
+// leave. It joins again once the check passes.
+type HealthCheck struct {
+	// One of CheckTCP, CheckHTTP or CheckScript.
+	Type string `json:"type"`
+	// Seconds between checks. DefaultCheckInterval when 0.
+	Interval uint32 `json:"interval,omitempty"`
+	// Seconds a check may take. DefaultCheckTimeout, but no more than the
+	// interval, when 0.
+	Timeout uint32 `json:"timeout,omitempty"`
+	// Path requested by http checks. Defaults to /.
+	Path string `json:"path,omitempty"`
+	// Command and arguments run by script checks.
+	Script []string `json:"script,omitempty"`
+}
+
+// Returns an error if the check cannot be run.
+func (c *HealthCheck) validate() error {
+	switch c.Type {
+	case CheckTCP, CheckHTTP:
+		return nil
+	case CheckScript:
+		if len(c.Script) == 0 {
+			return errors.New("Script check without a script")
+		}
+		return nil
+	}
+	return errors.New("Unknown health check type: " + c.Type)
+}
+
+func (c *HealthCheck) interval() time.Duration {
+	if c.Interval == 0 {
+		return DefaultCheckInterval * time.Second
+	}
+	return time.Duration(c.Interval) * time.Second
+}
+
+func (c *HealthCheck) timeout() time.Duration {
+	timeout := time.Duration(c.Timeout) * time.Second
+	if c.Timeout == 0 {
+		timeout = DefaultCheckTimeout * time.Second
+		if interval := c.interval(); interval < timeout {
+			timeout = interval
+		}
+	}
+	return timeout
+}
+
+// Runs the check against host:port, giving up when ctx is done. Returns nil if
+// the service is healthy.
+func (c *HealthCheck) run(ctx context.Context, host string, port uint16) error {
+	address := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	ctx, cancel := context.WithTimeout(ctx, c.timeout())
+	defer cancel()
+	switch c.Type {
+	case CheckTCP:
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case CheckHTTP:
+		path := c.Path
+		if path == "" {
+			path = "/"
+		}
+		req, err := http.NewRequest("GET", "http://"+address+path, nil)
+		if err != nil {
+			return err
+		}
+		res, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			return fmt.Errorf("HTTP status %s", res.Status)
+		}
+		return nil
+	case CheckScript:
+		return exec.CommandContext(ctx, c.Script[0], c.Script[1:]...).Run()
+	}
+	return errors.New("Unknown health check type: " + c.Type)
+}
+
+// Starts the tcp and http checks that are due. Results are applied in the
+// event loop. In a cluster only the leader runs checks and submits a command
+// for every change of health.
+func (s *Server) runChecks(now time.Time) {
+	if s.cluster != nil && !s.cluster.isLeader() || s.checkCtx.Err() != nil {
+		return
+	}
+	iter := s.services.Iterator()
+	for service := iter.Next(); service != nil; service = iter.Next() {
+		check := service.Check
+		if check == nil || check.Type == CheckScript || service.checking ||
+			now.Before(service.nextCheck) {
+			continue
+		}
+		service.checking = true
+		service.nextCheck = now.Add(check.interval())
+		s.checks.Add(1)
+		go func(service *ServiceDef) {
+			defer s.checks.Done()
+			err := check.run(s.checkCtx, service.Host, service.Port)
+			if s.checkCtx.Err() != nil {
+				// The server is shutting down.
+				return
+			}
+			s.eventChan <- func() { s.checked(service, err) }
+		}(service)
+	}
+}
+
+// Cancels the running checks and waits for them to return. No checks start
+// afterwards. Must not be called in the event loop, which must be running.
+func (s *Server) stopChecks() {
+	stopped := make(chan bool)
+	s.eventChan <- func() {
+		s.cancelChecks()
+		close(stopped)
+	}
+	<-stopped
+	s.checks.Wait()
+}
+
+// Applies the result of a check of service.
+func (s *Server) checked(service *ServiceDef, err error) {
+	// The registered definition is replaced when it changes, e.g. its state,
+	// so look it up again.
+	e := s.services.Find(service)
+	if e == nil || e.joined != service.joined {
+		// Left or joined again while it was checked.
+		return
+	}
+	e.checking = false
+	unhealthy := err != nil
+	if unhealthy == e.Unhealthy {
+		return
+	}
+	if unhealthy {
+		log.Println("Check failed:", service.toString(), err)
+	}
+	s.submitAsync(&command{
+		Op: cmdHealth,
+		Service: &ServiceDef{Host: service.Host, Port: service.Port,
+			Group: service.Group, Unhealthy: unhealthy},
+		Lease: service.joined})
+}
+
+// Sets the health of the registered service equal to service. When lease is
+// set, the change comes from a check run by the server for the service that
+// joined with that lease and is dropped if the service joined again since.
+// Heartbeats do not matter. Otherwise the connection of service must own the
+// registered one. Returns false if the service is not found.
+func (s *Server) setHealth(service *ServiceDef, lease uint64) bool {
+	e := s.services.Find(service)
+	if e == nil {
+		return false
+	}
+	if lease != 0 && e.joined != lease {
+		return true
+	}
+	if lease == 0 && !e.ownedBy(service.connId) {
+		return false
+	}
+	if e.Unhealthy == service.Unhealthy {
+		return true
+	}
+	// Snapshots already taken may still hold e, change a copy.
+	updated := *e
+	updated.Unhealthy = service.Unhealthy
+	e = &updated
+	s.services.Add(e)
+	// Watchers only see healthy services.
+	if e.Unhealthy {
+		log.Println("Unhealthy:", e.toString())
+		s.publish("DiscoveryClient.Leave", e, nil)
+	} else {
+		log.Println("Healthy:", e.toString())
+		s.publish("DiscoveryClient.Join", e, nil)
+	}
+	return true
+}
@@ -0,0 +1,314 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Starts the checks of every service of server now.
+func checkNow(server *Server) {
+	server.run(func() error {
+		for iter := server.services.Iterator(); ; {
+			service := iter.Next()
+			if service == nil {
+				break
+			}
+			service.nextCheck = time.Time{}
+		}
+		server.runChecks(time.Now())
+		return nil
+	})
+}
+
+// Runs the checks of server until the service has the given health.
+func waitForHealth(server *Server, service *ServiceDef, healthy bool) bool {
+	return waitFor(func() bool {
+		checkNow(server)
+		unhealthy := true
+		server.run(func() error {
+			if e := server.services.Find(service); e != nil {
+				unhealthy = e.Unhealthy
+			}
+			return nil
+		})
+		return unhealthy != healthy
+	})
+}
+
+func TestHealthCheckTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+	server := NewServer()
+	go server.processEvents()
+	client := connectTestClient(server, Protobuf)
+	defer client.Close()
+	_, events, err := client.Watch("g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := &ServiceDef{Host: "127.0.0.1", Port: port, Group: "g",
+		Check: &HealthCheck{Type: CheckTCP, Interval: 1}}
+	if err = client.Join(service); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-events; event.Type != Joined {
+		t.Error("Expected a join", event)
+	}
+	if !waitForHealth(server, service, true) {
+		t.Error("Service should be healthy")
+	}
+
+	listener.Close()
+	if !waitForHealth(server, service, false) {
+		t.Fatal("Service should be unhealthy")
+	}
+	if event := <-events; event.Type != Left || !event.Service.Unhealthy {
+		t.Error("Expected an unhealthy leave", event)
+	}
+	snapshot, err := client.Snapshot("g")
+	if err != nil || len(snapshot) != 0 {
+		t.Error("Unhealthy service in snapshot", snapshot, err)
+	}
+
+	if listener, err = net.Listen("tcp", address); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if !waitForHealth(server, service, true) {
+		t.Fatal("Service should be healthy again")
+	}
+	if event := <-events; event.Type != Joined || event.Service.Unhealthy {
+		t.Error("Expected a healthy join", event)
+	}
+}
+
+func TestHealthCheckHTTP(t *testing.T) {
+	var status int32 = http.StatusOK
+	web := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/health" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(int(atomic.LoadInt32(&status)))
+		}))
+	defer web.Close()
+	addr := web.Listener.Addr().(*net.TCPAddr)
+	server := NewServer()
+	go server.processEvents()
+
+	w := httpRequest(server, "POST", "/groups/g", `{"host": "127.0.0.1",
+		"port": `+strconv.Itoa(addr.Port)+`, "check": {"type": "http",
+		"path": "/health"}}`, "")
+	if w.Code != http.StatusNoContent {
+		t.Fatal("Join failed", w.Code, w.Body)
+	}
+	service := &ServiceDef{Host: "127.0.0.1", Port: uint16(addr.Port),
+		Group: "g"}
+	if !waitForHealth(server, service, true) {
+		t.Error("Service should be healthy")
+	}
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	if !waitForHealth(server, service, false) {
+		t.Error("Service should be unhealthy")
+	}
+	// Unhealthy services are listed on request.
+	var snapshot Snapshot
+	w = httpRequest(server, "GET", "/groups/g?all=true", "", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &snapshot); err != nil ||
+		len(snapshot.Services) != 1 || !snapshot.Services[0].Unhealthy {
+		t.Error("Wrong snapshot", w.Body, err)
+	}
+	w = httpRequest(server, "GET", "/groups/g", "", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &snapshot); err != nil ||
+		len(snapshot.Services) != 0 {
+		t.Error("Wrong snapshot", w.Body, err)
+	}
+}
+
+// Heartbeats do not make the server drop the result of a check.
+func TestHealthCheckHeartbeat(t *testing.T) {
+	server := NewServer()
+	go server.processEvents()
+	service := &ServiceDef{Host: "h", Port: 1, Group: "g", TTL: 10,
+		Check: &HealthCheck{Type: CheckTCP}}
+	server.run(func() error {
+		def := *service
+		server.join(&def)
+		joined := def.joined
+		if !server.heartbeat(service) {
+			t.Error("Heartbeat failed")
+		}
+		unhealthy := &ServiceDef{Host: "h", Port: 1, Group: "g",
+			Unhealthy: true}
+		if !server.setHealth(unhealthy, joined) ||
+			!server.services.Find(service).Unhealthy {
+			t.Error("Result of the check dropped after a heartbeat")
+		}
+
+		// The result of a check of an earlier join is dropped.
+		again := *service
+		server.join(&again)
+		if !server.setHealth(unhealthy, joined) ||
+			server.services.Find(service).Unhealthy {
+			t.Error("Result of the check applied to a new join")
+		}
+		return nil
+	})
+}
+
+// Snapshots already returned are serialized outside the event loop, a change
+// of health must not modify them.
+func TestHealthCopyOnWrite(t *testing.T) {
+	server := NewServer()
+	go server.processEvents()
+	service := &ServiceDef{Host: "h", Port: 1, Group: "g"}
+	var snapshot []*ServiceDef
+	server.run(func() error {
+		server.join(&ServiceDef{Host: "h", Port: 1, Group: "g"})
+		snapshot = server.snapshot("g")
+		unhealthy := *service
+		unhealthy.Unhealthy = true
+		server.setHealth(&unhealthy, 0)
+		return nil
+	})
+	if len(snapshot) != 1 || snapshot[0].Unhealthy {
+		t.Error("Snapshot changed", snapshot)
+	}
+	if countServices(server, "g") != 0 {
+		t.Error("Service should be unhealthy")
+	}
+}
+
+// Shutdown cancels the checks that are running.
+func TestHealthCheckShutdown(t *testing.T) {
+	started := make(chan bool, 1)
+	web := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			started <- true
+			<-r.Context().Done()
+		}))
+	defer web.Close()
+	addr := web.Listener.Addr().(*net.TCPAddr)
+	server := NewServer()
+	server.loopOnce.Do(func() { go server.processEvents() })
+	server.run(func() error {
+		server.join(&ServiceDef{Host: "127.0.0.1", Port: uint16(addr.Port),
+			Group: "g", Check: &HealthCheck{Type: CheckHTTP, Timeout: 60}})
+		return nil
+	})
+	checkNow(server)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal("Shutdown waited for the check", err)
+	}
+}
+
+func TestHealthCheckScript(t *testing.T) {
+	server := NewServer()
+	go server.processEvents()
+	client := connectTestClient(server, JSON)
+	defer client.Close()
+	service := &ServiceDef{Host: "h", Port: 1, Group: "g",
+		Check: &HealthCheck{Type: CheckScript, Script: []string{"false"}}}
+	if err := client.Join(service); err != nil {
+		t.Fatal(err)
+	}
+	// The client runs the script and reports the result right away.
+	if !waitFor(func() bool { return countServices(server, "g") == 0 }) {
+		t.Error("Service should be unhealthy")
+	}
+	if err := client.SetHealth(service, true); err != nil {
+		t.Error(err)
+	}
+	if countServices(server, "g") != 1 {
+		t.Error("Service should be healthy")
+	}
+	if err := client.Leave(service); err != nil {
+		t.Error(err)
+	}
+
+	// Only the connection that joined the service may report its health.
+	other := connectTestClient(server, JSON)
+	defer other.Close()
+	client.Join(&ServiceDef{Host: "h", Port: 2, Group: "g"})
+	if err := other.SetHealth(
+		&ServiceDef{Host: "h", Port: 2, Group: "g"}, false); err == nil {
+		t.Error("Expected an error")
+	}
+}
+
+func TestHealthCheckValidation(t *testing.T) {
+	server := NewServer()
+	go server.processEvents()
+	for _, protocol := range []Protocol{JSON, Protobuf} {
+		client := connectTestClient(server, protocol)
+		for _, check := range []*HealthCheck{
+			{Type: "icmp"}, {Type: CheckScript}} {
+			if err := client.Join(
+				&ServiceDef{Host: "h", Group: "g", Check: check}); err == nil {
+				t.Error("Expected an error for", check)
+			}
+		}
+		service := &ServiceDef{Host: "h", Group: "g", Check: &HealthCheck{
+			Type: CheckHTTP, Interval: 30, Timeout: 2, Path: "/health"}}
+		if err := client.Join(service); err != nil {
+			t.Error(err)
+		}
+		server.run(func() error {
+			check := server.services.Find(service).Check
+			if check == nil || check.Type != CheckHTTP || check.Interval != 30 ||
+				check.Timeout != 2 || check.Path != "/health" {
+				t.Error("Wrong check", check)
+			}
+			return nil
+		})
+		client.Close()
+	}
+}
+
+func TestHealthCheckCluster(t *testing.T) {
+	servers := startTestCluster(t, 3)
+	defer stopTestCluster(servers)
+	if !waitFor(func() bool { return findLeader(servers) != -1 }) {
+		t.Fatal("No leader elected")
+	}
+	leader := findLeader(servers)
+	// Nothing listens on the port once the listener is closed.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+
+	client := connectTestClient(servers[(leader+1)%len(servers)], JSON)
+	defer client.Close()
+	if err = client.Join(&ServiceDef{Host: "127.0.0.1", Port: port,
+		Group: "g", Check: &HealthCheck{Type: CheckTCP}}); err != nil {
+		t.Fatal(err)
+	}
+	// Only the leader runs checks and replicates the result.
+	for i, server := range servers {
+		if !waitFor(func() bool {
+			checkNow(servers[leader])
+			return countServices(server, "g") == 0
+		}) {
+			t.Error("Unhealthy service not replicated to", i)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package discovery
+
+// Number of changes kept by default for watchers resuming from a revision.
+const DefaultHistorySize = 1024
+
+// history keeps the most recent changes to the registry so that a watcher that
+// reconnects can resume from the last revision it saw instead of starting over
+// with a snapshot.
+type history struct {
+	// Ring buffer of changes ordered by revision, starting at start.
+	changes []change
+	start   int
+	// Every change after this revision is in the history.
+	since uint64
+}
+
+type change struct {
+	// The DiscoveryClient method used to send the change to watchers.
+	method  string
+	service *ServiceDef
+	// The definition a joining service replaced, if any. Watchers selecting
+	// by labels see the service leave when it no longer matches.
+	prev *ServiceDef
+}
+
+// Returns a history of at most size changes made after revision since.
+func newHistory(size int, since uint64) *history {
+	return &history{changes: make([]change, 0, size), since: since}
+}
+
+// Records a change. service.Revision must be the revision of the change. prev
+// is the definition service replaced, if any.
+func (h *history) add(method string, service, prev *ServiceDef) {
+	def := *service
+	c := change{method, &def, nil}
+	if prev != nil {
+		old := *prev
+		c.prev = &old
+	}
+	if len(h.changes) < cap(h.changes) {
+		h.changes = append(h.changes, c)
+		return
+	}
+	if len(h.changes) == 0 {
+		// The history is disabled.
+		h.since = service.Revision
+		return
+	}
+	h.since = h.changes[h.start].service.Revision
+	h.changes[h.start] = c
+	h.start = (h.start + 1) % len(h.changes)
+}
+
+// Returns the changes to group, or to the groups under the prefix group, after
+// revision. Returns false if some of them are no longer in the history.
+func (h *history) after(group string, revision uint64) ([]change, bool) {
+	if revision < h.since {
+		return nil, false
+	}
+	var changes []change
+	for i := range h.changes {
+		c := h.changes[(h.start+i)%len(h.changes)]
+		if c.service.Revision > revision && inGroup(c.service.Group, group) {
+			changes = append(changes, c)
+		}
+	}
+	return changes, true
+}
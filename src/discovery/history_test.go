@@ -0,0 +1,51 @@
+package discovery
+
+import "testing"
+
+func addChange(h *history, host string, revision uint64) {
+	h.add("DiscoveryClient.Join",
+		&ServiceDef{Host: host, Group: "group", Revision: revision}, nil)
+}
+
+func TestHistoryAfter(t *testing.T) {
+	h := newHistory(3, 10)
+	addChange(h, "a", 11)
+	h.add("DiscoveryClient.Join",
+		&ServiceDef{Host: "b", Group: "other", Revision: 12}, nil)
+	addChange(h, "c", 13)
+
+	changes, ok := h.after("group", 10)
+	if !ok || len(changes) != 2 || changes[0].service.Host != "a" ||
+		changes[1].service.Host != "c" {
+		t.Error("Wrong changes", changes, ok)
+	}
+	if changes, ok = h.after("group", 13); !ok || len(changes) != 0 {
+		t.Error("Expected no changes", changes, ok)
+	}
+	if _, ok = h.after("group", 9); ok {
+		t.Error("Changes before the history should not be found")
+	}
+
+	// Drops the oldest changes.
+	addChange(h, "d", 14)
+	addChange(h, "e", 15)
+	if _, ok = h.after("group", 11); ok {
+		t.Error("Dropped change should not be found")
+	}
+	changes, ok = h.after("group", 12)
+	if !ok || len(changes) != 3 || changes[0].service.Host != "c" ||
+		changes[2].service.Host != "e" {
+		t.Error("Wrong changes after wrapping", changes, ok)
+	}
+}
+
+func TestHistoryDisabled(t *testing.T) {
+	h := newHistory(0, 10)
+	addChange(h, "a", 11)
+	if _, ok := h.after("group", 10); ok {
+		t.Error("Disabled history should not have changes")
+	}
+	if changes, ok := h.after("group", 11); !ok || len(changes) != 0 {
+		t.Error("Expected no changes", changes, ok)
+	}
+}
@@ -0,0 +1,342 @@
+package discovery
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// httpAPI serves the registry as JSON over HTTP:
+//
+//	GET    /groups                      names of the groups with services
+//	GET    /groups/<group>              Snapshot of the group, all=true
+//	                                    includes unhealthy services and
+//	                                    selector= selects services by label
+//	GET    /groups/<group>?revision=    waits for a change, see poll
+//	POST   /groups/<group>              joins the ServiceDef in the body
+//	DELETE /groups/<group>?host=&port=  leaves a service
+//	PUT    /groups/<group>?host=&port=  sets the state= of a service
+//	GET    /connections                 open connections, requires the admin
+//	                                    operation on "*"
+//
+// A GET of a group that accepts text/event-stream streams its changes instead,
+// see stream.
+//
+// Services joined over HTTP belong to no connection. They stay until they are
+// deleted, unless they have a TTL, and may only be deleted over HTTP unless
+// they are persistent.
+type httpAPI struct {
+	server *Server
+}
+
+// Returns a handler serving the HTTP API of the server. The server's policy,
+// tokens and host verification apply as they do to connections: requests
+// authenticate with an "Authorization: Bearer <token>" header or a client
+// certificate.
+func (s *Server) HTTPHandler() http.Handler {
+	return &httpAPI{s}
+}
+
+// An error with the HTTP status it is reported with.
+type httpError struct {
+	status int
+	err    error
+}
+
+func (e *httpError) Error() string { return e.err.Error() }
+
+// Returns the principal of the request, or an error if the server requires
+// authentication and the request has not authenticated.
+func (h *httpAPI) principal(r *http.Request) (string, error) {
+	if cert := h.cert(r); cert != nil {
+		return cert.Subject.CommonName, nil
+	}
+	if h.server.tokens == nil {
+		return "", nil
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", &httpError{http.StatusUnauthorized,
+			errors.New("Authentication required")}
+	}
+	principal, err := h.server.tokens.Verify(auth[len("Bearer "):])
+	if err != nil {
+		return "", &httpError{http.StatusUnauthorized, err}
+	}
+	return principal, nil
+}
+
+// Returns the verified client certificate of the request, if any.
+func (h *httpAPI) cert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return r.TLS.PeerCertificates[0]
+}
+
+// Returns an error unless the request may perform op on group. Returns the
+// principal of the request otherwise.
+func (h *httpAPI) authorize(r *http.Request, op, group string) (string, error) {
+	principal, err := h.principal(r)
+	if err != nil || h.server.policy == nil {
+		return principal, err
+	}
+	if err = h.server.policy.check(principal, op, group); err != nil {
+		return "", &httpError{http.StatusForbidden, err}
+	}
+	return principal, nil
+}
+
+func (h *httpAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var err error
+	switch path := r.URL.Path; {
+	case path == "/groups" && r.Method == "GET":
+		err = h.groups(w, r)
+	case strings.HasPrefix(path, "/groups/") && len(path) > len("/groups/"):
+		group := path[len("/groups/"):]
+		switch r.Method {
+		case "GET":
+			err = h.get(w, r, group)
+		case "POST":
+			err = h.join(w, r, group)
+		case "PUT":
+			err = h.setState(w, r, group)
+		case "DELETE":
+			err = h.leave(w, r, group)
+		default:
+			err = &httpError{http.StatusMethodNotAllowed,
+				errors.New("Method not allowed")}
+		}
+	case path == "/connections" && r.Method == "GET":
+		err = h.connections(w, r)
+	default:
+		err = &httpError{http.StatusNotFound, errors.New("Not found")}
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		if e, ok := err.(*httpError); ok {
+			status = e.status
+		}
+		http.Error(w, err.Error(), status)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
+
+// Lists the groups the request may snapshot, as ListGroups does.
+func (h *httpAPI) groups(w http.ResponseWriter, r *http.Request) error {
+	principal, err := h.principal(r)
+	if err != nil {
+		return err
+	}
+	policy := h.server.policy
+	groups := []string{}
+	err = h.server.run(func() error {
+		for _, group := range h.server.services.Groups("") {
+			if policy == nil ||
+				policy.check(principal, opSnapshot, group) == nil {
+				groups = append(groups, group)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, groups)
+}
+
+// Returns the subscription of the request to the services of group matching
+// its selector parameter. Fails unless the request may perform op on group.
+func (h *httpAPI) subscribe(r *http.Request, op, group string) (
+	*subscription, error) {
+	principal, err := h.authorize(r, op, group)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := h.server.subscribe(
+		principal, op, group, r.FormValue("selector"))
+	if err != nil {
+		return nil, &httpError{http.StatusBadRequest, err}
+	}
+	return sub, nil
+}
+
+func (h *httpAPI) snapshot(
+	w http.ResponseWriter, r *http.Request, group string) error {
+	sub, err := h.subscribe(r, opSnapshot, group)
+	if err != nil {
+		return err
+	}
+	return h.writeSnapshot(w, group, sub, r.FormValue("all") == "true")
+}
+
+// Writes the Snapshot of the services in group that sub concerns. Unhealthy
+// services are left out unless all is set.
+func (h *httpAPI) writeSnapshot(
+	w http.ResponseWriter, group string, sub *subscription, all bool) error {
+	var snapshot Snapshot
+	err := h.server.run(func() error {
+		snapshot.Revision = h.server.revision
+		if all {
+			snapshot.Services = h.server.services.Group(group)
+		} else {
+			snapshot.Services = h.server.snapshot(group)
+		}
+		snapshot.Services = sub.filter(snapshot.Services)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, &snapshot)
+}
+
+func (h *httpAPI) join(
+	w http.ResponseWriter, r *http.Request, group string) error {
+	if _, err := h.authorize(r, opJoin, group); err != nil {
+		return err
+	}
+	if err := validateGroup(group); err != nil {
+		return &httpError{http.StatusBadRequest, err}
+	}
+	var service ServiceDef
+	if err := json.NewDecoder(r.Body).Decode(&service); err != nil {
+		return &httpError{http.StatusBadRequest, err}
+	}
+	service.Group = group
+	if service.Check != nil {
+		if err := service.Check.validate(); err != nil {
+			return &httpError{http.StatusBadRequest, err}
+		}
+		if service.Check.Type == CheckScript {
+			return &httpError{http.StatusBadRequest,
+				errors.New("Script checks need a connection to report them")}
+		}
+	}
+	if err := normalizeState(&service); err != nil {
+		return &httpError{http.StatusBadRequest, err}
+	}
+	if err := h.server.checkHost(h.cert(r), &service); err != nil {
+		return &httpError{http.StatusForbidden, err}
+	}
+	if err := h.server.submit(
+		&command{Op: cmdJoin, Service: &service}); err != nil {
+		return &httpError{http.StatusConflict, err}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (h *httpAPI) leave(
+	w http.ResponseWriter, r *http.Request, group string) error {
+	if _, err := h.authorize(r, opLeave, group); err != nil {
+		return err
+	}
+	service, err := serviceParams(r, group)
+	if err != nil {
+		return err
+	}
+	if err = h.server.checkHost(h.cert(r), service); err != nil {
+		return &httpError{http.StatusForbidden, err}
+	}
+	if err = h.server.submit(
+		&command{Op: cmdLeave, Service: service}); err != nil {
+		return &httpError{http.StatusNotFound, err}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// Returns the service of group identified by the host and port parameters.
+func serviceParams(r *http.Request, group string) (*ServiceDef, error) {
+	port, err := strconv.ParseUint(r.FormValue("port"), 10, 16)
+	if err != nil {
+		return nil, &httpError{http.StatusBadRequest,
+			errors.New("Invalid port: " + r.FormValue("port"))}
+	}
+	return &ServiceDef{
+		Host: r.FormValue("host"), Port: uint16(port), Group: group}, nil
+}
+
+// Sets the state of a service. Services joined over HTTP may be changed by
+// anyone who may join the group, others require the admin operation.
+func (h *httpAPI) setState(
+	w http.ResponseWriter, r *http.Request, group string) error {
+	_, err := h.authorize(r, opAdmin, group)
+	admin := err == nil
+	if !admin {
+		if _, err = h.authorize(r, opJoin, group); err != nil {
+			return err
+		}
+	}
+	service, err := serviceParams(r, group)
+	if err != nil {
+		return err
+	}
+	service.State = r.FormValue("state")
+	if err = normalizeState(service); err != nil {
+		return &httpError{http.StatusBadRequest, err}
+	}
+	if !admin {
+		if err = h.server.checkHost(h.cert(r), service); err != nil {
+			return &httpError{http.StatusForbidden, err}
+		}
+	}
+	if err = h.server.submit(&command{
+		Op: cmdState, Service: service, Admin: admin}); err != nil {
+		return &httpError{http.StatusNotFound, err}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// A connection as listed by GET /connections.
+type connectionInfo struct {
+	Id        int32  `json:"id"`
+	Remote    string `json:"remote"`
+	Principal string `json:"principal,omitempty"`
+	// Number of services joined on the connection.
+	Services int `json:"services"`
+}
+
+type connectionInfos []*connectionInfo
+
+func (c connectionInfos) Len() int           { return len(c) }
+func (c connectionInfos) Less(i, j int) bool { return c[i].Id < c[j].Id }
+func (c connectionInfos) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// Lists the open connections. They reveal the addresses and principals of
+// every client, so the request needs the admin operation on every group.
+func (h *httpAPI) connections(w http.ResponseWriter, r *http.Request) error {
+	if _, err := h.authorize(r, opAdmin, anyName); err != nil {
+		return err
+	}
+	s := h.server
+	infos := connectionInfos{}
+	s.connLock.Lock()
+	for id, d := range s.conns {
+		principal, _ := d.identity()
+		infos = append(infos, &connectionInfo{
+			Id: id, Remote: d.conn.RemoteAddr().String(), Principal: principal})
+	}
+	s.connLock.Unlock()
+	err := s.run(func() error {
+		for _, info := range infos {
+			info.Services = len(s.services.Connection(info.Id))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Sort(infos)
+	return writeJSON(w, infos)
+}
@@ -0,0 +1,167 @@
+package discovery
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Sends a request to the HTTP API of server and returns the response.
+func httpRequest(
+	server *Server, method, url, body, token string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest(method, url, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	server.HTTPHandler().ServeHTTP(w, r)
+	return w
+}
+
+func TestHTTPJoinSnapshotLeave(t *testing.T) {
+	server := NewServer()
+	go server.processEvents()
+
+	w := httpRequest(server, "POST", "/groups/web/a",
+		`{"host": "h", "port": 80}`, "")
+	if w.Code != http.StatusNoContent {
+		t.Fatal("Join failed", w.Code, w.Body)
+	}
+	w = httpRequest(server, "POST", "/groups/web/a", `{"host"`, "")
+	if w.Code != http.StatusBadRequest {
+		t.Error("Expected a bad request", w.Code)
+	}
+
+	w = httpRequest(server, "GET", "/groups", "", "")
+	var groups []string
+	if err := json.Unmarshal(w.Body.Bytes(), &groups); err != nil ||
+		len(groups) != 1 || groups[0] != "web/a" {
+		t.Error("Wrong groups", w.Body, err)
+	}
+
+	w = httpRequest(server, "GET", "/groups/web/a", "", "")
+	var snapshot Snapshot
+	if err := json.Unmarshal(w.Body.Bytes(), &snapshot); err != nil ||
+		len(snapshot.Services) != 1 || snapshot.Services[0].Host != "h" ||
+		snapshot.Services[0].Group != "web/a" || snapshot.Revision == 0 {
+		t.Error("Wrong snapshot", w.Body, err)
+	}
+
+	// A connection cannot remove a service joined over HTTP.
+	client := connectTestClient(server, JSON)
+	defer client.Close()
+	if err := client.Leave(
+		&ServiceDef{Host: "h", Port: 80, Group: "web/a"}); err == nil {
+		t.Error("Expected leave to fail")
+	}
+
+	w = httpRequest(server, "DELETE", "/groups/web/a?host=h&port=80", "", "")
+	if w.Code != http.StatusNoContent {
+		t.Error("Leave failed", w.Code, w.Body)
+	}
+	w = httpRequest(server, "DELETE", "/groups/web/a?host=h&port=80", "", "")
+	if w.Code != http.StatusNotFound {
+		t.Error("Expected the service to be gone", w.Code)
+	}
+	w = httpRequest(server, "DELETE", "/groups/web/a?host=h", "", "")
+	if w.Code != http.StatusBadRequest {
+		t.Error("Expected a bad request", w.Code)
+	}
+	w = httpRequest(server, "GET", "/other", "", "")
+	if w.Code != http.StatusNotFound {
+		t.Error("Expected not found", w.Code)
+	}
+}
+
+func TestHTTPConnections(t *testing.T) {
+	server := NewServer()
+	server.SetTokenVerifier(testTokens{"secret": "pay"})
+	go server.processEvents()
+	client := connectTestClient(server, JSON)
+	defer client.Close()
+	if err := client.call(
+		"Discovery.Authenticate", "secret", &Void{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Join(&ServiceDef{Host: "h", Group: "g"}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httpRequest(server, "GET", "/connections", "", "")
+	if w.Code != http.StatusUnauthorized {
+		t.Error("Expected authentication to be required", w.Code)
+	}
+	w = httpRequest(server, "GET", "/connections", "", "secret")
+	var infos []*connectionInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &infos); err != nil ||
+		len(infos) != 1 || infos[0].Principal != "pay" ||
+		infos[0].Services != 1 {
+		t.Error("Wrong connections", w.Body, err)
+	}
+}
+
+func TestHTTPPolicy(t *testing.T) {
+	server := NewServer()
+	server.SetPolicy(&Policy{Rules: []*Rule{
+		{Group: "*", Principals: []string{"*"}, Operations: []string{"snapshot"}},
+	}})
+	go server.processEvents()
+	w := httpRequest(server, "POST", "/groups/g", `{"host": "h"}`, "")
+	if w.Code != http.StatusForbidden {
+		t.Error("Expected join to be denied", w.Code)
+	}
+	w = httpRequest(server, "GET", "/groups/g", "", "")
+	if w.Code != http.StatusOK {
+		t.Error("Expected snapshot to be allowed", w.Code, w.Body)
+	}
+}
+
+func TestHTTPPolicyListing(t *testing.T) {
+	server := NewServer()
+	server.SetTokenVerifier(testTokens{"o": "ops", "u": "user"})
+	server.SetPolicy(&Policy{Rules: []*Rule{
+		{Group: "*", Principals: []string{"ops"}, Operations: []string{"*"}},
+		{Group: "g", Principals: []string{"user"},
+			Operations: []string{"snapshot"}},
+	}})
+	go server.processEvents()
+	httpRequest(server, "POST", "/groups/g", `{"host": "h"}`, "o")
+	httpRequest(server, "POST", "/groups/hidden", `{"host": "h"}`, "o")
+
+	w := httpRequest(server, "GET", "/groups", "", "u")
+	var groups []string
+	if err := json.Unmarshal(w.Body.Bytes(), &groups); err != nil ||
+		len(groups) != 1 || groups[0] != "g" {
+		t.Error("Expected only the groups that may be snapshot", w.Body, err)
+	}
+	w = httpRequest(server, "GET", "/connections", "", "u")
+	if w.Code != http.StatusForbidden {
+		t.Error("Expected connections to require admin", w.Code)
+	}
+	w = httpRequest(server, "GET", "/connections", "", "o")
+	if w.Code != http.StatusOK {
+		t.Error("Expected connections to be allowed", w.Code, w.Body)
+	}
+}
+
+func TestHTTPSelector(t *testing.T) {
+	server := NewServer()
+	go server.processEvents()
+	httpRequest(server, "POST", "/groups/web",
+		`{"host": "a", "port": 80, "labels": {"zone": "a"}}`, "")
+	httpRequest(server, "POST", "/groups/web",
+		`{"host": "b", "port": 80, "labels": {"zone": "b"}}`, "")
+
+	w := httpRequest(server, "GET", "/groups/web?selector=zone%3Db", "", "")
+	var snapshot Snapshot
+	if err := json.Unmarshal(w.Body.Bytes(), &snapshot); err != nil ||
+		len(snapshot.Services) != 1 || snapshot.Services[0].Host != "b" {
+		t.Error("Wrong snapshot", w.Body, err)
+	}
+	w = httpRequest(server, "GET", "/groups/web?selector=zone+in+(a", "", "")
+	if w.Code != http.StatusBadRequest {
+		t.Error("Expected a bad request", w.Code)
+	}
+}
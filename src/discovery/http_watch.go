@@ -0,0 +1,218 @@
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long a long-poll waits for a change unless it asks for less, and the
+// longest it may ask for.
+const (
+	httpDefaultWait = 30 * time.Second
+	httpMaxWait     = 5 * time.Minute
+)
+
+// Interval of the comments sent on idle event streams so that proxies keep
+// them open. Variable so tests can shorten it.
+var sseKeepAlive = 15 * time.Second
+
+// Serves GET /groups/<group>: a stream of Server-Sent Events when the client
+// accepts text/event-stream, a long-poll when a revision is given and a
+// snapshot otherwise. Each takes a selector parameter limiting it to the
+// services matching a Selector.
+func (h *httpAPI) get(
+	w http.ResponseWriter, r *http.Request, group string) error {
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		return h.stream(w, r, group)
+	}
+	if value := r.FormValue("revision"); value != "" {
+		revision, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return &httpError{http.StatusBadRequest,
+				errors.New("Invalid revision: " + value)}
+		}
+		return h.poll(w, r, group, revision)
+	}
+	return h.snapshot(w, r, group)
+}
+
+// Stops the watcher started by the HTTP API for group.
+func (h *httpAPI) stopWatch(group string, wr *watcher) {
+	h.server.run(func() error {
+		h.server.ignore(group, wr)
+		return nil
+	})
+	wr.close()
+}
+
+// Returns the name of the Server-Sent Event for a change sent with method.
+func sseEvent(method string) string {
+	if method == "DiscoveryClient.Leave" {
+		return "leave"
+	}
+	return "join"
+}
+
+func writeSSE(w http.ResponseWriter, event string, id uint64,
+	v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\nid: %d\ndata: %s\n\n", event, id, data)
+	w.(http.Flusher).Flush()
+	return err
+}
+
+// Streams the changes to group as Server-Sent Events. The stream starts with a
+// snapshot event holding the Snapshot of the group, followed by a join or
+// leave event holding the ServiceDef of every change. The id of each event is
+// its revision. A client that reconnects with a Last-Event-ID header, or a
+// revision parameter, gets the changes it missed instead of a snapshot when
+// the server still has them.
+func (h *httpAPI) stream(
+	w http.ResponseWriter, r *http.Request, group string) error {
+	principal, err := h.authorize(r, opWatch, group)
+	if err != nil {
+		return err
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		return errors.New("Streaming is not supported")
+	}
+	args := &WatchArgs{Group: group, Selector: r.FormValue("selector")}
+	if _, err = ParseSelector(args.Selector); err != nil {
+		return &httpError{http.StatusBadRequest, err}
+	}
+	last := r.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = r.FormValue("revision")
+	}
+	if last != "" {
+		if args.Revision, err = strconv.ParseUint(last, 10, 64); err != nil {
+			return &httpError{http.StatusBadRequest,
+				errors.New("Invalid revision: " + last)}
+		}
+	}
+
+	events := make(chan *watchEvent)
+	done := make(chan bool)
+	defer close(done)
+	// Closed when events were lost. Ending the stream makes the client
+	// reconnect with the last revision it saw.
+	lost := make(chan bool)
+	wr := newEventWatcher(func(event *watchEvent) error {
+		select {
+		case events <- event:
+			return nil
+		case <-done:
+			return errors.New("Stream closed")
+		}
+	}, func() { close(lost) })
+	defer h.stopWatch(group, wr)
+	var snapshot Snapshot
+	err = h.server.run(func() error {
+		return h.server.startWatch(args, principal, wr, &snapshot)
+	})
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	if !snapshot.Resumed {
+		if err = writeSSE(w, "snapshot", snapshot.Revision, &snapshot); err != nil {
+			return nil
+		}
+	} else {
+		w.(http.Flusher).Flush()
+	}
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-events:
+			err = writeSSE(w, sseEvent(event.method), event.service.Revision,
+				event.service)
+		case <-keepAlive.C:
+			if _, err = fmt.Fprint(w, ": keep-alive\n\n"); err == nil {
+				w.(http.Flusher).Flush()
+			}
+		case <-r.Context().Done():
+			return nil
+		case <-lost:
+			return nil
+		case <-h.server.done:
+			// End the stream so the HTTP server can shut down.
+			return nil
+		}
+		if err != nil {
+			// The client is gone and the response cannot carry an error.
+			return nil
+		}
+	}
+}
+
+// Waits until the selected services of group change after revision, or the
+// wait parameter runs out, and then returns their Snapshot. Returns at once if
+// they changed after revision already or if the server no longer knows.
+func (h *httpAPI) poll(w http.ResponseWriter, r *http.Request, group string,
+	revision uint64) error {
+	sub, err := h.subscribe(r, opWatch, group)
+	if err != nil {
+		return err
+	}
+	wait := httpDefaultWait
+	if value := r.FormValue("wait"); value != "" {
+		if wait, err = time.ParseDuration(value); err != nil || wait < 0 {
+			return &httpError{http.StatusBadRequest,
+				errors.New("Invalid wait: " + value)}
+		}
+		if wait > httpMaxWait {
+			wait = httpMaxWait
+		}
+	}
+
+	changed := make(chan bool, 1)
+	wr := newEventWatcher(func(event *watchEvent) error {
+		select {
+		case changed <- true:
+		default:
+		}
+		return nil
+	}, nil)
+	defer wr.close()
+	s := h.server
+	err = s.run(func() error {
+		changes, ok := s.history.after(group, revision)
+		if revision > s.revision || !ok {
+			changed <- true
+			return nil
+		}
+		for i := range changes {
+			if _, ok = sub.change(&changes[i]); ok {
+				changed <- true
+				return nil
+			}
+		}
+		s.watch(group, wr, sub)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	defer h.stopWatch(group, wr)
+	select {
+	case <-changed:
+	case <-time.After(wait):
+	case <-r.Context().Done():
+		return nil
+	case <-h.server.done:
+		return &httpError{http.StatusServiceUnavailable, ErrServerClosed}
+	}
+	return h.writeSnapshot(w, group, sub, false)
+}
@@ -0,0 +1,177 @@
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sseEventData struct {
+	event, id, data string
+}
+
+// Reads the next event of a Server-Sent Events stream, skipping comments.
+func readSSE(reader *bufio.Reader) (*sseEventData, error) {
+	event := &sseEventData{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "" && event.event != "":
+			return event, nil
+		case strings.HasPrefix(line, "event: "):
+			event.event = line[len("event: "):]
+		case strings.HasPrefix(line, "id: "):
+			event.id = line[len("id: "):]
+		case strings.HasPrefix(line, "data: "):
+			event.data = line[len("data: "):]
+		}
+	}
+}
+
+// Opens the event stream at url, resuming after lastId when it is set.
+func openSSE(t *testing.T, url, lastId string) (*http.Response, *bufio.Reader) {
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	if lastId != "" {
+		req.Header.Set("Last-Event-ID", lastId)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK ||
+		res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatal("Wrong response", res.Status, res.Header)
+	}
+	return res, bufio.NewReader(res.Body)
+}
+
+func TestHTTPEventStream(t *testing.T) {
+	defer func(interval time.Duration) { sseKeepAlive = interval }(sseKeepAlive)
+	sseKeepAlive = 10 * time.Millisecond
+	server := NewServer()
+	go server.processEvents()
+	web := httptest.NewServer(server.HTTPHandler())
+	defer web.Close()
+	client := connectTestClient(server, JSON)
+	defer client.Close()
+	service := &ServiceDef{Host: "h", Port: 80, Group: "g"}
+	if err := client.Join(service); err != nil {
+		t.Fatal(err)
+	}
+
+	res, reader := openSSE(t, web.URL+"/groups/g", "")
+	event, err := readSSE(reader)
+	var snapshot Snapshot
+	if err != nil || event.event != "snapshot" ||
+		json.Unmarshal([]byte(event.data), &snapshot) != nil ||
+		len(snapshot.Services) != 1 ||
+		event.id != strconv.FormatUint(snapshot.Revision, 10) {
+		t.Fatal("Wrong snapshot event", event, err)
+	}
+
+	client.Join(&ServiceDef{Host: "other", Group: "other"})
+	client.Leave(service)
+	event, err = readSSE(reader)
+	var def ServiceDef
+	if err != nil || event.event != "leave" ||
+		json.Unmarshal([]byte(event.data), &def) != nil || def.Host != "h" ||
+		event.id != strconv.FormatUint(def.Revision, 10) {
+		t.Fatal("Wrong leave event", event, err)
+	}
+	res.Body.Close()
+
+	// Reconnecting with the last id replays the missed changes.
+	client.Join(service)
+	res, reader = openSSE(t, web.URL+"/groups/g", event.id)
+	defer res.Body.Close()
+	event, err = readSSE(reader)
+	if err != nil || event.event != "join" ||
+		json.Unmarshal([]byte(event.data), &def) != nil || def.Host != "h" {
+		t.Fatal("Wrong join event", event, err)
+	}
+}
+
+func TestHTTPEventStreamShutdown(t *testing.T) {
+	server := NewServer()
+	// Started as Serve does, so that Shutdown does not start another loop.
+	server.loopOnce.Do(func() { go server.processEvents() })
+	web := httptest.NewServer(server.HTTPHandler())
+	defer web.Close()
+	res, reader := openSSE(t, web.URL+"/groups/g", "")
+	defer res.Body.Close()
+	if event, err := readSSE(reader); err != nil || event.event != "snapshot" {
+		t.Fatal("Wrong snapshot event", event, err)
+	}
+
+	// Streams end when the server shuts down so the HTTP server can too.
+	go server.Shutdown(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := web.Config.Shutdown(ctx); err != nil {
+		t.Error("HTTP server did not shut down", err)
+	}
+	if _, err := readSSE(reader); err == nil {
+		t.Error("Expected the stream to end")
+	}
+}
+
+func TestHTTPLongPoll(t *testing.T) {
+	server := NewServer()
+	go server.processEvents()
+	client := connectTestClient(server, JSON)
+	defer client.Close()
+	snapshot, err := client.SnapshotRevision("g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "/groups/g?revision=" + strconv.FormatUint(snapshot.Revision, 10)
+
+	// Waits until the group changes.
+	result := make(chan *httptest.ResponseRecorder)
+	go func() { result <- httpRequest(server, "GET", url+"&wait=5s", "", "") }()
+	client.Join(&ServiceDef{Host: "h", Group: "other"})
+	select {
+	case w := <-result:
+		t.Fatal("Poll returned before the group changed", w.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+	client.Join(&ServiceDef{Host: "h", Group: "g"})
+	select {
+	case w := <-result:
+		var changed Snapshot
+		if err = json.Unmarshal(w.Body.Bytes(), &changed); err != nil ||
+			len(changed.Services) != 1 || changed.Revision <= snapshot.Revision {
+			t.Error("Wrong snapshot", w.Body, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Poll did not return after a change")
+	}
+
+	// Returns at once for a revision before the change.
+	w := httpRequest(server, "GET", url+"&wait=5s", "", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"h"`) {
+		t.Error("Wrong response", w.Code, w.Body)
+	}
+	// Returns the current members once the wait runs out.
+	snapshot, _ = client.SnapshotRevision("g")
+	w = httpRequest(server, "GET", "/groups/g?wait=10ms&revision="+
+		strconv.FormatUint(snapshot.Revision, 10), "", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"h"`) {
+		t.Error("Wrong response", w.Code, w.Body)
+	}
+	w = httpRequest(server, "GET", "/groups/g?revision=x", "", "")
+	if w.Code != http.StatusBadRequest {
+		t.Error("Expected a bad request", w.Code)
+	}
+}
@@ -0,0 +1,103 @@
+package discovery
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// jsonMux allows a single json-rpc connection to carry requests in both
+// directions. Incoming messages that name a method are requests and are
+// delivered to the request half, everything else is a response to a request
+// sent on this connection and is delivered to the response half.
+type jsonMux struct {
+	rwc       io.ReadWriteCloser
+	writeLock sync.Mutex
+	closeOnce sync.Once
+
+	requestReader  *io.PipeReader
+	requestWriter  *io.PipeWriter
+	responseReader *io.PipeReader
+	responseWriter *io.PipeWriter
+}
+
+// jsonHalf is one direction of a jsonMux. Reads return messages of a single
+// kind while writes and closes go to the shared connection.
+type jsonHalf struct {
+	*io.PipeReader
+	mux *jsonMux
+}
+
+func (h *jsonHalf) Write(p []byte) (int, error) { return h.mux.write(p) }
+func (h *jsonHalf) Close() error                { return h.mux.Close() }
+
+func newJsonMux(rwc io.ReadWriteCloser) *jsonMux {
+	mux := &jsonMux{rwc: rwc}
+	mux.requestReader, mux.requestWriter = io.Pipe()
+	mux.responseReader, mux.responseWriter = io.Pipe()
+	go mux.input()
+	return mux
+}
+
+// Returns the half that reads incoming requests. Use it with
+// jsonrpc.NewServerCodec.
+func (mux *jsonMux) requests() io.ReadWriteCloser {
+	return &jsonHalf{mux.requestReader, mux}
+}
+
+// Returns the half that reads responses to outgoing requests. Use it with
+// jsonrpc.NewClientCodec.
+func (mux *jsonMux) responses() io.ReadWriteCloser {
+	return &jsonHalf{mux.responseReader, mux}
+}
+
+func (mux *jsonMux) input() {
+	decoder := json.NewDecoder(mux.rwc)
+	for {
+		var raw json.RawMessage
+		err := decoder.Decode(&raw)
+		if err != nil {
+			mux.closePipes(err)
+			return
+		}
+
+		var header struct {
+			Method *string `json:"method"`
+		}
+		// Malformed messages are passed on as responses and are reported by the
+		// rpc client.
+		json.Unmarshal(raw, &header)
+		out := mux.responseWriter
+		if header.Method != nil {
+			out = mux.requestWriter
+		}
+		if _, err = out.Write(raw); err != nil {
+			mux.Close()
+			return
+		}
+	}
+}
+
+// Each json-rpc codec writes a complete message with a single call. Serialize
+// the writes so messages from both halves are not interleaved.
+func (mux *jsonMux) write(p []byte) (int, error) {
+	mux.writeLock.Lock()
+	defer mux.writeLock.Unlock()
+	return mux.rwc.Write(p)
+}
+
+func (mux *jsonMux) closePipes(err error) {
+	mux.requestWriter.CloseWithError(err)
+	mux.responseWriter.CloseWithError(err)
+}
+
+func (mux *jsonMux) Close() error {
+	var err error
+	mux.closeOnce.Do(func() {
+		err = mux.rwc.Close()
+		mux.closePipes(io.EOF)
+		mux.requestReader.Close()
+		mux.responseReader.Close()
+	})
+	return err
+}
@@ -4,27 +4,46 @@ import (
 	"code.google.com/p/goprotobuf/proto"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"net/rpc"
 	"reflect"
+	"strings"
+	"sync"
 )
 
+// multiplexCodec implements both rpc.ServerCodec and rpc.ClientCodec over the
+// protocol buffer messages defined in discovery.proto. Each message is
+// prefixed by its length as a big endian int32.
 type multiplexCodec struct {
-	rpc.ServerCodec
-	rpc.ClientCodec
+	// Incoming requests are dispatched to methods of this service.
+	service string
 
 	requestChan  chan *Message
 	responseChan chan *Message
-	errorChan    chan error
 	rwc          io.ReadWriteCloser
+
+	// Closed when the connection fails or the codec is closed. err holds the
+	// reason and must only be read after done is closed.
+	done      chan struct{}
+	err       error
+	closeOnce sync.Once
+
+	// Messages whose header has been read but whose body has not. net/rpc reads
+	// the header and body from the same go routine so no locking is required.
+	request  *Message
+	response *Message
+
+	writeLock sync.Mutex
 }
 
-func newMultiplexCodec(rwc io.ReadWriteCloser) *multiplexCodec {
+func newMultiplexCodec(rwc io.ReadWriteCloser, service string) *multiplexCodec {
 	mux := &multiplexCodec{
+		service: service,
 		// TODO(pscott): Should these be buffered?
 		requestChan:  make(chan *Message),
 		responseChan: make(chan *Message),
-		errorChan:    make(chan error),
+		done:         make(chan struct{}),
 		rwc:          rwc}
 	go mux.input()
 	return mux
@@ -32,14 +51,29 @@ func newMultiplexCodec(rwc io.ReadWriteCloser) *multiplexCodec {
 
 const maxMessageSize = 1024 * 1024 // 1 MB limit
 
+// Larger messages are not written, and the connection is closed on reading
+// one.
+var errMessageTooLarge = errors.New("Max message size exceeded")
+
 // TODO(pscott): Cap the size of the buffer when reused?
 type byteBuffer []byte
 
-func (b byteBuffer) ensureSize(size int) {
+// Returns a buffer of exactly size bytes, reusing the underlying storage when
+// it is large enough.
+func (b byteBuffer) ensureSize(size int) byteBuffer {
 	if b == nil || size > cap(b) {
-		b = make([]byte, size)
+		return make([]byte, size)
 	}
-	b = b[0:0]
+	return b[0:size]
+}
+
+// Shuts down the codec, recording err as the reason. Only the first call has
+// any effect.
+func (mux *multiplexCodec) shutdown(err error) {
+	mux.closeOnce.Do(func() {
+		mux.err = err
+		close(mux.done)
+	})
 }
 
 // input() handles reading both Requests and Responses from the connection.
@@ -53,41 +87,62 @@ func (mux *multiplexCodec) input() {
 		var size int32
 		err := binary.Read(mux.rwc, binary.BigEndian, &size)
 		if err != nil {
-			mux.errorChan <- err
-			continue
+			mux.shutdown(err)
+			return
 		}
 
-		if size > maxMessageSize {
-			mux.errorChan <- errors.New("Max message size exceeded")
-			continue
+		if size < 0 || size > maxMessageSize {
+			mux.shutdown(errMessageTooLarge)
+			return
 		}
 
-		buf.ensureSize(int(size))
+		buf = buf.ensureSize(int(size))
 		_, err = io.ReadFull(mux.rwc, buf)
 		// err will be non-nil if ReadFull fails to read len(buf) bytes
 		if err != nil {
-			mux.errorChan <- err
-			continue
+			mux.shutdown(err)
+			return
 		}
 
 		// Parse the message and send it to the appropriate channel.
 		err = proto.Unmarshal(buf, msg)
-		switch {
-		case err != nil:
-			mux.errorChan <- err
-		case *msg.Type < MessageType___LAST_REQUEST:
-			mux.requestChan <- msg
-		default:
-			mux.responseChan <- msg
+		if err != nil {
+			mux.shutdown(err)
+			return
+		}
+		var out chan *Message = mux.responseChan
+		if *msg.Type < MessageType___LAST_REQUEST {
+			out = mux.requestChan
+		}
+		select {
+		case out <- msg:
+		case <-mux.done:
+			return
 		}
 	}
 }
 
+// Returns the next message from c or an error if the codec has shut down.
+func (mux *multiplexCodec) next(c chan *Message) (*Message, error) {
+	select {
+	case msg := <-c:
+		return msg, nil
+	case <-mux.done:
+		return nil, mux.err
+	}
+}
+
 func (mux *multiplexCodec) writeMessage(msg proto.Message) error {
 	bytes, err := proto.Marshal(msg)
 	if err != nil {
 		return err
 	}
+	if len(bytes) > maxMessageSize {
+		return errMessageTooLarge
+	}
+	// Requests and responses may be written from different go routines.
+	mux.writeLock.Lock()
+	defer mux.writeLock.Unlock()
 	err = binary.Write(mux.rwc, binary.BigEndian, int32(len(bytes)))
 	if err != nil {
 		return err
@@ -96,12 +151,29 @@ func (mux *multiplexCodec) writeMessage(msg proto.Message) error {
 	return err
 }
 
+// Wraps payload in a Message and writes it to the connection.
+func (mux *multiplexCodec) writePayload(
+	seq uint64, payload proto.Message) error {
+	var msg Message
+	var err error
+	msg.Sequence = proto.Uint64(seq)
+	msg.Type = typeMap[typeOf(payload)].Enum()
+	msg.Payload, err = proto.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return mux.writeMessage(&msg)
+}
+
 var typeMap map[string]MessageType
 
 func typeOf(i interface{}) string {
 	return reflect.TypeOf(i).Elem().String()
 }
 
+// Maps request types to the rpc method that handles them.
+var methodMap map[MessageType]string
+
 func init() {
 	typeMap = make(map[string]MessageType)
 	typeMap[typeOf((*JoinRequest)(nil))] = MessageType_JOIN_REQUEST
@@ -109,63 +181,484 @@ func init() {
 	typeMap[typeOf((*SnapshotRequest)(nil))] = MessageType_SNAPSHOT_REQUEST
 	typeMap[typeOf((*WatchRequest)(nil))] = MessageType_WATCH_REQUEST
 	typeMap[typeOf((*IgnoreRequest)(nil))] = MessageType_IGNORE_REQUEST
+	typeMap[typeOf((*HeartbeatRequest)(nil))] = MessageType_HEARTBEAT_REQUEST
+	typeMap[typeOf((*HealthRequest)(nil))] = MessageType_HEALTH_REQUEST
+	typeMap[typeOf((*StateRequest)(nil))] = MessageType_STATE_REQUEST
+	typeMap[typeOf((*AuthenticateRequest)(nil))] =
+		MessageType_AUTHENTICATE_REQUEST
+	typeMap[typeOf((*ListGroupsRequest)(nil))] = MessageType_LIST_GROUPS_REQUEST
 
 	typeMap[typeOf((*ErrorResponse)(nil))] = MessageType_ERROR_RESPONSE
 	typeMap[typeOf((*SnapshotResponse)(nil))] = MessageType_SNAPSHOT_RESPONSE
+	typeMap[typeOf((*EmptyResponse)(nil))] = MessageType_EMPTY_RESPONSE
+	typeMap[typeOf((*GroupsResponse)(nil))] = MessageType_GROUPS_RESPONSE
+
+	methodMap = make(map[MessageType]string)
+	methodMap[MessageType_JOIN_REQUEST] = "Join"
+	methodMap[MessageType_LEAVE_REQUEST] = "Leave"
+	methodMap[MessageType_SNAPSHOT_REQUEST] = "SnapshotGroup"
+	methodMap[MessageType_WATCH_REQUEST] = "WatchGroup"
+	methodMap[MessageType_IGNORE_REQUEST] = "Ignore"
+	methodMap[MessageType_HEARTBEAT_REQUEST] = "Heartbeat"
+	methodMap[MessageType_AUTHENTICATE_REQUEST] = "Authenticate"
+	methodMap[MessageType_HEALTH_REQUEST] = "SetHealth"
+	methodMap[MessageType_STATE_REQUEST] = "SetState"
+	methodMap[MessageType_LIST_GROUPS_REQUEST] = "ListGroups"
+}
+
+// Converts a ServiceDef to its protocol buffer representation.
+func (def *ServiceDef) toProto() *ServiceDefinition {
+	pb := &ServiceDefinition{
+		Host:       proto.String(def.Host),
+		Port:       proto.Int32(int32(def.Port)),
+		CustomData: def.CustomData,
+		Group:      proto.String(def.Group)}
+	if def.TTL > 0 {
+		pb.Ttl = proto.Uint32(def.TTL)
+	}
+	if def.Persistent {
+		pb.Persistent = proto.Bool(true)
+	}
+	if def.Revision > 0 {
+		pb.Revision = proto.Uint64(def.Revision)
+	}
+	if def.Check != nil {
+		pb.Check = &HealthCheckDefinition{
+			Type:   proto.String(def.Check.Type),
+			Script: def.Check.Script}
+		if def.Check.Interval > 0 {
+			pb.Check.Interval = proto.Uint32(def.Check.Interval)
+		}
+		if def.Check.Timeout > 0 {
+			pb.Check.Timeout = proto.Uint32(def.Check.Timeout)
+		}
+		if def.Check.Path != "" {
+			pb.Check.Path = proto.String(def.Check.Path)
+		}
+	}
+	if def.Unhealthy {
+		pb.Unhealthy = proto.Bool(true)
+	}
+	for _, key := range def.labelKeys() {
+		pb.Labels = append(pb.Labels, &Label{
+			Key: proto.String(key), Value: proto.String(def.Labels[key])})
+	}
+	pb.Tags = def.Tags
+	if def.State != "" {
+		pb.State = proto.String(def.State)
+	}
+	return pb
+}
+
+// Converts a protocol buffer ServiceDefinition into a ServiceDef within group.
+func newServiceDef(group string, pb *ServiceDefinition) *ServiceDef {
+	def := &ServiceDef{
+		Host:       pb.GetHost(),
+		Port:       uint16(pb.GetPort()),
+		Group:      group,
+		CustomData: pb.GetCustomData(),
+		TTL:        pb.GetTtl(),
+		Persistent: pb.GetPersistent(),
+		Revision:   pb.GetRevision(),
+		Unhealthy:  pb.GetUnhealthy(),
+		Tags:       pb.GetTags(),
+		State:      pb.GetState()}
+	if labels := pb.GetLabels(); len(labels) > 0 {
+		def.Labels = make(map[string]string, len(labels))
+		for _, label := range labels {
+			def.Labels[label.GetKey()] = label.GetValue()
+		}
+	}
+	if check := pb.GetCheck(); check != nil {
+		def.Check = &HealthCheck{
+			Type:     check.GetType(),
+			Interval: check.GetInterval(),
+			Timeout:  check.GetTimeout(),
+			Path:     check.GetPath(),
+			Script:   check.GetScript()}
+	}
+	return def
+}
+
+// Returns the string argument of a request, e.g. a group. net/rpc passes
+// arguments by value or by pointer depending on the caller.
+func stringArg(i interface{}) (string, error) {
+	switch arg := i.(type) {
+	case string:
+		return arg, nil
+	case *string:
+		return *arg, nil
+	}
+	return "", fmt.Errorf("Invalid string argument: %T", i)
+}
+
+// Returns the service definition argument of a request.
+func serviceArg(i interface{}) (*ServiceDef, error) {
+	switch arg := i.(type) {
+	case ServiceDef:
+		return &arg, nil
+	case *ServiceDef:
+		return arg, nil
+	}
+	return nil, fmt.Errorf("Invalid service argument: %T", i)
+}
+
+// Returns the argument of a snapshot request.
+func snapshotArg(i interface{}) (*SnapshotArgs, error) {
+	switch arg := i.(type) {
+	case SnapshotArgs:
+		return &arg, nil
+	case *SnapshotArgs:
+		return arg, nil
+	}
+	return nil, fmt.Errorf("Invalid snapshot argument: %T", i)
+}
+
+// Returns the argument of a watch request.
+func watchArg(i interface{}) (*WatchArgs, error) {
+	switch arg := i.(type) {
+	case WatchArgs:
+		return &arg, nil
+	case *WatchArgs:
+		return arg, nil
+	}
+	return nil, fmt.Errorf("Invalid watch argument: %T", i)
+}
+
+// Creates the protocol buffer request for the rpc method using the argument i.
+func encodeRequest(method string, i interface{}) (proto.Message, error) {
+	switch method {
+	case "Join", "Leave", "Heartbeat", "SetHealth", "SetState":
+		def, err := serviceArg(i)
+		if err != nil {
+			return nil, err
+		}
+		switch method {
+		case "Join":
+			return &JoinRequest{
+				Group: proto.String(def.Group), Service: def.toProto()}, nil
+		case "Leave":
+			return &LeaveRequest{
+				Group: proto.String(def.Group), Service: def.toProto()}, nil
+		case "SetHealth":
+			return &HealthRequest{
+				Group: proto.String(def.Group), Service: def.toProto()}, nil
+		case "SetState":
+			return &StateRequest{
+				Group: proto.String(def.Group), Service: def.toProto()}, nil
+		}
+		return &HeartbeatRequest{
+			Group: proto.String(def.Group), Service: def.toProto()}, nil
+	case "WatchGroup":
+		args, err := watchArg(i)
+		if err != nil {
+			return nil, err
+		}
+		req := &WatchRequest{Group: proto.String(args.Group)}
+		if args.Revision > 0 {
+			req.Revision = proto.Uint64(args.Revision)
+		}
+		if args.Selector != "" {
+			req.Selector = proto.String(args.Selector)
+		}
+		return req, nil
+	case "SnapshotGroup":
+		args, err := snapshotArg(i)
+		if err != nil {
+			return nil, err
+		}
+		req := &SnapshotRequest{Group: proto.String(args.Group)}
+		if args.Selector != "" {
+			req.Selector = proto.String(args.Selector)
+		}
+		return req, nil
+	case "Authenticate":
+		token, err := stringArg(i)
+		if err != nil {
+			return nil, err
+		}
+		return &AuthenticateRequest{Token: proto.String(token)}, nil
+	case "ListGroups":
+		args, ok := i.(*ListGroupsArgs)
+		if !ok {
+			return nil, fmt.Errorf("Invalid list groups argument: %T", i)
+		}
+		req := &ListGroupsRequest{}
+		if args.Prefix != "" {
+			req.Prefix = proto.String(args.Prefix)
+		}
+		return req, nil
+	case "Ignore":
+		group, err := stringArg(i)
+		if err != nil {
+			return nil, err
+		}
+		return &IgnoreRequest{Group: proto.String(group)}, nil
+	}
+	return nil, errors.New("Unsupported method: " + method)
+}
+
+// Stores a decoded service definition in the rpc argument i.
+func setServiceArg(i interface{}, def *ServiceDef) error {
+	arg, ok := i.(*ServiceDef)
+	if !ok {
+		return fmt.Errorf("Invalid service argument: %T", i)
+	}
+	*arg = *def
+	return nil
+}
+
+// Stores a decoded string, e.g. a group, in the rpc argument i.
+func setStringArg(i interface{}, value string) error {
+	arg, ok := i.(*string)
+	if !ok {
+		return fmt.Errorf("Invalid string argument: %T", i)
+	}
+	*arg = value
+	return nil
+}
+
+// Decodes the payload of a request message into the rpc argument i.
+func decodeRequest(msg *Message, i interface{}) error {
+	switch msg.GetType() {
+	case MessageType_JOIN_REQUEST:
+		var req JoinRequest
+		if err := proto.Unmarshal(msg.Payload, &req); err != nil {
+			return err
+		}
+		return setServiceArg(i, newServiceDef(req.GetGroup(), req.Service))
+	case MessageType_LEAVE_REQUEST:
+		var req LeaveRequest
+		if err := proto.Unmarshal(msg.Payload, &req); err != nil {
+			return err
+		}
+		return setServiceArg(i, newServiceDef(req.GetGroup(), req.Service))
+	case MessageType_HEARTBEAT_REQUEST:
+		var req HeartbeatRequest
+		if err := proto.Unmarshal(msg.Payload, &req); err != nil {
+			return err
+		}
+		return setServiceArg(i, newServiceDef(req.GetGroup(), req.Service))
+	case MessageType_HEALTH_REQUEST:
+		var req HealthRequest
+		if err := proto.Unmarshal(msg.Payload, &req); err != nil {
+			return err
+		}
+		return setServiceArg(i, newServiceDef(req.GetGroup(), req.Service))
+	case MessageType_STATE_REQUEST:
+		var req StateRequest
+		if err := proto.Unmarshal(msg.Payload, &req); err != nil {
+			return err
+		}
+		return setServiceArg(i, newServiceDef(req.GetGroup(), req.Service))
+	case MessageType_SNAPSHOT_REQUEST:
+		var req SnapshotRequest
+		if err := proto.Unmarshal(msg.Payload, &req); err != nil {
+			return err
+		}
+		arg, ok := i.(*SnapshotArgs)
+		if !ok {
+			return fmt.Errorf("Invalid snapshot argument: %T", i)
+		}
+		*arg = SnapshotArgs{req.GetGroup(), req.GetSelector()}
+		return nil
+	case MessageType_WATCH_REQUEST:
+		var req WatchRequest
+		if err := proto.Unmarshal(msg.Payload, &req); err != nil {
+			return err
+		}
+		arg, ok := i.(*WatchArgs)
+		if !ok {
+			return fmt.Errorf("Invalid watch argument: %T", i)
+		}
+		*arg = WatchArgs{
+			req.GetGroup(), req.GetRevision(), req.GetSelector()}
+		return nil
+	case MessageType_IGNORE_REQUEST:
+		var req IgnoreRequest
+		if err := proto.Unmarshal(msg.Payload, &req); err != nil {
+			return err
+		}
+		return setStringArg(i, req.GetGroup())
+	case MessageType_LIST_GROUPS_REQUEST:
+		var req ListGroupsRequest
+		if err := proto.Unmarshal(msg.Payload, &req); err != nil {
+			return err
+		}
+		arg, ok := i.(*ListGroupsArgs)
+		if !ok {
+			return fmt.Errorf("Invalid list groups argument: %T", i)
+		}
+		*arg = ListGroupsArgs{req.GetPrefix()}
+		return nil
+	case MessageType_AUTHENTICATE_REQUEST:
+		var req AuthenticateRequest
+		if err := proto.Unmarshal(msg.Payload, &req); err != nil {
+			return err
+		}
+		return setStringArg(i, req.GetToken())
+	}
+	return errors.New("Unsupported request: " + msg.GetType().String())
+}
+
+// Creates the protocol buffer response for the rpc reply i.
+func encodeResponse(i interface{}) (proto.Message, error) {
+	switch reply := i.(type) {
+	case *Void:
+		return &EmptyResponse{}, nil
+	case *Snapshot:
+		res := &SnapshotResponse{
+			Services: make([]*ServiceDefinition, len(reply.Services)),
+			Revision: proto.Uint64(reply.Revision)}
+		for i, def := range reply.Services {
+			res.Services[i] = def.toProto()
+		}
+		if reply.Resumed {
+			res.Resumed = proto.Bool(true)
+		}
+		return res, nil
+	case *GroupList:
+		res := &GroupsResponse{
+			Groups:   make([]*GroupDescription, len(reply.Groups)),
+			Revision: proto.Uint64(reply.Revision)}
+		for i, group := range reply.Groups {
+			res.Groups[i] = &GroupDescription{
+				Name:      proto.String(group.Name),
+				Services:  proto.Uint32(uint32(group.Services)),
+				Unhealthy: proto.Uint32(uint32(group.Unhealthy)),
+				Revision:  proto.Uint64(group.Revision)}
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("Unsupported response: %T", i)
+}
+
+// Decodes the payload of a response message into the rpc reply i.
+func decodeResponse(msg *Message, i interface{}) error {
+	switch msg.GetType() {
+	case MessageType_EMPTY_RESPONSE:
+		return nil
+	case MessageType_SNAPSHOT_RESPONSE:
+		var res SnapshotResponse
+		if err := proto.Unmarshal(msg.Payload, &res); err != nil {
+			return err
+		}
+		reply, ok := i.(*Snapshot)
+		if !ok {
+			return fmt.Errorf("Invalid snapshot reply: %T", i)
+		}
+		*reply = Snapshot{
+			Revision: res.GetRevision(),
+			Services: make([]*ServiceDef, len(res.Services)),
+			Resumed:  res.GetResumed()}
+		for i, def := range res.Services {
+			reply.Services[i] = newServiceDef(def.GetGroup(), def)
+		}
+		return nil
+	case MessageType_GROUPS_RESPONSE:
+		var res GroupsResponse
+		if err := proto.Unmarshal(msg.Payload, &res); err != nil {
+			return err
+		}
+		reply, ok := i.(*GroupList)
+		if !ok {
+			return fmt.Errorf("Invalid groups reply: %T", i)
+		}
+		*reply = GroupList{
+			Revision: res.GetRevision(),
+			Groups:   make([]*GroupInfo, len(res.Groups))}
+		for i, group := range res.Groups {
+			reply.Groups[i] = &GroupInfo{
+				Name:      group.GetName(),
+				Services:  int(group.GetServices()),
+				Unhealthy: int(group.GetUnhealthy()),
+				Revision:  group.GetRevision()}
+		}
+		return nil
+	}
+	return errors.New("Unsupported response: " + msg.GetType().String())
 }
 
 func (mux *multiplexCodec) WriteRequest(req *rpc.Request, i interface{}) error {
-	var msg Message
-	var err error
-	msg.Sequence = proto.Uint64(req.Seq)
-	msg.Type = typeMap[typeOf(i)].Enum()
-	msg.Payload, err = proto.Marshal(i.(proto.Message))
+	method := req.ServiceMethod[strings.LastIndex(req.ServiceMethod, ".")+1:]
+	payload, err := encodeRequest(method, i)
 	if err != nil {
 		return err
 	}
-	return mux.writeMessage(&msg)
+	return mux.writePayload(req.Seq, payload)
 }
 
-const requestMethod = "Discovery.Request"
-const responseMethod = "Discovery.Response"
-
 func (mux *multiplexCodec) ReadResponseHeader(res *rpc.Response) error {
-	select {
-	case err := <-mux.errorChan:
+	msg, err := mux.next(mux.responseChan)
+	if err != nil {
 		return err
-	case msg := <-mux.responseChan:
-		res.ServiceMethod = responseMethod
-		res.Seq = *msg.Sequence
+	}
+	res.Seq = msg.GetSequence()
+	mux.response = msg
+	if msg.GetType() == MessageType_ERROR_RESPONSE {
+		var errRes ErrorResponse
+		if err = proto.Unmarshal(msg.Payload, &errRes); err != nil {
+			return err
+		}
+		res.Error = errRes.GetDescription()
 	}
 	return nil
 }
 
-func (m *multiplexCodec) ReadResponseBody(i interface{}) error {
-	proto.Unmarshal(nil, &Message{})
-	return nil
+func (mux *multiplexCodec) ReadResponseBody(i interface{}) error {
+	msg := mux.response
+	mux.response = nil
+	if i == nil || msg == nil {
+		return nil
+	}
+	return decodeResponse(msg, i)
 }
 
-func (m *multiplexCodec) Close() error {
-	return m.rwc.Close()
+func (mux *multiplexCodec) Close() error {
+	err := mux.rwc.Close()
+	mux.shutdown(io.EOF)
+	return err
 }
 
-func (m *multiplexCodec) ReadRequestHeader(req *rpc.Request) error {
+func (mux *multiplexCodec) ReadRequestHeader(req *rpc.Request) error {
+	msg, err := mux.next(mux.requestChan)
+	if err != nil {
+		return err
+	}
+	req.Seq = msg.GetSequence()
+	method, ok := methodMap[msg.GetType()]
+	if !ok {
+		// Let the rpc server report the unknown method to the caller.
+		method = msg.GetType().String()
+	}
+	req.ServiceMethod = mux.service + "." + method
+	mux.request = msg
 	return nil
 }
 
-func (m *multiplexCodec) ReadRequestBody(i interface{}) error {
-	return nil
+func (mux *multiplexCodec) ReadRequestBody(i interface{}) error {
+	msg := mux.request
+	mux.request = nil
+	if i == nil || msg == nil {
+		return nil
+	}
+	return decodeRequest(msg, i)
 }
 
 func (mux *multiplexCodec) WriteResponse(
 	res *rpc.Response, i interface{}) error {
-	var msg Message
-	var err error
-	msg.Sequence = proto.Uint64(res.Seq)
-	msg.Type = typeMap[typeOf(i)].Enum()
-	msg.Payload, err = proto.Marshal(i.(proto.Message))
-	if err != nil {
-		return err
+	if res.Error != "" {
+		return mux.writePayload(res.Seq,
+			&ErrorResponse{Description: proto.String(res.Error)})
 	}
-	return mux.writeMessage(&msg)
+	payload, err := encodeResponse(i)
+	if err == nil {
+		err = mux.writePayload(res.Seq, payload)
+		if err != errMessageTooLarge {
+			return err
+		}
+	}
+	// Still send a response so the caller does not wait forever.
+	return mux.writePayload(res.Seq,
+		&ErrorResponse{Description: proto.String(err.Error())})
 }
@@ -0,0 +1,166 @@
+package discovery
+
+import (
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// Connects a client using protocol to a new connection on server.
+func connectTestClient(server *Server, protocol Protocol) *Client {
+	read, write := net.Pipe()
+	go server.handleConnection(read)
+	client := &Client{Protocol: protocol}
+	client.attach(write)
+	return client
+}
+
+func TestByteBufferEnsureSize(t *testing.T) {
+	var buf byteBuffer
+	buf = buf.ensureSize(10)
+	if len(buf) != 10 {
+		t.Error("Wrong buffer size", len(buf))
+	}
+	buf[0] = 42
+	buf = buf.ensureSize(5)
+	if len(buf) != 5 || buf[0] != 42 {
+		t.Error("Buffer was not reused")
+	}
+}
+
+func TestMultiplexJoinSnapshot(t *testing.T) {
+	server := NewServer()
+	go server.processEvents()
+	client := connectTestClient(server, Protobuf)
+	defer client.Close()
+
+	custom := []byte{1, 2, 3}
+	err := client.Join(&ServiceDef{
+		Host: "host", Port: 80, Group: "group", CustomData: custom})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Join(
+		&ServiceDef{Host: "host2", Port: 81, Group: "group", TTL: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Heartbeat(&ServiceDef{Host: "host2", Port: 81, Group: "group"})
+	if err != nil {
+		t.Error(err)
+	}
+
+	snapshot, err := client.Snapshot("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot) != 2 {
+		t.Fatal("Wrong snapshot size", len(snapshot))
+	}
+	def := snapshot[0]
+	if def.Host != "host" || def.Port != 80 || def.Group != "group" ||
+		!bytes.Equal(def.CustomData, custom) {
+		t.Error("Wrong definition", def)
+	}
+	if def = snapshot[1]; def.TTL != 30 {
+		t.Error("Wrong TTL", def)
+	}
+
+	if err = client.Leave(&ServiceDef{Host: "host", Port: 80,
+		Group: "group"}); err != nil {
+		t.Error(err)
+	}
+	snapshot, err = client.Snapshot("group")
+	if err != nil || len(snapshot) != 1 || snapshot[0].Host != "host2" {
+		t.Error("Leave failed", snapshot, err)
+	}
+}
+
+func TestMultiplexError(t *testing.T) {
+	server := NewServer()
+	go server.processEvents()
+	client := connectTestClient(server, Protobuf)
+	defer client.Close()
+	other := connectTestClient(server, JSON)
+	defer other.Close()
+
+	if err := other.Join(&ServiceDef{Host: "host", Group: "g"}); err != nil {
+		t.Fatal(err)
+	}
+	err := client.Join(&ServiceDef{Host: "host", Group: "g"})
+	if err == nil || err.Error() != "Unable to add service" {
+		t.Error("Expected error response", err)
+	}
+	// The connection is still usable after an error.
+	if _, err = client.Snapshot("g"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMultiplexMessageTooLarge(t *testing.T) {
+	server := NewServer()
+	go server.processEvents()
+	client := connectTestClient(server, Protobuf)
+	defer client.Close()
+
+	err := client.Join(&ServiceDef{Host: "a", Group: "g",
+		CustomData: make([]byte, maxMessageSize)})
+	if err != errMessageTooLarge {
+		t.Error("Expected the request to be refused", err)
+	}
+	data := make([]byte, maxMessageSize/2)
+	for _, host := range []string{"a", "b"} {
+		err = client.Join(&ServiceDef{Host: host, Group: "g", CustomData: data})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = client.Snapshot("g")
+	if err == nil || err.Error() != errMessageTooLarge.Error() {
+		t.Error("Expected an error response", err)
+	}
+	// The connection is still usable.
+	if err = client.Leave(&ServiceDef{Host: "a", Group: "g"}); err != nil {
+		t.Error(err)
+	}
+	if snapshot, err := client.Snapshot("g"); err != nil || len(snapshot) != 1 {
+		t.Error("Wrong snapshot", snapshot, err)
+	}
+}
+
+func TestMultiplexUnknownRequest(t *testing.T) {
+	server := NewServer()
+	go server.processEvents()
+	read, write := net.Pipe()
+	go server.handleConnection(read)
+	defer write.Close()
+
+	// Hand craft a request with an unknown type.
+	payload, _ := proto.Marshal(&Message{
+		Sequence: proto.Uint64(7),
+		Type:     MessageType(42).Enum(),
+		Payload:  []byte{}})
+	go func() {
+		binary.Write(write, binary.BigEndian, int32(len(payload)))
+		write.Write(payload)
+	}()
+
+	var size int32
+	if err := binary.Read(write, binary.BigEndian, &size); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(write, buf); err != nil {
+		t.Fatal(err)
+	}
+	var msg Message
+	if err := proto.Unmarshal(buf, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.GetSequence() != 7 || msg.GetType() != MessageType_ERROR_RESPONSE {
+		t.Error("Expected an error response", msg.String())
+	}
+}
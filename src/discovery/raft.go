@@ -0,0 +1,1028 @@
+package discovery
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"sync"
+	"time"
+)
+
+// Timing of the raft protocol. Variables so tests can speed things up.
+var (
+	// How often the leader contacts each follower.
+	raftHeartbeat = 50 * time.Millisecond
+	// A follower that does not hear from a leader within [timeout, 2*timeout)
+	// starts an election.
+	raftElectionTimeout = 300 * time.Millisecond
+	// Maximum time to wait for a peer to respond to a request.
+	raftRpcTimeout = 250 * time.Millisecond
+	// Maximum time to wait for a peer to install a snapshot, which may hold
+	// the whole registry.
+	raftSnapshotTimeout = 10 * time.Second
+	// Maximum number of entries sent in one AppendEntries request. A peer
+	// further behind is sent the rest in the following requests.
+	raftMaxAppendEntries = 1000
+	// Number of applied entries after which the log is compacted.
+	raftCompactEntries uint64 = 10000
+)
+
+type raftState int
+
+const (
+	follower raftState = iota
+	candidate
+	leader
+)
+
+type raftEntry struct {
+	Index   uint64   `json:"index"`
+	Term    uint64   `json:"term"`
+	Command *command `json:"command"`
+}
+
+// A proposal waiting for its entry to be applied on the leader.
+type proposal struct {
+	term uint64
+	done chan error
+}
+
+// raftNode replicates commands to the members of a cluster using the Raft
+// consensus algorithm. Committed entries are passed to apply, in log order, on
+// every member. The member calls applied once the entry has taken effect.
+//
+// Once enough entries are applied, the member replaces them with a snapshot of
+// the registry, see compact. Members too far behind the leader are sent its
+// snapshot, which is passed to restore, and continue from there.
+//
+// With a store, the term, vote, snapshot and log survive restarts. Otherwise
+// they are only kept in memory and a member that restarts rejoins with an
+// empty log and receives the snapshot and log from the leader.
+type raftNode struct {
+	self  int
+	peers []string
+	apply func(entry *raftEntry)
+	// Called instead of apply for the entries replaced by a snapshot. entry is
+	// the last of them.
+	restore func(entry *raftEntry, snapshot json.RawMessage)
+	// Called on the leader when a peer has not responded for too long.
+	peerDown    func(peer int)
+	peerTimeout time.Duration
+	listener    net.Listener
+	// When set, members talk over mutual TLS. Its certificate is presented to
+	// the other members and ClientCAs verifies theirs, which must be valid for
+	// the host of a member in peers.
+	tlsConfig *tls.Config
+	// Connections accepted from other members.
+	conns map[net.Conn]bool
+	// Keeps the state of the member on disk. nil if it is only in memory.
+	store *raftStore
+
+	lock     sync.Mutex
+	state    raftState
+	term     uint64
+	votedFor int
+	leader   int
+	// log[0] is the last entry replaced by the snapshot, without its command.
+	log []*raftEntry
+	// State after applying the entries up to log[0]. nil until the log is
+	// first compacted.
+	snapshot    json.RawMessage
+	commitIndex uint64
+	// Index of the last entry passed to apply.
+	lastApplied uint64
+	// Index of the last entry that took effect on this member.
+	appliedIndex uint64
+	electionTime time.Time
+	clients      []*rpc.Client
+
+	// Leader state.
+	nextIndex   []uint64
+	matchIndex  []uint64
+	lastContact []time.Time
+	down        []bool
+	replicate   []chan bool
+	proposals   map[uint64]*proposal
+
+	// Signaled when commitIndex or appliedIndex change.
+	changed *sync.Cond
+	stopped bool
+}
+
+func newRaftNode(listener net.Listener, peers []string, self int,
+	apply func(*raftEntry)) *raftNode {
+	r := &raftNode{
+		self:     self,
+		peers:    peers,
+		apply:    apply,
+		listener: listener,
+		votedFor: -1,
+		leader:   -1,
+		// log[0] stands for an empty snapshot so that indexes start at 1.
+		log:       []*raftEntry{&raftEntry{}},
+		conns:     make(map[net.Conn]bool),
+		clients:   make([]*rpc.Client, len(peers)),
+		proposals: make(map[uint64]*proposal)}
+	r.changed = sync.NewCond(&r.lock)
+	r.resetElectionTime()
+	return r
+}
+
+func (r *raftNode) start() {
+	server := rpc.NewServer()
+	server.RegisterName("Raft", &raftService{r})
+	go func() {
+		for {
+			conn, err := r.listener.Accept()
+			if err != nil {
+				return
+			}
+			r.lock.Lock()
+			if r.stopped {
+				r.lock.Unlock()
+				conn.Close()
+				return
+			}
+			r.conns[conn] = true
+			r.lock.Unlock()
+			go func() {
+				if err := r.serve(server, conn); err != nil {
+					log.Println("Refused cluster connection from",
+						conn.RemoteAddr(), err)
+				}
+				r.lock.Lock()
+				delete(r.conns, conn)
+				r.lock.Unlock()
+			}()
+		}
+	}()
+	go r.run()
+	go r.applyEntries()
+}
+
+func (r *raftNode) stop() {
+	r.lock.Lock()
+	r.stopped = true
+	r.state = follower
+	for _, client := range r.clients {
+		if client != nil {
+			client.Close()
+		}
+	}
+	for conn := range r.conns {
+		conn.Close()
+	}
+	r.changed.Broadcast()
+	if r.store != nil {
+		r.store.close()
+	}
+	r.lock.Unlock()
+	r.listener.Close()
+}
+
+func (r *raftNode) majority() int {
+	return len(r.peers)/2 + 1
+}
+
+// Returns the entry at index, which must be in the log. Must hold r.lock.
+func (r *raftNode) entry(index uint64) *raftEntry {
+	return r.log[index-r.log[0].Index]
+}
+
+func (r *raftNode) lastIndex() uint64 {
+	return r.log[len(r.log)-1].Index
+}
+
+func (r *raftNode) lastTerm() uint64 {
+	return r.log[len(r.log)-1].Term
+}
+
+// Writes the term and vote to the store, if any. Must hold r.lock.
+func (r *raftNode) saveVote() error {
+	if r.store == nil {
+		return nil
+	}
+	return r.store.saveVote(r.term, r.votedFor)
+}
+
+// Writes entries to the store, if any. Must hold r.lock.
+func (r *raftNode) saveEntries(entries []*raftEntry) error {
+	if r.store == nil {
+		return nil
+	}
+	return r.store.saveEntries(entries)
+}
+
+func (r *raftNode) resetElectionTime() {
+	timeout := raftElectionTimeout +
+		time.Duration(rand.Int63n(int64(raftElectionTimeout)))
+	r.electionTime = time.Now().Add(timeout)
+}
+
+func (r *raftNode) isStopped() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.stopped
+}
+
+// Returns true if this member is the leader.
+func (r *raftNode) isLeader() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.state == leader
+}
+
+// Returns the index of the current leader or -1 if unknown.
+func (r *raftNode) currentLeader() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.leader
+}
+
+// Starts elections when the leader goes quiet and, on the leader, watches for
+// peers that stopped responding.
+func (r *raftNode) run() {
+	ticker := time.NewTicker(raftHeartbeat / 5)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		r.lock.Lock()
+		if r.stopped {
+			r.lock.Unlock()
+			return
+		}
+		if r.state == leader {
+			r.checkPeers(now)
+		} else if now.After(r.electionTime) {
+			r.startElection()
+		}
+		r.lock.Unlock()
+	}
+}
+
+// Must hold r.lock.
+func (r *raftNode) checkPeers(now time.Time) {
+	if r.peerDown == nil {
+		return
+	}
+	for peer := range r.peers {
+		if peer == r.self || r.down[peer] {
+			continue
+		}
+		if now.Sub(r.lastContact[peer]) > r.peerTimeout {
+			log.Println("Cluster member not responding:", r.peers[peer])
+			r.down[peer] = true
+			go r.peerDown(peer)
+		}
+	}
+}
+
+// Serves the requests of another member on conn until it closes. Over TLS,
+// returns an error at once unless the certificate of the member is valid for
+// the host of a member in peers.
+func (r *raftNode) serve(server *rpc.Server, conn net.Conn) error {
+	if r.tlsConfig != nil {
+		tlsConn := tls.Server(conn, r.tlsConfig)
+		cert, err := peerCertificate(tlsConn)
+		if err == nil && (cert == nil || !r.isPeer(cert)) {
+			err = errors.New("Certificate does not name a cluster member")
+		}
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tlsConn
+	}
+	server.ServeCodec(jsonrpc.NewServerCodec(conn))
+	return nil
+}
+
+func (r *raftNode) isPeer(cert *x509.Certificate) bool {
+	for _, peer := range r.peers {
+		host, _, err := net.SplitHostPort(peer)
+		if err == nil && cert.VerifyHostname(host) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Connects to peer, over TLS when the cluster uses it. The certificate of the
+// peer must be valid for its host.
+func (r *raftNode) dial(peer int) (net.Conn, error) {
+	address := r.peers[peer]
+	dialer := &net.Dialer{Timeout: raftRpcTimeout}
+	if r.tlsConfig == nil {
+		return dialer.Dial("tcp", address)
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: r.tlsConfig.Certificates,
+		RootCAs:      r.tlsConfig.ClientCAs,
+		ServerName:   host}
+	return tls.DialWithDialer(dialer, "tcp", address, config)
+}
+
+// Returns the rpc client for peer, connecting if necessary.
+func (r *raftNode) client(peer int) *rpc.Client {
+	r.lock.Lock()
+	client := r.clients[peer]
+	stopped := r.stopped
+	r.lock.Unlock()
+	if client != nil || stopped {
+		return client
+	}
+
+	// Do not hold the lock while connecting, the peer may be down.
+	conn, err := r.dial(peer)
+	if err != nil {
+		return nil
+	}
+	client = jsonrpc.NewClient(conn)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stopped || r.clients[peer] != nil {
+		// Lost the race with another caller or the member stopped.
+		client.Close()
+		return r.clients[peer]
+	}
+	r.clients[peer] = client
+	return client
+}
+
+// Calls method on peer waiting at most timeout for the reply.
+func (r *raftNode) call(peer int, method string, args interface{},
+	reply interface{}, timeout time.Duration) error {
+	client := r.client(peer)
+	if client == nil {
+		return errors.New("Unable to connect to " + r.peers[peer])
+	}
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if _, ok := call.Error.(rpc.ServerError); call.Error != nil && !ok {
+			// The connection is broken, reconnect on the next call.
+			r.lock.Lock()
+			if r.clients[peer] == client {
+				r.clients[peer] = nil
+			}
+			r.lock.Unlock()
+			client.Close()
+		}
+		return call.Error
+	case <-time.After(timeout):
+		return errors.New("Timeout calling " + r.peers[peer])
+	}
+}
+
+// The requests and replies sent between members are only exported because
+// net/rpc requires it.
+type RaftVoteArgs struct {
+	Term         uint64 `json:"term"`
+	Candidate    int    `json:"candidate"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	LastLogTerm  uint64 `json:"last_log_term"`
+}
+
+type RaftVoteReply struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type RaftAppendArgs struct {
+	Term         uint64       `json:"term"`
+	Leader       int          `json:"leader"`
+	PrevLogIndex uint64       `json:"prev_log_index"`
+	PrevLogTerm  uint64       `json:"prev_log_term"`
+	Entries      []*raftEntry `json:"entries"`
+	LeaderCommit uint64       `json:"leader_commit"`
+}
+
+type RaftAppendReply struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	// On failure, the index the leader should try next.
+	NextIndex uint64 `json:"next_index"`
+}
+
+// Steps down if term is newer than the current term. Must hold r.lock.
+func (r *raftNode) observeTerm(term uint64) {
+	if term > r.term {
+		r.term = term
+		r.votedFor = -1
+		r.leader = -1
+		if r.state != follower {
+			r.becomeFollower()
+		}
+	}
+}
+
+// Must hold r.lock.
+func (r *raftNode) becomeFollower() {
+	r.state = follower
+	// Stop the replication go routines of the previous term.
+	for _, c := range r.replicate {
+		if c != nil {
+			close(c)
+		}
+	}
+	r.replicate = nil
+	r.resetElectionTime()
+}
+
+// Must hold r.lock.
+func (r *raftNode) startElection() {
+	r.state = candidate
+	r.term++
+	r.votedFor = r.self
+	r.leader = -1
+	r.resetElectionTime()
+	// The vote for itself must not be forgotten before asking for others.
+	if err := r.saveVote(); err != nil {
+		log.Println("Error saving raft state:", err)
+		return
+	}
+	args := &RaftVoteArgs{r.term, r.self, r.lastIndex(), r.lastTerm()}
+	log.Printf("Starting election for term %d\n", r.term)
+
+	votes := 1
+	if votes >= r.majority() {
+		r.becomeLeader()
+		return
+	}
+	for peer := range r.peers {
+		if peer == r.self {
+			continue
+		}
+		go func(peer int) {
+			var reply RaftVoteReply
+			err := r.call(peer, "Raft.RequestVote", args, &reply, raftRpcTimeout)
+			if err != nil {
+				return
+			}
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			r.observeTerm(reply.Term)
+			if r.state != candidate || r.term != args.Term || !reply.Granted {
+				return
+			}
+			votes++
+			if votes >= r.majority() {
+				r.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// Must hold r.lock.
+func (r *raftNode) becomeLeader() {
+	log.Printf("Elected cluster leader for term %d\n", r.term)
+	r.state = leader
+	r.leader = r.self
+	now := time.Now()
+	r.nextIndex = make([]uint64, len(r.peers))
+	r.matchIndex = make([]uint64, len(r.peers))
+	r.lastContact = make([]time.Time, len(r.peers))
+	r.down = make([]bool, len(r.peers))
+	r.replicate = make([]chan bool, len(r.peers))
+	for peer := range r.peers {
+		r.nextIndex[peer] = r.lastIndex() + 1
+		r.lastContact[peer] = now
+	}
+	// Entries from previous terms are only committed along with an entry from
+	// the current term.
+	if _, err := r.appendEntry(&command{Op: cmdNoop}); err != nil {
+		log.Println("Error saving raft log:", err)
+		r.leader = -1
+		r.becomeFollower()
+		return
+	}
+	for peer := range r.peers {
+		if peer != r.self {
+			r.replicate[peer] = make(chan bool, 1)
+			go r.replicateTo(peer, r.term, r.replicate[peer])
+		}
+	}
+}
+
+// Appends a new entry to the leader's log. Must hold r.lock.
+func (r *raftNode) appendEntry(cmd *command) (*raftEntry, error) {
+	entry := &raftEntry{r.lastIndex() + 1, r.term, cmd}
+	if err := r.saveEntries([]*raftEntry{entry}); err != nil {
+		return nil, err
+	}
+	r.log = append(r.log, entry)
+	r.matchIndex[r.self] = entry.Index
+	r.advanceCommit()
+	for _, c := range r.replicate {
+		if c != nil {
+			select {
+			case c <- true:
+			default:
+			}
+		}
+	}
+	return entry, nil
+}
+
+// Sends entries and heartbeats to peer while this member leads term.
+func (r *raftNode) replicateTo(peer int, term uint64, trigger chan bool) {
+	timer := time.NewTicker(raftHeartbeat)
+	defer timer.Stop()
+	for {
+		r.lock.Lock()
+		if r.stopped || r.state != leader || r.term != term {
+			r.lock.Unlock()
+			return
+		}
+		next := r.nextIndex[peer]
+		first := r.log[0]
+		var args *RaftAppendArgs
+		var snapshot *RaftSnapshotArgs
+		if next <= first.Index {
+			// The entries the peer is missing were compacted.
+			snapshot = &RaftSnapshotArgs{
+				Term:     term,
+				Leader:   r.self,
+				Index:    first.Index,
+				LastTerm: first.Term,
+				Data:     r.snapshot}
+		} else {
+			prev := r.entry(next - 1)
+			entries := r.log[next-first.Index:]
+			if len(entries) > raftMaxAppendEntries {
+				entries = entries[:raftMaxAppendEntries]
+			}
+			args = &RaftAppendArgs{
+				Term:         term,
+				Leader:       r.self,
+				PrevLogIndex: prev.Index,
+				PrevLogTerm:  prev.Term,
+				Entries:      append([]*raftEntry(nil), entries...),
+				LeaderCommit: r.commitIndex}
+		}
+		r.lock.Unlock()
+
+		var err error
+		if snapshot != nil {
+			var reply RaftSnapshotReply
+			err = r.call(peer, "Raft.InstallSnapshot", snapshot, &reply,
+				raftSnapshotTimeout)
+			if err == nil {
+				r.handleSnapshotReply(peer, snapshot, &reply)
+			}
+		} else {
+			var reply RaftAppendReply
+			err = r.call(peer, "Raft.AppendEntries", args, &reply,
+				raftRpcTimeout)
+			if err == nil {
+				r.handleAppendReply(peer, args, &reply)
+			}
+		}
+
+		r.lock.Lock()
+		// Keep sending while the peer is missing entries.
+		behind := err == nil && r.state == leader && r.term == term &&
+			r.nextIndex[peer] <= r.lastIndex()
+		r.lock.Unlock()
+		if behind {
+			continue
+		}
+		select {
+		case _, ok := <-trigger:
+			if !ok {
+				return
+			}
+		case <-timer.C:
+		}
+	}
+}
+
+func (r *raftNode) handleAppendReply(
+	peer int, args *RaftAppendArgs, reply *RaftAppendReply) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.observeTerm(reply.Term)
+	if r.state != leader || r.term != args.Term {
+		return
+	}
+	r.lastContact[peer] = time.Now()
+	r.down[peer] = false
+	if reply.Success {
+		match := args.PrevLogIndex + uint64(len(args.Entries))
+		if match > r.matchIndex[peer] {
+			r.matchIndex[peer] = match
+		}
+		r.nextIndex[peer] = r.matchIndex[peer] + 1
+		r.advanceCommit()
+	} else if reply.NextIndex > 0 && reply.NextIndex <= r.lastIndex()+1 {
+		r.nextIndex[peer] = reply.NextIndex
+	} else if r.nextIndex[peer] > 1 {
+		r.nextIndex[peer]--
+	}
+}
+
+func (r *raftNode) handleSnapshotReply(
+	peer int, args *RaftSnapshotArgs, reply *RaftSnapshotReply) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.observeTerm(reply.Term)
+	if r.state != leader || r.term != args.Term {
+		return
+	}
+	r.lastContact[peer] = time.Now()
+	r.down[peer] = false
+	if args.Index > r.matchIndex[peer] {
+		r.matchIndex[peer] = args.Index
+	}
+	r.nextIndex[peer] = r.matchIndex[peer] + 1
+	r.advanceCommit()
+}
+
+// Commits the entries replicated to a majority. Must hold r.lock.
+func (r *raftNode) advanceCommit() {
+	for n := r.lastIndex(); n > r.commitIndex; n-- {
+		if r.entry(n).Term != r.term {
+			break
+		}
+		count := 0
+		for _, match := range r.matchIndex {
+			if match >= n {
+				count++
+			}
+		}
+		if count >= r.majority() {
+			r.commitIndex = n
+			r.changed.Broadcast()
+			break
+		}
+	}
+}
+
+// Passes committed entries to apply in order.
+func (r *raftNode) applyEntries() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for {
+		for !r.stopped && r.lastApplied >= r.commitIndex {
+			r.changed.Wait()
+		}
+		if r.stopped {
+			return
+		}
+		if first := r.log[0]; r.lastApplied < first.Index {
+			// The entries up to first were replaced by a snapshot.
+			r.lastApplied = first.Index
+			snapshot := r.snapshot
+			r.lock.Unlock()
+			r.restore(first, snapshot)
+			r.lock.Lock()
+			continue
+		}
+		r.lastApplied++
+		entry := r.entry(r.lastApplied)
+		r.lock.Unlock()
+		r.apply(entry)
+		r.lock.Lock()
+	}
+}
+
+// Returns true once enough entries up to index, which took effect on this
+// member, can be compacted.
+func (r *raftNode) shouldCompact(index uint64) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return index >= r.log[0].Index+raftCompactEntries
+}
+
+// Replaces the entries up to index, which took effect on this member, with
+// snapshot, the state they resulted in.
+func (r *raftNode) compact(index uint64, snapshot json.RawMessage) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if index <= r.log[0].Index || index > r.appliedIndex {
+		return nil
+	}
+	last := r.entry(index)
+	return r.replaceLog(&raftEntry{Index: last.Index, Term: last.Term},
+		snapshot, r.log[index-r.log[0].Index+1:])
+}
+
+// Makes snapshot, taken at the entry first, and entries the new log. Must hold
+// r.lock.
+func (r *raftNode) replaceLog(first *raftEntry, snapshot json.RawMessage,
+	entries []*raftEntry) error {
+	if r.store != nil {
+		err := r.store.rewrite(r.term, r.votedFor, first, snapshot, entries)
+		if err != nil {
+			return err
+		}
+	}
+	// Copy the entries so the compacted ones can be freed.
+	log := make([]*raftEntry, 0, len(entries)+1)
+	r.log = append(append(log, first), entries...)
+	r.snapshot = snapshot
+	return nil
+}
+
+// Records that the snapshot replacing the entries up to entry took effect.
+// Proposals among them cannot tell their result anymore.
+func (r *raftNode) restored(entry *raftEntry) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for index, p := range r.proposals {
+		if index <= entry.Index {
+			delete(r.proposals, index)
+			p.done <- errors.New("Cluster leader changed")
+		}
+	}
+	r.appliedIndex = entry.Index
+	r.changed.Broadcast()
+}
+
+// Records that entry took effect with the given result. Wakes up the proposer
+// and anyone waiting for the entry.
+func (r *raftNode) applied(entry *raftEntry, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if p, ok := r.proposals[entry.Index]; ok {
+		delete(r.proposals, entry.Index)
+		if p.term != entry.Term {
+			err = errors.New("Cluster leader changed")
+		}
+		p.done <- err
+	}
+	r.appliedIndex = entry.Index
+	r.changed.Broadcast()
+}
+
+// Appends cmd to the log if this member is the leader. The returned channel
+// receives the result of applying the command.
+func (r *raftNode) propose(cmd *command) (uint64, chan error, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.state != leader {
+		return 0, nil, errors.New("Not the cluster leader")
+	}
+	entry, err := r.appendEntry(cmd)
+	if err != nil {
+		return 0, nil, err
+	}
+	p := &proposal{entry.Term, make(chan error, 1)}
+	r.proposals[entry.Index] = p
+	return entry.Index, p.done, nil
+}
+
+// Waits until the entry at index has taken effect on this member.
+func (r *raftNode) waitApplied(index uint64, timeout time.Duration) error {
+	timedOut := false
+	timer := time.AfterFunc(timeout, func() {
+		r.lock.Lock()
+		timedOut = true
+		r.changed.Broadcast()
+		r.lock.Unlock()
+	})
+	defer timer.Stop()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for r.appliedIndex < index && !timedOut && !r.stopped {
+		r.changed.Wait()
+	}
+	if r.appliedIndex < index {
+		return errors.New("Method timeout")
+	}
+	return nil
+}
+
+// Waits for the result of a proposal.
+func (r *raftNode) wait(done chan error, timeout time.Duration) error {
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return errors.New("Method timeout")
+	}
+}
+
+// Replicates cmd and waits until it has taken effect on this member. Followers
+// forward the command to the leader.
+func (r *raftNode) submit(cmd *command, timeout time.Duration) error {
+	_, done, err := r.propose(cmd)
+	if err == nil {
+		return r.wait(done, timeout)
+	}
+
+	// Wait for an election in progress to finish.
+	leader := r.currentLeader()
+	for deadline := time.Now().Add(timeout); leader < 0 || leader == r.self; {
+		if r.isStopped() || time.Now().After(deadline) {
+			return errors.New("No cluster leader")
+		}
+		time.Sleep(raftHeartbeat)
+		if _, done, err = r.propose(cmd); err == nil {
+			return r.wait(done, timeout)
+		}
+		leader = r.currentLeader()
+	}
+	var reply RaftForwardReply
+	err = r.call(leader, "Raft.Forward", &RaftForwardArgs{cmd}, &reply,
+		timeout)
+	if err != nil {
+		return err
+	}
+	// Return once the change is visible on this member.
+	if err = r.waitApplied(reply.Index, timeout); err != nil {
+		return err
+	}
+	if reply.Error != "" {
+		return errors.New(reply.Error)
+	}
+	return nil
+}
+
+// raftService handles the requests sent between members of the cluster.
+type raftService struct {
+	node *raftNode
+}
+
+func (s *raftService) RequestVote(args *RaftVoteArgs, reply *RaftVoteReply) error {
+	r := s.node
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.observeTerm(args.Term)
+	reply.Term = r.term
+	// Only vote for candidates whose log is at least as up to date.
+	upToDate := args.LastLogTerm > r.lastTerm() ||
+		(args.LastLogTerm == r.lastTerm() && args.LastLogIndex >= r.lastIndex())
+	if args.Term == r.term && upToDate &&
+		(r.votedFor == -1 || r.votedFor == args.Candidate) {
+		r.votedFor = args.Candidate
+		r.resetElectionTime()
+		reply.Granted = true
+	}
+	// Answer only once the term and vote are on disk.
+	if err := r.saveVote(); err != nil {
+		reply.Granted = false
+		return err
+	}
+	return nil
+}
+
+func (s *raftService) AppendEntries(args *RaftAppendArgs, reply *RaftAppendReply) error {
+	r := s.node
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.observeTerm(args.Term)
+	if err := r.saveVote(); err != nil {
+		return err
+	}
+	reply.Term = r.term
+	if args.Term < r.term {
+		return nil
+	}
+	if r.state != follower {
+		r.becomeFollower()
+	}
+	r.leader = args.Leader
+	r.resetElectionTime()
+
+	// The log must contain the entry preceding the new entries.
+	if args.PrevLogIndex > r.lastIndex() {
+		reply.NextIndex = r.lastIndex() + 1
+		return nil
+	}
+	if first := r.log[0].Index; args.PrevLogIndex < first {
+		// The entries up to the snapshot are committed, continue after it.
+		reply.NextIndex = first + 1
+		return nil
+	}
+	if r.entry(args.PrevLogIndex).Term != args.PrevLogTerm {
+		// Skip back over the whole conflicting term.
+		term := r.entry(args.PrevLogIndex).Term
+		index := args.PrevLogIndex
+		for index > r.commitIndex+1 && r.entry(index-1).Term == term {
+			index--
+		}
+		reply.NextIndex = index
+		return nil
+	}
+
+	for i, entry := range args.Entries {
+		if entry.Index <= r.lastIndex() &&
+			r.entry(entry.Index).Term == entry.Term {
+			continue
+		}
+		// Conflicting entries are never committed, drop them. The new entries
+		// must be on disk before the leader counts them as replicated.
+		if err := r.saveEntries(args.Entries[i:]); err != nil {
+			return err
+		}
+		r.log = append(r.log[:entry.Index-r.log[0].Index],
+			args.Entries[i:]...)
+		break
+	}
+
+	if args.LeaderCommit > r.commitIndex {
+		last := args.PrevLogIndex + uint64(len(args.Entries))
+		r.commitIndex = args.LeaderCommit
+		if last < r.commitIndex {
+			r.commitIndex = last
+		}
+		r.changed.Broadcast()
+	}
+	reply.Success = true
+	return nil
+}
+
+type RaftSnapshotArgs struct {
+	Term   uint64 `json:"term"`
+	Leader int    `json:"leader"`
+	// Index and term of the last entry replaced by the snapshot.
+	Index    uint64          `json:"index"`
+	LastTerm uint64          `json:"last_term"`
+	Data     json.RawMessage `json:"data"`
+}
+
+type RaftSnapshotReply struct {
+	Term uint64 `json:"term"`
+}
+
+// Replaces the log up to the snapshot of the leader. The entries after it are
+// kept if the log already has the last entry of the snapshot.
+func (s *raftService) InstallSnapshot(
+	args *RaftSnapshotArgs, reply *RaftSnapshotReply) error {
+	r := s.node
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.observeTerm(args.Term)
+	if err := r.saveVote(); err != nil {
+		return err
+	}
+	reply.Term = r.term
+	if args.Term < r.term {
+		return nil
+	}
+	if r.state != follower {
+		r.becomeFollower()
+	}
+	r.leader = args.Leader
+	r.resetElectionTime()
+	if args.Index <= r.log[0].Index {
+		return nil
+	}
+
+	var entries []*raftEntry
+	if args.Index <= r.lastIndex() &&
+		r.entry(args.Index).Term == args.LastTerm {
+		entries = r.log[args.Index-r.log[0].Index+1:]
+	}
+	err := r.replaceLog(&raftEntry{Index: args.Index, Term: args.LastTerm},
+		args.Data, entries)
+	if err != nil {
+		return err
+	}
+	if args.Index > r.commitIndex {
+		r.commitIndex = args.Index
+		r.changed.Broadcast()
+	}
+	return nil
+}
+
+type RaftForwardArgs struct {
+	Command *command `json:"command"`
+}
+
+type RaftForwardReply struct {
+	// Index of the command's entry.
+	Index uint64 `json:"index"`
+	// Result of applying the command on the leader.
+	Error string `json:"error"`
+}
+
+// Proposes a command on behalf of a follower.
+func (s *raftService) Forward(
+	args *RaftForwardArgs, reply *RaftForwardReply) error {
+	index, done, err := s.node.propose(args.Command)
+	if err != nil {
+		return err
+	}
+	select {
+	case err = <-done:
+	case <-time.After(methodTimeout):
+		return errors.New("Method timeout")
+	}
+	reply.Index = index
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package discovery
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const raftFile = "raft.json"
+
+// raftStore keeps what a member of a cluster must not forget when it restarts:
+// the current term, the vote it cast in that term, its snapshot and its log.
+// Otherwise a member could vote twice in a term or lose entries it
+// acknowledged to the leader. Changes reach the disk before the member answers
+// another member.
+//
+// The file contains one json encoded raftRecord per line. An entry replaces
+// the entries at and after its index, which records entries dropped after a
+// conflict with the leader. When the log is compacted, the file is rewritten
+// starting with the snapshot.
+type raftStore struct {
+	path   string
+	file   *os.File
+	writer *bufio.Writer
+	// The term and vote last written.
+	term     uint64
+	votedFor int
+}
+
+type raftVote struct {
+	Term     uint64 `json:"term"`
+	VotedFor int    `json:"voted_for"`
+}
+
+// The snapshot of the entries up to Index.
+type raftSnapshot struct {
+	Index uint64          `json:"index"`
+	Term  uint64          `json:"term"`
+	Data  json.RawMessage `json:"data"`
+}
+
+type raftRecord struct {
+	Vote     *raftVote     `json:"vote,omitempty"`
+	Snapshot *raftSnapshot `json:"snapshot,omitempty"`
+	Entry    *raftEntry    `json:"entry,omitempty"`
+}
+
+// Opens the raft state kept in dir and loads it into r.
+func openRaftStore(dir string, r *raftNode) (*raftStore, error) {
+	path := filepath.Join(dir, raftFile)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &raftStore{path: path, file: file, votedFor: -1}
+	size, err := s.load(r)
+	if err == nil {
+		// Drop a partially written record, like the store does.
+		err = file.Truncate(size)
+	}
+	if err == nil {
+		_, err = file.Seek(size, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	s.writer = bufio.NewWriter(file)
+	return s, nil
+}
+
+// Replays the records of the file into r. Returns the size of the complete
+// records.
+func (s *raftStore) load(r *raftNode) (int64, error) {
+	reader := bufio.NewReader(s.file)
+	var size int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return size, nil
+		} else if err != nil {
+			return 0, err
+		}
+		var record raftRecord
+		if err = json.Unmarshal(line, &record); err != nil {
+			return 0, err
+		}
+		size += int64(len(line))
+		if record.Vote != nil {
+			s.term = record.Vote.Term
+			s.votedFor = record.Vote.VotedFor
+			r.term = s.term
+			r.votedFor = s.votedFor
+		}
+		if snapshot := record.Snapshot; snapshot != nil {
+			r.log = []*raftEntry{{Index: snapshot.Index, Term: snapshot.Term}}
+			r.snapshot = snapshot.Data
+			// Only applied entries are compacted.
+			r.commitIndex = snapshot.Index
+		}
+		if entry := record.Entry; entry != nil {
+			first := r.log[0].Index
+			if entry.Index <= first || entry.Index > r.lastIndex()+1 {
+				return 0, errors.New("Missing raft log entries")
+			}
+			r.log = append(r.log[:entry.Index-first], entry)
+		}
+	}
+}
+
+// Writes the term and vote if they changed since they were last written.
+func (s *raftStore) saveVote(term uint64, votedFor int) error {
+	if term == s.term && votedFor == s.votedFor {
+		return nil
+	}
+	err := s.write(&raftRecord{Vote: &raftVote{term, votedFor}})
+	if err == nil {
+		s.term = term
+		s.votedFor = votedFor
+	}
+	return err
+}
+
+// Writes entries, replacing any entries at and after the index of the first.
+func (s *raftStore) saveEntries(entries []*raftEntry) error {
+	records := make([]*raftRecord, len(entries))
+	for i, entry := range entries {
+		records[i] = &raftRecord{Entry: entry}
+	}
+	return s.write(records...)
+}
+
+// Replaces the file with the term and vote, the snapshot taken at the entry
+// first and the entries after it.
+func (s *raftStore) rewrite(term uint64, votedFor int, first *raftEntry,
+	snapshot json.RawMessage, entries []*raftEntry) error {
+	file, err := os.Create(s.path + ".tmp")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	err = encoder.Encode(&raftRecord{Vote: &raftVote{term, votedFor}})
+	if err == nil {
+		err = encoder.Encode(&raftRecord{Snapshot: &raftSnapshot{
+			first.Index, first.Term, snapshot}})
+	}
+	for _, entry := range entries {
+		if err == nil {
+			err = encoder.Encode(&raftRecord{Entry: entry})
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(s.path+".tmp", s.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(s.path + ".tmp")
+		return err
+	}
+	// Keep appending to the new file.
+	s.file.Close()
+	s.file = file
+	s.writer = bufio.NewWriter(file)
+	s.term = term
+	s.votedFor = votedFor
+	return nil
+}
+
+// Appends records to the file and waits for them to reach the disk.
+func (s *raftStore) write(records ...*raftRecord) error {
+	encoder := json.NewEncoder(s.writer)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *raftStore) close() error {
+	return s.file.Close()
+}
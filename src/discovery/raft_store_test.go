@@ -0,0 +1,77 @@
+package discovery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Returns a node whose state is loaded from dir.
+func openTestRaftStore(t *testing.T, dir string) *raftNode {
+	r := newRaftNode(nil, []string{"a"}, 0, nil)
+	store, err := openRaftStore(dir, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.store = store
+	return r
+}
+
+func TestRaftStoreReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := openTestRaftStore(t, dir)
+	if r.term != 0 || r.votedFor != -1 || r.lastIndex() != 0 {
+		t.Error("New store should be empty", r.term, r.votedFor)
+	}
+	r.store.saveVote(3, 1)
+	r.store.saveEntries([]*raftEntry{{1, 1, nil}, {2, 1, nil}, {3, 2, nil}})
+	// Entries after a conflict replace the ones from the conflict on.
+	r.store.saveEntries([]*raftEntry{{2, 3, nil}})
+	r.store.saveVote(4, -1)
+	r.store.close()
+
+	r = openTestRaftStore(t, dir)
+	if r.term != 4 || r.votedFor != -1 || r.lastIndex() != 2 ||
+		r.log[2].Term != 3 {
+		t.Error("Wrong state after reload", r.term, r.votedFor, r.lastIndex())
+	}
+	r.store.close()
+
+	// Records written after a partial one are not lost.
+	file, err := os.OpenFile(filepath.Join(dir, raftFile),
+		os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"entry":{"ind`)
+	file.Close()
+	r = openTestRaftStore(t, dir)
+	r.store.saveEntries([]*raftEntry{{3, 4, nil}})
+	r.store.close()
+	r = openTestRaftStore(t, dir)
+	if r.term != 4 || r.lastIndex() != 3 || r.log[3].Term != 4 {
+		t.Error("Wrong state after a partial record", r.term, r.lastIndex())
+	}
+
+	// A compacted log starts with the snapshot.
+	err = r.store.rewrite(5, 0, &raftEntry{Index: 2, Term: 3},
+		[]byte(`{"revision":7}`), []*raftEntry{{3, 4, nil}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.store.saveEntries([]*raftEntry{{4, 5, nil}})
+	r.store.close()
+	r = openTestRaftStore(t, dir)
+	defer r.store.close()
+	if r.term != 5 || r.votedFor != 0 || r.log[0].Index != 2 ||
+		r.commitIndex != 2 || string(r.snapshot) != `{"revision":7}` ||
+		r.lastIndex() != 4 || r.entry(4).Term != 5 {
+		t.Error("Wrong state after compaction", r.term, r.log[0], r.lastIndex())
+	}
+}
@@ -0,0 +1,300 @@
+package discovery
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Suffix of the files a Resolver keeps its groups in.
+const resolverFileSuffix = ".json"
+
+// Returned by Resolve for a group with nothing cached once the resolver is
+// closed.
+var ErrResolverClosed = errors.New("Resolver is closed")
+
+// A Resolver answers with the members of groups from a local cache so that
+// applications keep finding services while the server is unreachable. The
+// first Resolve of a group watches it and the watch keeps the cache up to
+// date. While the client is disconnected, or when the group cannot be
+// watched, Resolve returns the cached members marked as stale. Once the
+// client reconnects, its restored watches bring the cache back in line with
+// the server.
+//
+// With a directory, the cache is also kept on disk, one file per group, so a
+// new Resolver starts with the members its predecessor last knew about.
+type Resolver struct {
+	client *Client
+	dir    string
+
+	// Serializes the attempts to watch a group.
+	watchLock sync.Mutex
+	// Guards the fields below.
+	lock   sync.Mutex
+	groups map[string]*cachedGroup
+	closed bool
+}
+
+type cachedGroup struct {
+	revision uint64
+	members  map[serviceKey]*ServiceDef
+	// When the members were last known to match the server.
+	updated time.Time
+	// Set while a watch keeps the members up to date.
+	watching bool
+}
+
+// The members of a group returned by a Resolver.
+type CachedSnapshot struct {
+	Snapshot
+	// Set when the members could not be confirmed with the server, e.g. while
+	// it is unreachable. Age is how long ago they last were.
+	Stale bool
+	Age   time.Duration
+}
+
+// Format of the file of a group.
+type resolverFile struct {
+	Group    string        `json:"group"`
+	Revision uint64        `json:"revision"`
+	Updated  time.Time     `json:"updated"`
+	Services []*ServiceDef `json:"services"`
+}
+
+// Returns a resolver watching groups on client. When dir is not empty, the
+// groups are also kept in files in dir, which is created if necessary, and
+// the groups already there are loaded. A client has a single watch per group:
+// Resolve cannot watch a group that client already watches, or that overlaps
+// a watched prefix, e.g. for a Balancer or Ring, and only returns its cached
+// members. Use one Client per watcher of a group.
+func NewResolver(client *Client, dir string) (*Resolver, error) {
+	r := &Resolver{client: client, dir: dir,
+		groups: make(map[string]*cachedGroup)}
+	if dir == "" {
+		return r, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Loads the groups kept in the directory of the resolver. Files that cannot
+// be read are skipped, an older cache is better than none.
+func (r *Resolver) load() error {
+	files, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range files {
+		if !strings.HasSuffix(info.Name(), resolverFileSuffix) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(r.dir, info.Name()))
+		var file resolverFile
+		if err == nil {
+			err = json.Unmarshal(data, &file)
+		}
+		if err != nil {
+			log.Println("Unable to load", info.Name(), err)
+			continue
+		}
+		g := &cachedGroup{revision: file.Revision, updated: file.Updated}
+		g.reset(file.Services)
+		r.groups[file.Group] = g
+	}
+	return nil
+}
+
+// Returns the path of the file of group. Group names may contain "/" so they
+// are escaped.
+func (r *Resolver) path(group string) string {
+	return filepath.Join(r.dir, url.PathEscape(group)+resolverFileSuffix)
+}
+
+// Writes the members of group to its file, if the resolver has a directory.
+func (r *Resolver) save(group string) {
+	if r.dir == "" {
+		return
+	}
+	r.lock.Lock()
+	g, ok := r.groups[group]
+	if !ok {
+		r.lock.Unlock()
+		return
+	}
+	file := &resolverFile{Group: group, Revision: g.revision,
+		Updated: g.updated, Services: g.services()}
+	r.lock.Unlock()
+
+	path := r.path(group)
+	out, err := os.Create(path + ".tmp")
+	if err == nil {
+		writer := bufio.NewWriter(out)
+		err = json.NewEncoder(writer).Encode(file)
+		if err == nil {
+			err = writer.Flush()
+		}
+		out.Close()
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		log.Println("Unable to save", group, err)
+	}
+}
+
+// Replaces the members of the group.
+func (g *cachedGroup) reset(services []*ServiceDef) {
+	g.members = make(map[serviceKey]*ServiceDef, len(services))
+	for _, service := range services {
+		g.members[keyOf(service)] = service
+	}
+}
+
+// Returns the members of the group in ServiceDef.compare order.
+func (g *cachedGroup) services() []*ServiceDef {
+	services := make(serviceDefs, 0, len(g.members))
+	for _, service := range g.members {
+		services = append(services, service)
+	}
+	sort.Sort(services)
+	return services
+}
+
+type serviceDefs []*ServiceDef
+
+func (s serviceDefs) Len() int           { return len(s) }
+func (s serviceDefs) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s serviceDefs) Less(i, j int) bool { return s[i].compare(s[j]) < 0 }
+
+// Returns the members of group, a group or a prefix as for Watch. Stale is set
+// when they come from the cache without being confirmed by a watch on a
+// connected client. The error of the watch is only returned when nothing is
+// cached for group.
+func (r *Resolver) Resolve(group string) (*CachedSnapshot, error) {
+	if err := r.watch(group); err != nil {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		g, ok := r.groups[group]
+		if !ok {
+			return nil, err
+		}
+		return g.snapshot(true), nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	g := r.groups[group]
+	stale := !g.watching || r.client.State() != Connected
+	if !stale {
+		g.updated = time.Now()
+	}
+	return g.snapshot(stale), nil
+}
+
+func (g *cachedGroup) snapshot(stale bool) *CachedSnapshot {
+	s := &CachedSnapshot{Snapshot: Snapshot{Revision: g.revision,
+		Services: g.services()}, Stale: stale}
+	if stale {
+		s.Age = time.Since(g.updated)
+	}
+	return s
+}
+
+// Starts watching group unless it is already watched. The snapshot of the
+// watch replaces the cached members.
+func (r *Resolver) watch(group string) error {
+	r.watchLock.Lock()
+	defer r.watchLock.Unlock()
+	r.lock.Lock()
+	g, ok := r.groups[group]
+	watching := ok && g.watching
+	closed := r.closed
+	r.lock.Unlock()
+	if watching {
+		return nil
+	} else if closed {
+		return ErrResolverClosed
+	}
+
+	snapshot, events, err := r.client.Watch(group)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	if !ok {
+		g = &cachedGroup{}
+		r.groups[group] = g
+	}
+	g.reset(snapshot.Services)
+	g.revision = snapshot.Revision
+	g.updated = time.Now()
+	g.watching = true
+	r.lock.Unlock()
+	r.save(group)
+	go r.follow(group, g, events)
+	return nil
+}
+
+// Applies the events of the watch of group until it is closed.
+func (r *Resolver) follow(group string, g *cachedGroup,
+	events <-chan *Event) {
+	for event := range events {
+		r.lock.Lock()
+		if event.Type == Joined {
+			g.members[keyOf(event.Service)] = event.Service
+		} else {
+			delete(g.members, keyOf(event.Service))
+		}
+		if event.Service.Revision > g.revision {
+			g.revision = event.Service.Revision
+		}
+		g.updated = time.Now()
+		r.lock.Unlock()
+		if len(events) == 0 {
+			// Save once a burst of events is applied.
+			r.save(group)
+		}
+	}
+	r.lock.Lock()
+	g.watching = false
+	r.lock.Unlock()
+}
+
+// Stops watching the groups. Resolve keeps returning the cached members, as
+// stale.
+func (r *Resolver) Close() error {
+	r.watchLock.Lock()
+	defer r.watchLock.Unlock()
+	r.lock.Lock()
+	r.closed = true
+	var groups []string
+	for group, g := range r.groups {
+		if g.watching {
+			g.watching = false
+			groups = append(groups, group)
+		}
+	}
+	r.lock.Unlock()
+	var err error
+	for _, group := range groups {
+		if e := r.client.Ignore(group); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,124 @@
+package discovery
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Returns true if the resolved services are the given hosts, in order.
+func resolvedHosts(res *CachedSnapshot, hosts ...string) bool {
+	if len(res.Services) != len(hosts) {
+		return false
+	}
+	for i, service := range res.Services {
+		if service.Host != hosts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testResolver(t *testing.T, protocol Protocol) {
+	dir, err := ioutil.TempDir("", "resolver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server := NewServer()
+	go server.processEvents()
+	states := make(chan ConnState, 4)
+	client, dial, disconnect :=
+		connectReconnectingClient(server, protocol, states)
+	other := connectTestClient(server, protocol)
+	defer other.Close()
+
+	other.Join(&ServiceDef{Host: "a", Group: "prod/api"})
+	r, err := NewResolver(client, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := r.Resolve("prod/api")
+	if err != nil || res.Stale || !resolvedHosts(res, "a") {
+		t.Fatal("Wrong members", res, err)
+	}
+	other.Join(&ServiceDef{Host: "b", Group: "prod/api"})
+	if !waitFor(func() bool {
+		res, err = r.Resolve("prod/api")
+		return err == nil && resolvedHosts(res, "a", "b")
+	}) {
+		t.Fatal("Join not resolved", res)
+	}
+
+	// The members are still there, but stale, while the server is away.
+	disconnect()
+	if state := nextState(t, states); state != Disconnected {
+		t.Fatal("Expected to be disconnected", state)
+	}
+	res, err = r.Resolve("prod/api")
+	if err != nil || !res.Stale || res.Age <= 0 ||
+		!resolvedHosts(res, "a", "b") {
+		t.Error("Expected stale members", res, err)
+	}
+	if _, err = r.Resolve("other"); err == nil {
+		t.Error("Expected an error for a group that is not cached")
+	}
+
+	// They catch up once the client is back.
+	other.Leave(&ServiceDef{Host: "a", Group: "prod/api"})
+	dial <- true
+	if state := nextState(t, states); state != Connected {
+		t.Fatal("Expected to be connected", state)
+	}
+	if !waitFor(func() bool {
+		res, err = r.Resolve("prod/api")
+		return err == nil && !res.Stale && resolvedHosts(res, "b")
+	}) {
+		t.Error("Members not reconciled", res)
+	}
+
+	// A new resolver starts from the members on disk.
+	client.Close()
+	if state := nextState(t, states); state != Closed {
+		t.Fatal("Expected to be closed", state)
+	}
+	if !waitFor(func() bool {
+		loaded, err := NewResolver(client, dir)
+		if err != nil {
+			return false
+		}
+		res, err = loaded.Resolve("prod/api")
+		return err == nil && res.Stale && resolvedHosts(res, "b")
+	}) {
+		t.Error("Members not loaded from disk", res)
+	}
+}
+
+func TestResolverJSON(t *testing.T) {
+	testResolver(t, JSON)
+}
+
+func TestResolverProtobuf(t *testing.T) {
+	testResolver(t, Protobuf)
+}
+
+func TestResolverMemory(t *testing.T) {
+	server := NewServer()
+	go server.processEvents()
+	client := connectTestClient(server, JSON)
+	client.Join(&ServiceDef{Host: "a", Group: "group"})
+	r, err := NewResolver(client, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := r.Resolve("group"); err != nil || res.Stale ||
+		!resolvedHosts(res, "a") {
+		t.Fatal("Wrong members", res, err)
+	}
+	r.Close()
+	if res, err := r.Resolve("group"); err != nil || !res.Stale ||
+		!resolvedHosts(res, "a") {
+		t.Error("Expected stale members after close", res, err)
+	}
+	client.Close()
+}
@@ -0,0 +1,183 @@
+package discovery
+
+import (
+	"hash/crc32"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Number of points a service of weight 1 has on a Ring. More points spread
+// keys more evenly.
+const ringPointsPerWeight = 128
+
+// A Ring assigns keys to the members of a watched group by consistent hashing.
+// Every service has points on a circle of hashes, in proportion to its weight
+// label, and a key belongs to the service of the first point after the hash of
+// the key. When a service joins or leaves, only the keys of its points move.
+//
+// Services are identified by host and port, so a key keeps its service when
+// the service joins again with other labels. Only active services are on the
+// ring: the keys of a service that starts draining move to the others.
+type Ring struct {
+	client *Client
+	group  string
+
+	lock sync.RWMutex
+	// Points of every service, sorted by hash.
+	points []ringPoint
+	// Services on the ring by host:port.
+	services map[string]*ServiceDef
+}
+
+type ringPoint struct {
+	hash uint32
+	// host:port of the service the point belongs to.
+	key string
+}
+
+type ringPoints []ringPoint
+
+func (p ringPoints) Len() int      { return len(p) }
+func (p ringPoints) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p ringPoints) Less(i, j int) bool {
+	if p[i].hash != p[j].hash {
+		return p[i].hash < p[j].hash
+	}
+	// Keep the order of colliding points the same everywhere.
+	return p[i].key < p[j].key
+}
+
+// Returns a ring over the members of group. The ring watches group on client
+// until it is closed. A client has a single watch per group, so this fails if
+// client already watches group, or a prefix above or a group under it, e.g.
+// for another Ring, Balancer or Resolver. Use one Client per watcher of a
+// group.
+func NewRing(client *Client, group string) (*Ring, error) {
+	snapshot, events, err := client.Watch(group)
+	if err != nil {
+		return nil, err
+	}
+	r := newRing()
+	r.client = client
+	r.group = group
+	for _, service := range snapshot.Services {
+		r.join(service)
+	}
+	go r.follow(events)
+	return r, nil
+}
+
+func newRing() *Ring {
+	return &Ring{services: make(map[string]*ServiceDef)}
+}
+
+// Applies the events of the watch until it is closed.
+func (r *Ring) follow(events <-chan *Event) {
+	for event := range events {
+		r.lock.Lock()
+		if event.Type == Joined {
+			r.join(event.Service)
+		} else {
+			r.leave(event.Service)
+		}
+		r.lock.Unlock()
+	}
+}
+
+func ringKey(service *ServiceDef) string {
+	return net.JoinHostPort(service.Host, strconv.Itoa(int(service.Port)))
+}
+
+// Adds the service, or updates it if its weight changed. Removes it when it is
+// no longer active.
+func (r *Ring) join(service *ServiceDef) {
+	if !service.active() {
+		r.leave(service)
+		return
+	}
+	key := ringKey(service)
+	if old, ok := r.services[key]; ok {
+		r.services[key] = service
+		if weightOf(old) == weightOf(service) {
+			return
+		}
+		r.removePoints(key)
+	}
+	r.services[key] = service
+	for i := 0; i < ringPointsPerWeight*weightOf(service); i++ {
+		hash := crc32.ChecksumIEEE([]byte(key + "-" + strconv.Itoa(i)))
+		r.points = append(r.points, ringPoint{hash, key})
+	}
+	sort.Sort(ringPoints(r.points))
+}
+
+func (r *Ring) leave(service *ServiceDef) {
+	key := ringKey(service)
+	if _, ok := r.services[key]; ok {
+		delete(r.services, key)
+		r.removePoints(key)
+	}
+}
+
+func (r *Ring) removePoints(key string) {
+	points := r.points[:0]
+	for _, p := range r.points {
+		if p.key != key {
+			points = append(points, p)
+		}
+	}
+	r.points = points
+}
+
+// Returns the services on the ring, in no particular order.
+func (r *Ring) Services() []*ServiceDef {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	services := make([]*ServiceDef, 0, len(r.services))
+	for _, service := range r.services {
+		services = append(services, service)
+	}
+	return services
+}
+
+// Returns the service key belongs to, or nil if the ring is empty.
+func (r *Ring) Get(key string) *ServiceDef {
+	if services := r.GetN(key, 1); len(services) > 0 {
+		return services[0]
+	}
+	return nil
+}
+
+// Returns up to n distinct services for key, e.g. to hold its replicas. The
+// first one is the service Get returns, the others follow it on the ring.
+func (r *Ring) GetN(key string, n int) []*ServiceDef {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if n > len(r.services) {
+		n = len(r.services)
+	}
+	if n <= 0 {
+		return nil
+	}
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= hash
+	})
+	services := make([]*ServiceDef, 0, n)
+	seen := make(map[string]bool, n)
+	for i := 0; len(services) < n; i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if !seen[p.key] {
+			seen[p.key] = true
+			services = append(services, r.services[p.key])
+		}
+	}
+	return services
+}
+
+// Stops watching the group. The ring keeps its last members.
+func (r *Ring) Close() error {
+	return r.client.Ignore(r.group)
+}
@@ -0,0 +1,140 @@
+package discovery
+
+import (
+	"strconv"
+	"testing"
+)
+
+func ringService(host string, weight int) *ServiceDef {
+	return &ServiceDef{Host: host, Port: 80, Group: "cache",
+		Labels: map[string]string{WeightLabel: strconv.Itoa(weight)}}
+}
+
+// Returns the host of the service of each of n keys.
+func ringAssignments(r *Ring, n int) []string {
+	hosts := make([]string, n)
+	for i := range hosts {
+		hosts[i] = r.Get("key" + strconv.Itoa(i)).Host
+	}
+	return hosts
+}
+
+func TestRingMovesFewKeys(t *testing.T) {
+	r := newRing()
+	if r.Get("key") != nil || r.GetN("key", 2) != nil {
+		t.Error("Empty ring should return nothing")
+	}
+	for _, host := range []string{"a", "b", "c"} {
+		r.join(ringService(host, 1))
+	}
+	before := ringAssignments(r, 1000)
+	r.join(ringService("d", 1))
+	after := ringAssignments(r, 1000)
+	moved := 0
+	for i := range before {
+		if before[i] != after[i] {
+			if after[i] != "d" {
+				t.Fatal("Key moved between old services", i, before[i],
+					after[i])
+			}
+			moved++
+		}
+	}
+	if moved < 100 || moved > 400 {
+		t.Error("Expected about a quarter of the keys to move", moved)
+	}
+
+	// Labels other than the weight do not move keys.
+	d := ringService("d", 1)
+	d.Labels["zone"] = "b"
+	r.join(d)
+	r.leave(&ServiceDef{Host: "d", Port: 80, Group: "cache"})
+	for i, host := range ringAssignments(r, 1000) {
+		if host != before[i] {
+			t.Fatal("Keys did not move back", i, host, before[i])
+		}
+	}
+}
+
+func TestRingGetN(t *testing.T) {
+	r := newRing()
+	for _, host := range []string{"a", "b", "c"} {
+		r.join(ringService(host, 1))
+	}
+	services := r.GetN("key", 2)
+	if len(services) != 2 || services[0] != r.Get("key") ||
+		services[0].Host == services[1].Host {
+		t.Error("Wrong replicas", services)
+	}
+	if services = r.GetN("key", 5); len(services) != 3 {
+		t.Error("Expected every service", services)
+	}
+}
+
+func TestRingMaxWeight(t *testing.T) {
+	r := newRing()
+	r.join(ringService("a", 100000000))
+	if len(r.points) != ringPointsPerWeight*MaxWeight {
+		t.Error("Weight not bounded", len(r.points))
+	}
+}
+
+func TestRingState(t *testing.T) {
+	r := newRing()
+	r.join(ringService("a", 1))
+	r.join(ringService("b", 1))
+	draining := ringService("b", 1)
+	draining.State = StateDraining
+	r.join(draining)
+	for i, host := range ringAssignments(r, 100) {
+		if host != "a" {
+			t.Fatal("Key assigned to a draining service", i, host)
+		}
+	}
+	r.join(ringService("b", 1))
+	if len(r.Services()) != 2 {
+		t.Error("Expected b back on the ring", r.Services())
+	}
+}
+
+func TestRingWeight(t *testing.T) {
+	r := newRing()
+	r.join(ringService("a", 3))
+	r.join(ringService("b", 1))
+	count := 0
+	for _, host := range ringAssignments(r, 1000) {
+		if host == "a" {
+			count++
+		}
+	}
+	if count < 650 || count > 850 {
+		t.Error("Expected about 3/4 of the keys on a", count)
+	}
+}
+
+func TestRingWatch(t *testing.T) {
+	server := NewServer()
+	go server.processEvents()
+	client := connectTestClient(server, Protobuf)
+	defer client.Close()
+
+	client.Join(ringService("a", 1))
+	r, err := NewRing(client, "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service := r.Get("key"); service == nil || service.Host != "a" {
+		t.Error("Expected a", service)
+	}
+	client.Join(ringService("b", 1))
+	if !waitFor(func() bool { return len(r.Services()) == 2 }) {
+		t.Error("Join not seen", r.Services())
+	}
+	client.Leave(ringService("a", 1))
+	if !waitFor(func() bool { return len(r.Services()) == 1 }) {
+		t.Error("Leave not seen", r.Services())
+	}
+	if err = r.Close(); err != nil {
+		t.Error(err)
+	}
+}
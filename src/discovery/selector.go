@@ -0,0 +1,237 @@
+package discovery
+
+import (
+	"errors"
+	"strings"
+)
+
+// Operators of the requirements of a Selector.
+const (
+	selEquals    = "="
+	selNotEquals = "!="
+	selIn        = "in"
+	selNotIn     = "notin"
+	selExists    = "exists"
+	selNotExists = "!exists"
+)
+
+// Prefix of the requirements on tags.
+const tagPrefix = "tag:"
+
+// A Selector picks the services of a group by their labels, tags and state. It
+// is parsed from a comma separated list of requirements, all of which must
+// hold:
+//
+//	key=value, key==value  the label key is value
+//	key!=value             the label key is missing or not value
+//	key in (v1,v2)         the label key is one of the values
+//	key notin (v1,v2)      the label key is missing or none of the values
+//	key                    the service has the label key
+//	!key                   the service does not have the label key
+//	tag:name               the service has the tag name
+//	!tag:name              the service does not have the tag name
+//	state:name             the service is in the state name, e.g. active
+//	!state:name            the service is not in the state name
+//
+// e.g. "zone in (a,b),version!=1.2,!tag:canary,state:active". The empty
+// selector matches every service.
+type Selector struct {
+	requirements []*requirement
+	expr         string
+}
+
+type requirement struct {
+	// Label key, or tag name when tag is set, or state when state is set.
+	key    string
+	tag    bool
+	state  bool
+	op     string
+	values []string
+}
+
+// Splits expr at the commas outside of parentheses.
+func splitRequirements(expr string) ([]string, error) {
+	var terms []string
+	depth, start := 0, 0
+	for i, c := range expr {
+		switch c {
+		case '(':
+			if depth++; depth > 1 {
+				return nil, errors.New("Nested parentheses")
+			}
+		case ')':
+			if depth--; depth < 0 {
+				return nil, errors.New("Unbalanced parentheses")
+			}
+		case ',':
+			if depth == 0 {
+				terms = append(terms, expr[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, errors.New("Unbalanced parentheses")
+	}
+	return append(terms, expr[start:]), nil
+}
+
+func validKey(key string) bool {
+	return key != "" && !strings.ContainsAny(key, " \t=!(),")
+}
+
+// Parses a single requirement.
+func parseRequirement(term string) (*requirement, error) {
+	r := &requirement{}
+	if i := strings.Index(term, "("); i >= 0 {
+		fields := strings.Fields(term[:i])
+		rest := strings.TrimSpace(term[i+1:])
+		if len(fields) != 2 || !strings.HasSuffix(rest, ")") {
+			return nil, errors.New("Invalid requirement: " + term)
+		}
+		r.key, r.op = fields[0], fields[1]
+		if r.op != selIn && r.op != selNotIn {
+			return nil, errors.New("Unknown operator: " + r.op)
+		}
+		for _, value := range strings.Split(rest[:len(rest)-1], ",") {
+			r.values = append(r.values, strings.TrimSpace(value))
+		}
+	} else if i := strings.Index(term, "!="); i >= 0 {
+		r.key, r.op = strings.TrimSpace(term[:i]), selNotEquals
+		r.values = []string{strings.TrimSpace(term[i+2:])}
+	} else if i := strings.Index(term, "="); i >= 0 {
+		value := strings.TrimPrefix(term[i+1:], "=")
+		r.key, r.op = strings.TrimSpace(term[:i]), selEquals
+		r.values = []string{strings.TrimSpace(value)}
+	} else if strings.HasPrefix(term, "!") {
+		r.key, r.op = strings.TrimSpace(term[1:]), selNotExists
+	} else {
+		r.key, r.op = term, selExists
+	}
+	if strings.HasPrefix(r.key, tagPrefix) {
+		if r.op != selExists && r.op != selNotExists {
+			return nil, errors.New("Tags only support existence: " + term)
+		}
+		r.key = r.key[len(tagPrefix):]
+		r.tag = true
+	} else if strings.HasPrefix(r.key, statePrefix) {
+		if r.op != selExists && r.op != selNotExists {
+			return nil, errors.New("States only support existence: " + term)
+		}
+		r.key = r.key[len(statePrefix):]
+		r.state = true
+		if err := validateState(r.key); err != nil || r.key == "" {
+			return nil, errors.New("Invalid state: " + term)
+		}
+	}
+	if !validKey(r.key) {
+		return nil, errors.New("Invalid key: " + term)
+	}
+	return r, nil
+}
+
+// Parses a selector expression. See Selector for the syntax.
+func ParseSelector(expr string) (*Selector, error) {
+	sel := &Selector{expr: strings.TrimSpace(expr)}
+	if sel.expr == "" {
+		return sel, nil
+	}
+	terms, err := splitRequirements(sel.expr)
+	if err != nil {
+		return nil, errors.New("Invalid selector: " + err.Error())
+	}
+	for _, term := range terms {
+		r, err := parseRequirement(strings.TrimSpace(term))
+		if err != nil {
+			return nil, errors.New("Invalid selector: " + err.Error())
+		}
+		sel.requirements = append(sel.requirements, r)
+	}
+	return sel, nil
+}
+
+func (r *requirement) matches(service *ServiceDef) bool {
+	if r.state {
+		return (service.state() == r.key) == (r.op == selExists)
+	}
+	if r.tag {
+		found := false
+		for _, tag := range service.Tags {
+			if tag == r.key {
+				found = true
+				break
+			}
+		}
+		return found == (r.op == selExists)
+	}
+	value, found := service.Labels[r.key]
+	switch r.op {
+	case selExists:
+		return found
+	case selNotExists:
+		return !found
+	}
+	in := false
+	if found {
+		for _, v := range r.values {
+			if v == value {
+				in = true
+				break
+			}
+		}
+	}
+	return in == (r.op == selEquals || r.op == selIn)
+}
+
+// Returns true if service meets every requirement. A nil selector matches
+// every service.
+func (sel *Selector) Matches(service *ServiceDef) bool {
+	if sel == nil {
+		return true
+	}
+	for _, r := range sel.requirements {
+		if !r.matches(service) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the expression the selector was parsed from.
+func (sel *Selector) String() string {
+	if sel == nil {
+		return ""
+	}
+	return sel.expr
+}
+
+// Removes the services that do not match from services, in place.
+func (sel *Selector) filter(services []*ServiceDef) []*ServiceDef {
+	if sel == nil || len(sel.requirements) == 0 {
+		return services
+	}
+	selected := services[:0]
+	for _, service := range services {
+		if sel.Matches(service) {
+			selected = append(selected, service)
+		}
+	}
+	return selected
+}
+
+// Returns the method a watcher using the selector is sent change c with, or
+// false if it is not sent at all. A service that stops matching when it joins
+// again with new labels, or changes state, leaves the selection.
+func (sel *Selector) change(c *change) (string, bool) {
+	if sel == nil || len(sel.requirements) == 0 {
+		return c.method, true
+	}
+	if sel.Matches(c.service) {
+		return c.method, true
+	}
+	if c.method == "DiscoveryClient.Join" && c.prev != nil &&
+		!c.prev.Unhealthy && sel.Matches(c.prev) {
+		return "DiscoveryClient.Leave", true
+	}
+	return "", false
+}
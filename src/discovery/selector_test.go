@@ -0,0 +1,82 @@
+package discovery
+
+import "testing"
+
+func TestSelectorMatches(t *testing.T) {
+	service := &ServiceDef{Host: "a", Group: "g",
+		Labels: map[string]string{"zone": "a", "version": "1.2"},
+		Tags:   []string{"canary"}}
+	tests := []struct {
+		expr    string
+		matches bool
+	}{
+		{"", true},
+		{"zone=a", true},
+		{"zone==a", true},
+		{"zone = b", false},
+		{"zone!=b", true},
+		{"zone!=a", false},
+		{"missing!=a", true},
+		{"zone in (b, a)", true},
+		{"zone in (b,c)", false},
+		{"zone notin (b,c)", true},
+		{"missing notin (a)", true},
+		{"version", true},
+		{"missing", false},
+		{"!missing", true},
+		{"!version", false},
+		{"tag:canary", true},
+		{"!tag:canary", false},
+		{"tag:blue", false},
+		{"zone in (a,b),version=1.2,tag:canary", true},
+		{"zone in (a,b),version=1.3", false},
+		{"state:active", true},
+		{"!state:active", false},
+		{"state:draining", false},
+		{"!state:maintenance", true},
+	}
+	for _, test := range tests {
+		sel, err := ParseSelector(test.expr)
+		if err != nil {
+			t.Error(test.expr, err)
+			continue
+		}
+		if sel.Matches(service) != test.matches {
+			t.Error("Wrong match", test.expr, test.matches)
+		}
+	}
+}
+
+func TestParseSelectorErrors(t *testing.T) {
+	for _, expr := range []string{"=a", "zone in (a", "zone in a)",
+		"zone is (a)", "zone in ((a))", "a,,b", "tag:x=y", "!", "a b",
+		"state:asleep", "state:active=x", "state:"} {
+		if _, err := ParseSelector(expr); err == nil {
+			t.Error("Expected an error", expr)
+		}
+	}
+}
+
+func TestSelectorChange(t *testing.T) {
+	sel, _ := ParseSelector("zone=a")
+	inA := &ServiceDef{Host: "h", Labels: map[string]string{"zone": "a"}}
+	inB := &ServiceDef{Host: "h", Labels: map[string]string{"zone": "b"}}
+	tests := []struct {
+		c      change
+		method string
+		ok     bool
+	}{
+		{change{"DiscoveryClient.Join", inA, nil}, "DiscoveryClient.Join", true},
+		{change{"DiscoveryClient.Join", inB, nil}, "", false},
+		{change{"DiscoveryClient.Join", inB, inA}, "DiscoveryClient.Leave", true},
+		{change{"DiscoveryClient.Join", inA, inB}, "DiscoveryClient.Join", true},
+		{change{"DiscoveryClient.Leave", inA, nil}, "DiscoveryClient.Leave", true},
+		{change{"DiscoveryClient.Leave", inB, nil}, "", false},
+	}
+	for i, test := range tests {
+		method, ok := sel.change(&test.c)
+		if method != test.method || ok != test.ok {
+			t.Error("Wrong change", i, method, ok)
+		}
+	}
+}
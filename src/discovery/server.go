@@ -1,161 +1,706 @@
 package discovery
 
 import (
-	"container/list"
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/rpc"
-	"net/rpc/jsonrpc"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// How often leases are checked for expiration.
+const leaseCheckInterval = time.Second
+
+// How long Serve gives Shutdown once its context is done. Variable so tests
+// can shorten it.
+var shutdownTimeout = 10 * time.Second
+
+// Returned by Serve once the server is shut down.
+var ErrServerClosed = errors.New("Server closed")
+
 type Server struct {
-	connections list.List
 	services    serviceList
 	eventChan   chan func()
 	servicePool chan *Discovery
 	nextConnId  int32
-	watchers    map[string](map[*rpc.Client]bool)
+	watchers    map[string](map[*watcher]*subscription)
+	// Revision of the last change to each group with services.
+	groupRevisions map[string]uint64
+	// Returns the current time. Replaced in tests.
+	now func() time.Time
+	// Records persistent services. nil unless OpenStore is called.
+	store           *store
+	compactInterval time.Duration
+	// Replicates changes to the other members of the cluster. nil unless
+	// StartCluster is called.
+	cluster *raftNode
+	// Mutual TLS configuration of the connections between cluster members.
+	// nil unless SetClusterTLSConfig is called.
+	clusterTLS *tls.Config
+	// Closed once the server is ready to handle connections.
+	ready chan bool
+	// Incremented for every renewal of a lease.
+	leaseSeq uint64
+	// When set, services may only be joined and left by connections with a
+	// client certificate valid for the service's host.
+	verifyHost bool
+	// Decides which connections may use which groups. nil allows everything.
+	policy *Policy
+	// When set, connections must authenticate with a token before any other
+	// request unless they present a client certificate.
+	tokens TokenVerifier
+	// Revision of the last change to the registry.
+	revision uint64
+	history  *history
+	// In a cluster, the revisions of the changes made by the entry being
+	// applied are above this one.
+	revisionBase uint64
+
+	// When set, Shutdown removes the services of the open connections before
+	// closing them.
+	leaveOnShutdown bool
+	// Set in the event loop to make processEvents return.
+	stopped bool
+	// Starts the event loop of Serve once.
+	loopOnce sync.Once
+	// Connection handlers started by Serve.
+	handlers sync.WaitGroup
+	// Health checks started by runChecks, which run until checkCtx is done.
+	checks       sync.WaitGroup
+	checkCtx     context.Context
+	cancelChecks context.CancelFunc
+	// Closed once Shutdown is over.
+	shutdownDone chan bool
+
+	// Open connections by connection id. Guarded by connLock, as are the fields
+	// below.
+	connLock sync.Mutex
+	conns    map[int32]*Discovery
+	// Listeners Serve accepts connections on.
+	listeners map[net.Listener]bool
+	// Closed when Shutdown starts.
+	done chan bool
 }
 
-func (s *Server) snapshot(group string) *list.List {
-	log.Printf("Snapshot: '%s'\n", group)
-	var services list.List
+// Opens the store in dir and loads the persistent services it contains. The
+// store is compacted every compactInterval. Must be called before Serve.
+func (s *Server) OpenStore(dir string, compactInterval time.Duration) error {
+	store, err := openStore(dir, &s.services)
+	if err != nil {
+		return err
+	}
+	log.Printf("Loaded %d services from %s\n", s.services.Len(), dir)
+	// Leases are not stored. Restored services get a new one so those with a
+	// TTL expire unless they are renewed.
 	iter := s.services.Iterator()
-	for {
-		service := iter.Next()
-		if service == nil {
-			break
+	for service := iter.Next(); service != nil; service = iter.Next() {
+		s.renew(service)
+		service.joined = service.lease
+	}
+	s.store = store
+	s.compactInterval = compactInterval
+	return nil
+}
+
+// When verify is true, services may only be joined and left over TLS
+// connections whose client certificate is valid for the host of the service.
+// Use with mutual TLS. Must be called before Serve.
+func (s *Server) SetVerifyHost(verify bool) {
+	s.verifyHost = verify
+}
+
+// Secures the connections between cluster members with config, typically the
+// configuration of Serve from NewServerTLSConfig. config must verify client
+// certificates: members only accept connections from members whose
+// certificate is valid for the host of a member in peers, and check that the
+// member they connect to has a certificate valid for its host. Must be called
+// before StartCluster.
+func (s *Server) SetClusterTLSConfig(config *tls.Config) error {
+	if config.ClientCAs == nil ||
+		config.ClientAuth != tls.RequireAndVerifyClientCert {
+		return errors.New("Cluster TLS requires client certificates")
+	}
+	s.clusterTLS = config
+	return nil
+}
+
+// Only lets connections use the groups policy allows them to. Must be called
+// before Serve.
+func (s *Server) SetPolicy(policy *Policy) {
+	s.policy = policy
+}
+
+// Requires connections to authenticate with a token verified by verifier
+// before any other request. Connections that do not authenticate in time are
+// closed. Connections with a verified client certificate are authenticated by
+// it. Must be called before Serve.
+func (s *Server) SetTokenVerifier(verifier TokenVerifier) {
+	s.tokens = verifier
+}
+
+// When leave is true, Shutdown removes the services joined by the open
+// connections, except persistent ones, and gives watchers the time to be told
+// before closing the connections. Otherwise watchers only notice the shutdown
+// when their connection closes, and clients that reconnect keep their view of
+// the groups. Ignored in a cluster, where the other members remove the services
+// once the connections close. Must be called before Serve.
+func (s *Server) SetLeaveOnShutdown(leave bool) {
+	s.leaveOnShutdown = leave
+}
+
+// Sets how many changes are kept for watchers resuming from a revision. Must be
+// called before Serve.
+func (s *Server) SetHistorySize(size int) {
+	s.history = newHistory(size, s.revision)
+}
+
+// Starts numbering changes after revision and forgets the history.
+func (s *Server) startRevisions(revision uint64) {
+	s.revision = revision
+	s.history = newHistory(cap(s.history.changes), revision)
+	s.groupRevisions = make(map[string]uint64)
+}
+
+// Records a change to service and sends it to the watchers of its group, and of
+// the prefixes above it, whose subscription it concerns. prev is the definition
+// a joining service replaced.
+//
+// Sets the revision of service, which must not have been returned by a
+// snapshot yet: snapshots are serialized outside the event loop. Changes to a
+// registered service replace it with a modified copy instead.
+func (s *Server) publish(method string, service, prev *ServiceDef) {
+	if s.revision < s.revisionBase {
+		s.revision = s.revisionBase
+	}
+	s.revision++
+	service.Revision = s.revision
+	s.history.add(method, service, prev)
+	if s.services.GroupLen(service.Group) > 0 {
+		s.groupRevisions[service.Group] = s.revision
+	} else {
+		delete(s.groupRevisions, service.Group)
+	}
+	s.notify(method, service, prev)
+}
+
+// Sends a change to service to the watchers whose subscription it concerns,
+// without recording it.
+func (s *Server) notify(method string, service, prev *ServiceDef) {
+	c := &change{method, service, prev}
+	for _, group := range groupAndPrefixes(service.Group) {
+		for w, sub := range s.watchers[group] {
+			if method, ok := sub.change(c); ok {
+				w.send(method, service)
+			}
 		}
-		// Services are ordered by group first so once we go beyond a group, we
-		// don't need to keep iterating.
-		diff := strcmp(service.Group, group)
-		if diff > 0 {
-			break
-		} else if diff == 0 {
-			services.PushBack(service)
+	}
+}
+
+// Sends the changes to group after revision that concern sub to w. Returns
+// false if the history no longer holds all of them.
+func (s *Server) replay(group string, revision uint64, w *watcher,
+	sub *subscription) bool {
+	if revision > s.revision {
+		// Not a revision of this server.
+		return false
+	}
+	changes, ok := s.history.after(group, revision)
+	if !ok {
+		return false
+	}
+	for i := range changes {
+		if method, ok := sub.change(&changes[i]); ok {
+			w.send(method, changes[i].service)
+		}
+	}
+	return true
+}
+
+// Records a change to a persistent service if the store is open.
+func (s *Server) persist(op string, service *ServiceDef) {
+	if s.store == nil {
+		return
+	}
+	if err := s.store.append(op, service); err != nil {
+		log.Println("Error writing to store:", err)
+	}
+}
+
+func (s *Server) compact() {
+	if err := s.store.compact(&s.services); err != nil {
+		log.Println("Error compacting store:", err)
+	}
+}
+
+// Returns the healthy services in group, or in every group under the prefix
+// group.
+func (s *Server) snapshot(group string) []*ServiceDef {
+	log.Printf("Snapshot: '%s'\n", group)
+	healthy := make([]*ServiceDef, 0, s.services.GroupLen(group))
+	s.services.ForEach(group, func(service *ServiceDef) {
+		if !service.Unhealthy {
+			healthy = append(healthy, service)
+		}
+	})
+	return healthy
+}
+
+// Returns the groups starting with prefix for which allow, when set, returns
+// true.
+func (s *Server) listGroups(prefix string,
+	allow func(group string) bool) []*GroupInfo {
+	groups := []*GroupInfo{}
+	for _, name := range s.services.Groups(prefix) {
+		if allow != nil && !allow(name) {
+			continue
 		}
+		info := &GroupInfo{Name: name, Revision: s.groupRevisions[name]}
+		s.services.ForEach(name, func(service *ServiceDef) {
+			if service.Unhealthy {
+				info.Unhealthy++
+			} else {
+				info.Services++
+			}
+			// Services loaded from a store or a cluster snapshot changed before
+			// the revisions of this server.
+			if service.Revision > info.Revision {
+				info.Revision = service.Revision
+			}
+		})
+		groups = append(groups, info)
 	}
-	return &services
+	return groups
+}
+
+// Renews the lease of the service. Must be called in the event loop.
+func (s *Server) renew(service *ServiceDef) {
+	s.leaseSeq++
+	service.lease = s.leaseSeq
+	service.renew(s.now())
 }
 
 func (s *Server) join(service *ServiceDef) bool {
+	// Services are healthy until their check fails.
+	service.Unhealthy = false
+	s.renew(service)
+	service.joined = service.lease
+	old := s.services.Find(service)
 	if !s.services.Add(service) {
 		return false
 	}
-	log.Println("Join:", service.toString())
-	clients, ok := s.watchers[service.Group]
-	if ok {
-		for client := range clients {
-			// Although client.Go does not wait for the response, it does block
-			// sending the request. Invoke the Go method in a separate go routine to
-			// not block.
-			go client.Go("DiscoveryClient.Join", service, &Void{}, nil)
-		}
+	if service.Persistent {
+		s.persist(storeJoin, service)
+	} else if old != nil && old.Persistent {
+		s.persist(storeLeave, old)
 	}
+	log.Println("Join:", service.toString())
+	s.publish("DiscoveryClient.Join", service, old)
 	return true
 }
 
 func (s *Server) leave(service *ServiceDef) bool {
+	old := s.services.Find(service)
 	if !s.services.Remove(service) {
 		return false
 	}
-	s.sendLeave(service)
+	if old.Persistent {
+		s.persist(storeLeave, old)
+	}
+	s.sendLeave(old)
 	return true
 }
 
+// Publishes the leave of a removed service. Snapshots already taken may still
+// hold the definition, the leave gets a copy.
 func (s *Server) sendLeave(service *ServiceDef) {
 	log.Println("Leave:", service.toString())
-	clients, ok := s.watchers[service.Group]
-	if ok {
-		for client := range clients {
-			// Although client.Go does not wait for the response, it does block
-			// sending the request. Invoke the Go method in a separate go routine to
-			// not block.
-			go client.Go("DiscoveryClient.Leave", service, &Void{}, nil)
+	left := *service
+	s.publish("DiscoveryClient.Leave", &left, nil)
+}
+
+// Extends the lease of a service attached to the same connection. Returns false
+// if the service is not found.
+func (s *Server) heartbeat(service *ServiceDef) bool {
+	e := s.services.Find(service)
+	if e == nil || !e.ownedBy(service.connId) {
+		return false
+	}
+	s.renew(e)
+	return true
+}
+
+// Removes all services whose lease has expired at the given time. In a cluster
+// only the leader expires services, by submitting a command for each.
+func (s *Server) expire(now time.Time) {
+	if s.cluster != nil && !s.cluster.isLeader() {
+		return
+	}
+	iter := s.services.Iterator()
+	for {
+		service := iter.Next()
+		if service == nil {
+			break
+		}
+		if s.cluster != nil {
+			if service.expired(now) && service.expiring != service.lease {
+				service.expiring = service.lease
+				s.submitAsync(&command{
+					Op: cmdExpire,
+					Service: &ServiceDef{
+						Host: service.Host, Port: service.Port, Group: service.Group},
+					Lease: service.lease})
+			}
+			continue
+		}
+		if service.expired(now) {
+			iter.Remove()
+			if service.Persistent {
+				s.persist(storeLeave, service)
+			}
+			log.Println("Expired:", service.toString())
+			s.sendLeave(service)
 		}
 	}
 }
 
 func (s *Server) removeAll(d *Discovery) {
-	// Get rid of any watchers on this connection.
-	if d.client != nil {
+	s.removeWatchers(d)
+	s.removeServices(s.services.Connection(d.id))
+}
+
+// Get rid of any watchers on this connection.
+func (s *Server) removeWatchers(d *Discovery) {
+	if d.watcher != nil {
 		for group, val := range s.watchers {
-			delete(val, d.client)
+			delete(val, d.watcher)
 			if len(val) == 0 {
 				delete(s.watchers, group)
 			}
 		}
+		d.watcher.close()
 	}
+}
 
-	iter := s.services.Iterator()
-	for {
-		service := iter.Next()
-		if service == nil {
-			break
+// Removes the given services. Persistent services outlive the connection and
+// are never removed.
+func (s *Server) removeServices(services []*ServiceDef) {
+	for _, service := range services {
+		if !service.Persistent && s.services.Remove(service) {
+			s.sendLeave(service)
 		}
-		// Not the right connection id, just keep iterating.
-		if service.connId != d.id {
-			continue
-		}
-		iter.Remove()
-		s.sendLeave(service)
 	}
 }
 
-func (s *Server) watch(group string, client *rpc.Client) {
+// Registers w as a watcher of the services in group, or under the prefix group,
+// that sub concerns. A nil subscription concerns every service.
+func (s *Server) watch(group string, w *watcher, sub *subscription) {
 	m, ok := s.watchers[group]
 	if !ok {
-		s.watchers[group] = make(map[*rpc.Client]bool)
+		s.watchers[group] = make(map[*watcher]*subscription)
 		m = s.watchers[group]
 	}
-	m[client] = true
+	m[w] = sub
 }
 
-func (s *Server) ignore(group string, client *rpc.Client) {
+// Returns the subscription of principal to the services in group matching
+// selector. Returns an error if the selector is not valid.
+func (s *Server) subscribe(principal, op, group, selector string) (
+	*subscription, error) {
+	sel, err := ParseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	sub := &subscription{selector: sel}
+	// The policy may treat the groups under a prefix differently than the
+	// prefix itself.
+	if isPrefix(group) && s.policy != nil {
+		sub.allow = func(name string) bool {
+			return s.policy.check(principal, op, name) == nil
+		}
+	}
+	return sub, nil
+}
+
+// Registers w as a watcher of args.Group for principal and fills in snapshot.
+// When the changes after args.Revision can be replayed to w instead, snapshot
+// is only marked Resumed. Returns an error if args.Selector is not valid. Must
+// be called in the event loop.
+func (s *Server) startWatch(args *WatchArgs, principal string, w *watcher,
+	snapshot *Snapshot) error {
+	sub, err := s.subscribe(principal, opWatch, args.Group, args.Selector)
+	if err != nil {
+		return err
+	}
+	s.watch(args.Group, w, sub)
+	snapshot.Revision = s.revision
+	if args.Revision > 0 && s.replay(args.Group, args.Revision, w, sub) {
+		snapshot.Resumed = true
+		return nil
+	}
+	snapshot.Services = sub.filter(s.snapshot(args.Group))
+	return nil
+}
+
+func (s *Server) ignore(group string, w *watcher) {
 	if m, ok := s.watchers[group]; ok {
-		delete(m, client)
+		delete(m, w)
 		if len(m) == 0 {
 			delete(s.watchers, group)
 		}
 	}
 }
 
+// Revisions start at the Unix time in milliseconds shifted by
+// revisionTimeShift. They stay below 2^53, so JavaScript clients read them
+// exactly, and keep increasing across restarts unless a server makes more than
+// 2^10 changes per millisecond of uptime.
+const revisionTimeShift = 10
+
 func NewServer() *Server {
+	ready := make(chan bool)
+	close(ready)
+	// Revisions start at the current time so they keep increasing across
+	// restarts and a watcher never resumes from a revision of an earlier run.
+	revision := uint64(time.Now().UnixMilli()) << revisionTimeShift
+	checkCtx, cancelChecks := context.WithCancel(context.Background())
 	return &Server{
 		// TODO(pscott): Add flags for event and service buffer size.
-		eventChan:   make(chan func(), 1024),
-		servicePool: make(chan *Discovery, 128),
-		watchers:    make(map[string]map[*rpc.Client]bool)}
+		eventChan:      make(chan func(), 1024),
+		servicePool:    make(chan *Discovery, 128),
+		watchers:       make(map[string]map[*watcher]*subscription),
+		groupRevisions: make(map[string]uint64),
+		now:            time.Now,
+		ready:          ready,
+		revision:       revision,
+		history:        newHistory(DefaultHistorySize, revision),
+		shutdownDone:   make(chan bool),
+		conns:          make(map[int32]*Discovery),
+		listeners:      make(map[net.Listener]bool),
+		done:           make(chan bool),
+		checkCtx:       checkCtx,
+		cancelChecks:   cancelChecks}
 }
 
+// Runs the event loop until stopEvents is called.
 func (s *Server) processEvents() {
 	log.Println("Event loop start...")
-	for {
-		(<-s.eventChan)()
+	leaseTicker := time.NewTicker(leaseCheckInterval)
+	defer leaseTicker.Stop()
+	// A nil channel never fires so compaction is disabled without a store.
+	var compactChan <-chan time.Time
+	if s.store != nil && s.compactInterval > 0 {
+		compactTicker := time.NewTicker(s.compactInterval)
+		defer compactTicker.Stop()
+		compactChan = compactTicker.C
 	}
+	for !s.stopped {
+		select {
+		case event := <-s.eventChan:
+			event()
+		case now := <-leaseTicker.C:
+			s.expire(now)
+			s.runChecks(now)
+		case <-compactChan:
+			s.compact()
+		}
+	}
+	log.Println("Event loop stop")
 }
 
-// Listen for connections on the given port.
-func (s *Server) Serve(port uint16) (err error) {
+// Runs the events queued so far, then stops the event loop.
+func (s *Server) stopEvents() {
+	stopped := make(chan bool)
+	s.eventChan <- func() {
+		s.stopped = true
+		close(stopped)
+	}
+	<-stopped
+}
+
+// Listen for connections on the given port until ctx is done or Shutdown is
+// called. Returns ErrServerClosed once the server is shut down.
+func (s *Server) Serve(ctx context.Context, port uint16) (err error) {
 	log.Println("Listening on port", port)
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return
 	}
+	return s.ServeListener(ctx, listener)
+}
 
-	go s.processEvents()
+// Same as Serve but only accepts TLS connections. See NewServerTLSConfig.
+func (s *Server) ServeTLS(
+	ctx context.Context, port uint16, config *tls.Config) (err error) {
+	log.Println("Listening for TLS connections on port", port)
+	listener, err := tls.Listen("tcp", fmt.Sprintf(":%d", port), config)
+	if err != nil {
+		return
+	}
+	return s.ServeListener(ctx, listener)
+}
+
+// Same as Serve but accepts connections on listener, e.g. one listening on a
+// random port in tests. The listener is closed when the server shuts down.
+func (s *Server) ServeListener(
+	ctx context.Context, listener net.Listener) error {
+	s.connLock.Lock()
+	select {
+	case <-s.done:
+		s.connLock.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	default:
+	}
+	s.listeners[listener] = true
+	s.connLock.Unlock()
+	s.loopOnce.Do(func() { go s.processEvents() })
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			ctx, cancel := context.WithTimeout(
+				context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := s.Shutdown(ctx); err != nil &&
+				err != ErrServerClosed {
+				log.Println("Shutdown failed:", err)
+			}
+		case <-s.done:
+		}
+	}()
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			select {
+			case <-s.done:
+				<-s.shutdownDone
+				return ErrServerClosed
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
 			log.Println("Error accepting connection:", err)
 			continue
 		}
-		go s.handleConnection(conn)
+		s.connLock.Lock()
+		select {
+		case <-s.done:
+			// Accepted while shutting down.
+			conn.Close()
+		default:
+			s.handlers.Add(1)
+			go func() {
+				defer s.handlers.Done()
+				s.handleConnection(conn)
+			}()
+		}
+		s.connLock.Unlock()
+	}
+}
+
+// Shuts the server down: stops accepting connections, removes the services of
+// the open connections when SetLeaveOnShutdown was called, closes the
+// connections, waits for them to be cleaned up and runs the events already
+// queued before stopping the event loop, the cluster and the store. If ctx is
+// done first, Shutdown returns its error and the server finishes shutting down
+// in the background without waiting for watchers to be told of the leaves.
+// Returns ErrServerClosed if the server was already shut down.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.connLock.Lock()
+	select {
+	case <-s.done:
+		s.connLock.Unlock()
+		return ErrServerClosed
+	default:
+	}
+	close(s.done)
+	for listener := range s.listeners {
+		listener.Close()
+	}
+	s.connLock.Unlock()
+	log.Println("Shutting down...")
+
+	finished := make(chan error, 1)
+	go func() {
+		defer close(s.shutdownDone)
+		finished <- s.shutdown(ctx)
+	}()
+	select {
+	case err := <-finished:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shuts the server down once it stopped accepting connections. Only telling
+// watchers of the leaves is given up when ctx is done.
+func (s *Server) shutdown(ctx context.Context) error {
+	if s.leaveOnShutdown && s.cluster == nil {
+		if err := s.leaveConnections(ctx); err != nil {
+			log.Println("Watchers not told of every leave:", err)
+		}
+	}
+	s.closeConnections()
+	s.handlers.Wait()
+	if s.cluster != nil {
+		s.cluster.stop()
+	}
+	s.loopOnce.Do(func() { go s.processEvents() })
+	// Checks send their results to the event loop.
+	s.stopChecks()
+	s.stopEvents()
+	if s.store != nil {
+		return s.store.close()
+	}
+	return nil
+}
+
+// Removes the services of the open connections and waits until the watchers
+// were sent the leaves, or ctx is done.
+func (s *Server) leaveConnections(ctx context.Context) error {
+	s.connLock.Lock()
+	conns := make([]*Discovery, 0, len(s.conns))
+	for _, d := range s.conns {
+		conns = append(conns, d)
+	}
+	s.connLock.Unlock()
+
+	flushed := make(chan []<-chan bool, 1)
+	s.eventChan <- func() {
+		for _, d := range conns {
+			s.removeServices(s.services.Connection(d.id))
+		}
+		var chans []<-chan bool
+		for _, watchers := range s.watchers {
+			for w := range watchers {
+				chans = append(chans, w.flushed())
+			}
+		}
+		flushed <- chans
+	}
+	var chans []<-chan bool
+	select {
+	case chans = <-flushed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	for _, c := range chans {
+		select {
+		case <-c:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 	return nil
 }
@@ -183,7 +728,90 @@ func (in *debugInput) Close() error {
 	return in.rwc.Close()
 }
 
+// bufferedConn reads from a buffered reader that may already hold data read
+// from the connection while detecting the protocol.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// Inspects the first byte sent by the client to determine the protocol. Json
+// requests begin with an object while protocol buffer messages begin with a
+// length prefix whose first byte is always 0 given maxMessageSize.
+func detectProtocol(conn net.Conn) (Protocol, net.Conn, error) {
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return JSON, conn, err
+	}
+	protocol := JSON
+	if first[0] == 0 {
+		protocol = Protobuf
+	}
+	return protocol, &bufferedConn{conn, reader}, nil
+}
+
+// Closes every open client connection.
+func (s *Server) closeConnections() {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	for _, d := range s.conns {
+		d.conn.Close()
+	}
+}
+
+// Cleans up after a connection has closed.
+func (s *Server) disconnect(d *Discovery) {
+	removed := make(chan bool)
+	if s.cluster == nil {
+		// Remove any registered services. This must be done in the event loop and
+		// must finish before the service is reused.
+		s.eventChan <- func() {
+			s.removeAll(d)
+			removed <- true
+		}
+		<-removed
+		return
+	}
+
+	s.eventChan <- func() {
+		s.removeWatchers(d)
+		removed <- true
+	}
+	<-removed
+	// Services are removed on every member. Keep trying, e.g. while a new leader
+	// is elected.
+	cmd := &command{Op: cmdDisconnect, ConnId: d.id}
+	go func() {
+		for !s.cluster.isStopped() && s.submit(cmd) != nil {
+			time.Sleep(raftElectionTimeout)
+		}
+	}()
+}
+
 func (s *Server) handleConnection(conn net.Conn) {
+	select {
+	case <-s.ready:
+	case <-s.done:
+		conn.Close()
+		return
+	}
+	cert, err := peerCertificate(conn)
+	if err != nil {
+		log.Println("TLS handshake failed:", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	protocol, conn, err := detectProtocol(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
 	// We create a new server each time so that we can have access to the
 	// underlying connection. The standard rpc package does not give us access
 	// to the calling connection :/
@@ -198,24 +826,59 @@ func (s *Server) handleConnection(conn net.Conn) {
 		service = newDiscoveryService(s)
 	}
 
-	// Set up the service variables.
-	service.init(conn, atomic.AddInt32(&s.nextConnId, 1))
-
 	// If debugging is enabled, log all rpc traffic.
 	var rwc io.ReadWriteCloser = conn
 	if *debug {
 		rwc = &debugInput{conn}
 	}
 
+	// The connection carries requests in both directions. Watch events are sent
+	// to the client using the client codec.
+	serverCodec, clientCodec := newCodecs(rwc, protocol, "Discovery")
+	client := rpc.NewClientWithCodec(clientCodec)
+
+	// Set up the service variables.
+	id := atomic.AddInt32(&s.nextConnId, 1)
+	service.init(conn, id, client)
+	service.cert = cert
+	if cert != nil {
+		// A verified client certificate authenticates the connection.
+		service.principal = cert.Subject.CommonName
+		service.authenticated = true
+		log.Printf("Connection #%d from %s\n", id, cert.Subject.CommonName)
+	} else if s.tokens != nil {
+		// Close connections that do not authenticate in time.
+		timer := time.AfterFunc(authTimeout, func() {
+			if _, ok := service.identity(); !ok {
+				log.Printf("Connection #%d did not authenticate\n", id)
+				conn.Close()
+			}
+		})
+		defer timer.Stop()
+	}
+	s.connLock.Lock()
+	select {
+	case <-s.done:
+		// Closed right away, Shutdown may already have closed the others.
+		conn.Close()
+	default:
+	}
+	s.conns[id] = service
+	s.connLock.Unlock()
+
 	// Set up the rpc service and start serving the connection.
 	server.Register(service)
-	server.ServeCodec(jsonrpc.NewServerCodec(rwc))
+	server.ServeCodec(serverCodec)
+	client.Close()
 
+	s.connLock.Lock()
+	delete(s.conns, id)
+	s.connLock.Unlock()
 	// Connection has disconnected. Remove any registered services.
-	s.removeAll(service)
+	s.disconnect(service)
 
 	// Reset the service state.
-	service.init(nil, -1)
+	service.init(nil, -1, nil)
 
 	select {
 	case s.servicePool <- service:
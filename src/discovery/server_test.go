@@ -1,11 +1,15 @@
 package discovery
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"net"
 	"net/rpc"
 	"net/rpc/jsonrpc"
+	"os"
 	"testing"
 	"time"
 )
@@ -13,7 +17,7 @@ import (
 func TestServerSnapshot(t *testing.T) {
 	server := NewServer()
 	result := server.snapshot("group")
-	if result.Len() != 0 {
+	if len(result) != 0 {
 		t.Error("Empty services list should return empty list")
 	}
 
@@ -21,24 +25,24 @@ func TestServerSnapshot(t *testing.T) {
 	server.services.Add(&ServiceDef{Host: "host2", Group: "group2"})
 
 	result = server.snapshot("group")
-	if result.Len() != 0 {
+	if len(result) != 0 {
 		t.Error("group snapshot is not empty")
 	}
 
 	result = server.snapshot("group1")
-	if result.Len() != 1 {
-		t.Error("group1 snapshot should be a single entry", result.Len())
+	if len(result) != 1 {
+		t.Error("group1 snapshot should be a single entry", len(result))
 	}
-	service := result.Front().Value.(*ServiceDef)
+	service := result[0]
 	if service.Host != "host1" || service.Group != "group1" {
 		t.Error("group1 entry has wrong values", service)
 	}
 
 	result = server.snapshot("group2")
-	if result.Len() != 1 {
-		t.Error("group2 snapshot should be a single entry", result.Len())
+	if len(result) != 1 {
+		t.Error("group2 snapshot should be a single entry", len(result))
 	}
-	service = result.Front().Value.(*ServiceDef)
+	service = result[0]
 	if service.Host != "host2" || service.Group != "group2" {
 		t.Error("group2 entry has wrong values", service)
 	}
@@ -72,7 +76,7 @@ func TestServerJoin(t *testing.T) {
 	impl := &testClientImpl{signal: make(chan int)}
 	read, write := net.Pipe()
 	serveTestImpl(impl, read)
-	server.watch("group1", jsonrpc.NewClient(write))
+	server.watch("group1", newWatcher(jsonrpc.NewClient(write), write), nil)
 
 	if !server.join(&ServiceDef{Host: "h", Group: "group1"}) {
 		t.Error("Server join failed")
@@ -111,7 +115,7 @@ func TestServerLeave(t *testing.T) {
 	impl := &testClientImpl{signal: make(chan int)}
 	read, write := net.Pipe()
 	serveTestImpl(impl, read)
-	server.watch("group1", jsonrpc.NewClient(write))
+	server.watch("group1", newWatcher(jsonrpc.NewClient(write), write), nil)
 
 	if server.leave(&ServiceDef{Host: "host", Group: "group1"}) {
 		t.Error("Server leave should have failed")
@@ -159,8 +163,8 @@ func TestServerRemoveAll(t *testing.T) {
 	server.join(&ServiceDef{Host: "host", Group: "group1"})
 
 	_, write := net.Pipe()
-	client := jsonrpc.NewClient(write)
-	server.watch("group", client)
+	w := newWatcher(jsonrpc.NewClient(write), write)
+	server.watch("group", w, nil)
 
 	// Does not do anything.
 	server.removeAll(&Discovery{id: 2})
@@ -172,7 +176,7 @@ func TestServerRemoveAll(t *testing.T) {
 	}
 
 	// Removes 4 services and the only watcher.
-	server.removeAll(&Discovery{client: client, id: 0})
+	server.removeAll(&Discovery{watcher: w, id: 0})
 	if len(server.watchers) != 0 {
 		t.Error("Watchers is not empty", len(server.watchers))
 	}
@@ -192,7 +196,7 @@ func BenchmarkServerSnapshot(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		server.services.Add(
 			&ServiceDef{Host: "host", Port: uint16(i), Group: "group"})
-		if server.snapshot("group").Len() != i+1 {
+		if len(server.snapshot("group")) != i+1 {
 			b.Error("Wrong snapshot size")
 		}
 	}
@@ -212,3 +216,409 @@ func BenchmarkServerRemoveAll(b *testing.B) {
 		server.removeAll(&Discovery{})
 	}
 }
+
+// Snapshot of a single group among 10000 services.
+func BenchmarkServerSnapshotLarge(b *testing.B) {
+	server := NewServer()
+	fillServiceList(&server.services, 100, 100, 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		server.snapshot("group50")
+	}
+}
+
+// Disconnect of a connection with 10 services among 10000 services.
+func BenchmarkServerRemoveAllLarge(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	server := NewServer()
+	fillServiceList(&server.services, 100, 100, 1000)
+	services := server.services.Connection(0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		server.removeAll(&Discovery{})
+		b.StopTimer()
+		for _, service := range services {
+			server.services.Add(service)
+		}
+		b.StartTimer()
+	}
+}
+
+func testServerWatchConnection(t *testing.T, protocol Protocol) {
+	server := NewServer()
+	go server.processEvents()
+
+	// Serve DiscoveryClient on the same connection used to call Watch.
+	read, write := net.Pipe()
+	go server.handleConnection(read)
+	serverCodec, clientCodec := newCodecs(write, protocol, "DiscoveryClient")
+	impl := &testClientImpl{signal: make(chan int)}
+	rpcServer := rpc.NewServer()
+	rpcServer.RegisterName("DiscoveryClient", impl)
+	go rpcServer.ServeCodec(serverCodec)
+	watcher := rpc.NewClientWithCodec(clientCodec)
+	defer watcher.Close()
+
+	var snapshot Snapshot
+	err := watcher.Call("Discovery.WatchGroup", &WatchArgs{Group: "group"},
+		&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := connectTestClient(server, protocol)
+	defer client.Close()
+	def := &ServiceDef{Host: "host", Port: 1, Group: "group"}
+	if err := client.Join(def); err != nil {
+		t.Fatal(err)
+	}
+	<-impl.signal
+	if impl.join == nil || impl.join.Host != "host" || impl.join.Port != 1 {
+		t.Error("Wrong join event", impl.join)
+	}
+
+	if err := client.Leave(def); err != nil {
+		t.Fatal(err)
+	}
+	<-impl.signal
+	if impl.leave == nil || impl.leave.Host != "host" ||
+		impl.leave.Group != "group" {
+		t.Error("Wrong leave event", impl.leave)
+	}
+}
+
+func TestServerWatchConnectionJSON(t *testing.T) {
+	testServerWatchConnection(t, JSON)
+}
+
+func TestServerWatchConnectionProtobuf(t *testing.T) {
+	testServerWatchConnection(t, Protobuf)
+}
+
+// Clients written before revisions send a group name to Snapshot and Watch.
+func TestServerLegacyMethods(t *testing.T) {
+	server := NewServer()
+	go server.processEvents()
+	read, write := net.Pipe()
+	go server.handleConnection(read)
+	serverCodec, clientCodec := newCodecs(write, JSON, "DiscoveryClient")
+	impl := &testClientImpl{signal: make(chan int)}
+	rpcServer := rpc.NewServer()
+	rpcServer.RegisterName("DiscoveryClient", impl)
+	go rpcServer.ServeCodec(serverCodec)
+	legacy := rpc.NewClientWithCodec(clientCodec)
+	defer legacy.Close()
+
+	client := connectTestClient(server, JSON)
+	defer client.Close()
+	client.Join(&ServiceDef{Host: "a", Group: "group"})
+	var services []*ServiceDef
+	err := legacy.Call("Discovery.Snapshot", "group", &services)
+	if err != nil || len(services) != 1 || services[0].Host != "a" {
+		t.Error("Wrong snapshot", services, err)
+	}
+	if err = legacy.Call("Discovery.Watch", "group", &Void{}); err != nil {
+		t.Error(err)
+	}
+	client.Join(&ServiceDef{Host: "b", Group: "group"})
+	<-impl.signal
+	if impl.join == nil || impl.join.Host != "b" {
+		t.Error("Wrong join event", impl.join)
+	}
+}
+
+type closeFunc func() error
+
+func (f closeFunc) Close() error { return f() }
+
+// A watcher that does not acknowledge an event in time is disconnected.
+func TestServerWatcherTimeout(t *testing.T) {
+	defer func(timeout time.Duration) {
+		watcherCallTimeout = timeout
+	}(watcherCallTimeout)
+	watcherCallTimeout = 100 * time.Millisecond
+
+	// Nothing reads impl.signal so the client never answers.
+	impl := &testClientImpl{signal: make(chan int)}
+	read, write := net.Pipe()
+	serveTestImpl(impl, read)
+	failed := make(chan bool)
+	w := newWatcher(jsonrpc.NewClient(write), closeFunc(func() error {
+		close(failed)
+		return write.Close()
+	}))
+	w.send("DiscoveryClient.Join", &ServiceDef{Host: "host", Group: "group"})
+	select {
+	case <-failed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watcher did not time out")
+	}
+}
+
+// A watcher that falls too far behind is dropped.
+func TestServerWatcherOverflow(t *testing.T) {
+	block := make(chan bool)
+	defer close(block)
+	failed := 0
+	w := newEventWatcher(func(event *watchEvent) error {
+		<-block
+		return nil
+	}, func() { failed++ })
+	w.queueSize = 4
+	// One event is being delivered, the others are queued.
+	for i := 0; i < w.queueSize+2; i++ {
+		w.send("DiscoveryClient.Join", &ServiceDef{Host: "host", Group: "g"})
+	}
+	if failed != 1 {
+		t.Error("Watcher should have failed once", failed)
+	}
+	if _, ok := w.next(); ok {
+		t.Error("Watcher still open")
+	}
+}
+
+// Snapshots already returned are serialized outside the event loop, a leave
+// must not change their revision.
+func TestServerLeaveCopy(t *testing.T) {
+	server := NewServer()
+	go server.processEvents()
+	var snapshot []*ServiceDef
+	var revision uint64
+	server.run(func() error {
+		server.join(&ServiceDef{Host: "h", Port: 1, Group: "g"})
+		snapshot = server.snapshot("g")
+		revision = snapshot[0].Revision
+		server.leave(&ServiceDef{Host: "h", Port: 1, Group: "g"})
+		return nil
+	})
+	if snapshot[0].Revision != revision {
+		t.Error("Snapshot changed", snapshot[0].Revision, revision)
+	}
+}
+
+// The HTTP API sends revisions as JSON numbers, which JavaScript reads exactly
+// only below 2^53.
+func TestServerRevisionFitsJavaScript(t *testing.T) {
+	server := NewServer()
+	if server.revision == 0 || server.revision >= 1<<53 {
+		t.Error("Revision out of range", server.revision)
+	}
+}
+
+func TestServerExpire(t *testing.T) {
+	server := NewServer()
+	impl := &testClientImpl{signal: make(chan int)}
+	read, write := net.Pipe()
+	serveTestImpl(impl, read)
+	server.watch("group", newWatcher(jsonrpc.NewClient(write), write), nil)
+
+	now := time.Now()
+	server.now = func() time.Time { return now }
+	server.join(&ServiceDef{Host: "forever", Group: "group"})
+	server.join(&ServiceDef{Host: "leased", Group: "group", TTL: 10})
+	<-impl.signal
+	<-impl.signal
+
+	server.expire(now.Add(5 * time.Second))
+	if server.services.Len() != 2 {
+		t.Error("Lease expired early", server.services.Len())
+	}
+
+	now = now.Add(5 * time.Second)
+	if !server.heartbeat(&ServiceDef{Host: "leased", Group: "group"}) {
+		t.Error("Heartbeat failed")
+	}
+	if server.heartbeat(&ServiceDef{Host: "leased", Group: "group", connId: 1}) {
+		t.Error("Heartbeat from a different connection should fail")
+	}
+	if server.heartbeat(&ServiceDef{Host: "unknown", Group: "group"}) {
+		t.Error("Heartbeat of an unknown service should fail")
+	}
+
+	server.expire(now.Add(6 * time.Second))
+	if server.services.Len() != 2 {
+		t.Error("Heartbeat did not renew the lease")
+	}
+
+	server.expire(now.Add(11 * time.Second))
+	if server.services.Len() != 1 || server.services.Get(0).Host != "forever" {
+		t.Error("Lease did not expire")
+	}
+	<-impl.signal
+	if impl.leave == nil || impl.leave.Host != "leased" {
+		t.Error("Expiration did not send a leave", impl.leave)
+	}
+}
+
+func TestServerPersistent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := NewServer()
+	if err = server.OpenStore(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	server.join(&ServiceDef{Host: "p1", Group: "group", Persistent: true})
+	server.join(&ServiceDef{Host: "p2", Group: "group", Persistent: true})
+	server.join(&ServiceDef{Host: "p3", Group: "group", Persistent: true,
+		TTL: 10})
+	server.join(&ServiceDef{Host: "e", Group: "group"})
+
+	// Persistent services outlive the connection.
+	server.removeAll(&Discovery{id: 0})
+	if server.services.Len() != 3 {
+		t.Error("Wrong number of services", server.services.Len())
+	}
+
+	// Any connection may remove a persistent service.
+	if !server.leave(&ServiceDef{Host: "p1", Group: "group", connId: 5}) {
+		t.Error("Leave of persistent service failed")
+	}
+	server.store.close()
+
+	server = NewServer()
+	if err = server.OpenStore(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer server.store.close()
+	if server.services.Len() != 2 || server.services.Get(0).Host != "p2" {
+		t.Error("Wrong services after restart", server.services.Len())
+	}
+
+	// Restored services with a TTL still expire.
+	server.expire(time.Now().Add(11 * time.Second))
+	if server.services.Len() != 1 || server.services.Get(0).Host != "p2" {
+		t.Error("Restored lease did not expire", server.services.Len())
+	}
+}
+
+// Serves server on a random port. The returned channel receives the result of
+// Serve.
+func serveTestServer(ctx context.Context, t *testing.T, server *Server) (
+	uint16, chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(chan error, 1)
+	go func() { result <- server.ServeListener(ctx, listener) }()
+	return uint16(listener.Addr().(*net.TCPAddr).Port), result
+}
+
+func TestServerShutdown(t *testing.T) {
+	server := NewServer()
+	ctx, cancel := context.WithCancel(context.Background())
+	port, result := serveTestServer(ctx, t, server)
+	client := &Client{}
+	if err := client.Connect("127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Join(&ServiceDef{Host: "a", Group: "g"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	select {
+	case err := <-result:
+		if err != ErrServerClosed {
+			t.Error("Expected the server to be closed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return")
+	}
+	if _, err := client.Snapshot("g"); err == nil {
+		t.Error("Connection should be closed")
+	}
+	if server.services.Len() != 0 {
+		t.Error("Services of closed connections should be removed")
+	}
+	if err := (&Client{}).Connect("127.0.0.1", port); err == nil {
+		t.Error("Server should not accept connections")
+	}
+	if err := server.Shutdown(context.Background()); err != ErrServerClosed {
+		t.Error("Expected the server to be closed already", err)
+	}
+	_, result = serveTestServer(ctx, t, server)
+	if err := <-result; err != ErrServerClosed {
+		t.Error("A closed server should not serve again", err)
+	}
+}
+
+func TestServerShutdownExpired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server := NewServer()
+	if err = server.OpenStore(dir, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	server.SetLeaveOnShutdown(true)
+	port, result := serveTestServer(context.Background(), t, server)
+	client := &Client{}
+	if err = client.Connect("127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+	client.Join(&ServiceDef{Host: "a", Group: "g"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = server.Shutdown(ctx); err != nil && err != context.Canceled {
+		t.Error("Unexpected error", err)
+	}
+	// The server still shuts down completely once Shutdown gave up.
+	select {
+	case err := <-result:
+		if err != ErrServerClosed {
+			t.Error("Expected the server to be closed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return")
+	}
+	if !server.stopped || server.services.Len() != 0 {
+		t.Error("Event loop not stopped", server.stopped, server.services.Len())
+	}
+	if err = server.store.append(storeJoin, &ServiceDef{}); err == nil {
+		t.Error("Store not closed")
+	}
+}
+
+func TestServerShutdownLeave(t *testing.T) {
+	server := NewServer()
+	server.SetLeaveOnShutdown(true)
+	port, _ := serveTestServer(context.Background(), t, server)
+	joiner, watcher := &Client{}, &Client{}
+	if err := joiner.Connect("127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+	if err := watcher.Connect("127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+	joiner.Join(&ServiceDef{Host: "a", Group: "g"})
+	joiner.Join(&ServiceDef{Host: "b", Group: "g", Persistent: true})
+	_, events, err := watcher.Watch("g")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Only the leave of the service that does not persist is sent.
+	var left []string
+	for event := range events {
+		if event.Type == Left {
+			left = append(left, event.Service.Host)
+		}
+	}
+	if len(left) != 1 || left[0] != "a" {
+		t.Error("Expected a to leave", left)
+	}
+}
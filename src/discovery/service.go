@@ -1,11 +1,13 @@
 package discovery
 
 import (
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"log"
 	"net"
 	"net/rpc"
-	"net/rpc/jsonrpc"
+	"sync"
 	"time"
 )
 
@@ -13,111 +15,345 @@ type Discovery struct {
 	server *Server
 	conn   net.Conn
 	id     int32
+	// Sends requests, e.g. watch events, back over the same connection.
 	client *rpc.Client
+	// Created by the first call to Watch. Only accessed in the event loop.
+	watcher *watcher
+	// Certificate presented by the client over TLS. nil if there is none.
+	cert *x509.Certificate
+	// Guards principal and authenticated, which Authenticate changes while
+	// other requests on the connection may be running.
+	authLock sync.Mutex
+	// Name the server's policy knows the connection by. Empty if unknown.
+	principal     string
+	authenticated bool
 }
 
 func newDiscoveryService(server *Server) *Discovery {
 	return &Discovery{server: server}
 }
 
-func (d *Discovery) init(conn net.Conn, id int32) {
+func (d *Discovery) init(conn net.Conn, id int32, client *rpc.Client) {
 	d.conn = conn
 	d.id = id
-	d.client = nil
+	d.client = client
+	d.watcher = nil
+	d.cert = nil
+	d.principal = ""
+	d.authenticated = false
 }
 
-func (d *Discovery) rpcClient() *rpc.Client {
-	if d.client == nil {
-		tcpAddr, ok := d.conn.RemoteAddr().(*net.TCPAddr)
-		if !ok {
-			return nil
-		}
-		// TODO(pscott): Figure out how to multiplex this connection. If we could
-		// reuse the same connection, we could avoid having to assume the client
-		// is running the DiscoveryClient service on the default port.
-		address := fmt.Sprintf("%s:%d", tcpAddr.IP.String(), DefaultPort)
+// Returns the principal of the connection and whether it has authenticated.
+func (d *Discovery) identity() (string, bool) {
+	d.authLock.Lock()
+	defer d.authLock.Unlock()
+	return d.principal, d.authenticated
+}
 
-		// A failure in connecting will return a nil client.
-		d.client, _ = jsonrpc.Dial("tcp", address)
+// Returns an error if the server requires authentication and the connection
+// has not authenticated.
+func (d *Discovery) checkAuthenticated() error {
+	if _, ok := d.identity(); !ok && d.server.tokens != nil {
+		return errors.New("Authentication required")
 	}
-	return d.client
+	return nil
 }
 
+// Returns an error unless the connection is authenticated, if required, and
+// the server's policy lets it perform op on group.
+func (d *Discovery) authorize(op, group string) error {
+	if err := d.checkAuthenticated(); err != nil {
+		return err
+	}
+	if d.server.policy == nil {
+		return nil
+	}
+	principal, _ := d.identity()
+	return d.server.policy.check(principal, op, group)
+}
+
+// Returns an error unless cert is valid for the host of service. Only checked
+// when the server verifies hosts.
+func (s *Server) checkHost(cert *x509.Certificate, service *ServiceDef) error {
+	if !s.verifyHost {
+		return nil
+	}
+	if cert == nil {
+		return errors.New("Client certificate required")
+	}
+	if err := cert.VerifyHostname(service.Host); err != nil {
+		return fmt.Errorf("Certificate of %s is not valid for host %s",
+			cert.Subject.CommonName, service.Host)
+	}
+	return nil
+}
+
+// Returns an error unless the client certificate of the connection is valid
+// for the host of service.
+func (d *Discovery) checkHost(service *ServiceDef) error {
+	return d.server.checkHost(d.cert, service)
+}
+
+// TODO(pscott): make this configurable
+const methodTimeout = 2 * time.Second
+
 // run takes a closure that returns an error. It runs the function in the main
 // server event loop and returns any error that the function returns. If the
 // function times out, run will return a timeout error.
-func (d *Discovery) run(f func() error) error {
+func (s *Server) run(f func() error) error {
 	result := make(chan error, 1)
-	d.server.eventChan <- func() { result <- f() }
+	s.eventChan <- func() { result <- f() }
 	select {
 	case err := <-result:
 		return err
-	// TODO(pscott): make this configurable
-	case <-time.After(2 * time.Second):
+	case <-time.After(methodTimeout):
 		return errors.New("Method timeout")
 	}
-	panic("Unreachable statement")
+}
+
+func (d *Discovery) run(f func() error) error {
+	return d.server.run(f)
 }
 
 type Void struct{}
 
+// Authenticates the connection with a bearer token. The principal the token
+// belongs to replaces the one of the client certificate, if any.
+func (d *Discovery) Authenticate(token string, v *Void) error {
+	if d.server.tokens == nil {
+		return errors.New("Authentication is not enabled")
+	}
+	principal, err := d.server.tokens.Verify(token)
+	if err != nil {
+		return err
+	}
+	d.authLock.Lock()
+	d.principal = principal
+	d.authenticated = true
+	d.authLock.Unlock()
+	log.Printf("Connection #%d authenticated as %s\n", d.id, principal)
+	return nil
+}
+
 func (d *Discovery) Join(service *ServiceDef, v *Void) error {
-	service.connId = d.id
-	return d.run(func() error {
-		if !d.server.join(service) {
-			return errors.New("Unable to add service")
+	if err := d.authorize(opJoin, service.Group); err != nil {
+		return err
+	}
+	if err := validateGroup(service.Group); err != nil {
+		return err
+	}
+	if service.Check != nil {
+		if err := service.Check.validate(); err != nil {
+			return err
 		}
-		return nil
-	})
+	}
+	if err := normalizeState(service); err != nil {
+		return err
+	}
+	if err := d.checkHost(service); err != nil {
+		return err
+	}
+	service.connId = d.id
+	return d.server.submit(
+		&command{Op: cmdJoin, Service: service, ConnId: d.id})
 }
 
 func (d *Discovery) Leave(service *ServiceDef, v *Void) error {
+	if err := d.authorize(opLeave, service.Group); err != nil {
+		return err
+	}
+	if err := d.checkHost(service); err != nil {
+		return err
+	}
 	service.connId = d.id
-	return d.run(func() error {
-		if !d.server.leave(service) {
-			return errors.New("Unable to remove service")
+	return d.server.submit(
+		&command{Op: cmdLeave, Service: service, ConnId: d.id})
+}
+
+// Renews the lease of a service previously joined on this connection with a
+// non-zero TTL.
+func (d *Discovery) Heartbeat(service *ServiceDef, v *Void) error {
+	if err := d.checkAuthenticated(); err != nil {
+		return err
+	}
+	service.connId = d.id
+	return d.server.submit(
+		&command{Op: cmdHeartbeat, Service: service, ConnId: d.id})
+}
+
+// Reports the result of the script check of a service joined on this
+// connection. service.Unhealthy holds the result.
+func (d *Discovery) SetHealth(service *ServiceDef, v *Void) error {
+	if err := d.authorize(opJoin, service.Group); err != nil {
+		return err
+	}
+	if err := d.checkHost(service); err != nil {
+		return err
+	}
+	service.connId = d.id
+	return d.server.submit(
+		&command{Op: cmdHealth, Service: service, ConnId: d.id})
+}
+
+// Sets the state of a registered service to service.State. A service joined
+// on this connection may always be changed. Others, e.g. when an operator
+// drains a service, require the admin operation of the policy.
+func (d *Discovery) SetState(service *ServiceDef, v *Void) error {
+	if err := normalizeState(service); err != nil {
+		return err
+	}
+	admin := d.authorize(opAdmin, service.Group) == nil
+	if !admin {
+		if err := d.authorize(opJoin, service.Group); err != nil {
+			return err
+		}
+		if err := d.checkHost(service); err != nil {
+			return err
 		}
+	}
+	service.connId = d.id
+	return d.server.submit(&command{
+		Op: cmdState, Service: service, ConnId: d.id, Admin: admin})
+}
+
+// A Snapshot holds the members of a group as of a revision.
+type Snapshot struct {
+	Revision uint64        `json:"revision"`
+	Services []*ServiceDef `json:"services"`
+	// Set by Watch when the changes after the requested revision are sent as
+	// events instead of returning the members of the group.
+	Resumed bool `json:"resumed,omitempty"`
+}
+
+type SnapshotArgs struct {
+	// A group, or a prefix ending in "/" for the services of every group under
+	// it.
+	Group string `json:"group"`
+	// When set, only the services matching this Selector are returned.
+	Selector string `json:"selector,omitempty"`
+}
+
+// Returns the members of args.Group, as of snapshot.Revision.
+func (d *Discovery) SnapshotGroup(
+	args *SnapshotArgs, snapshot *Snapshot) error {
+	if err := d.authorize(opSnapshot, args.Group); err != nil {
+		return err
+	}
+	principal, _ := d.identity()
+	sub, err := d.server.subscribe(
+		principal, opSnapshot, args.Group, args.Selector)
+	if err != nil {
+		return err
+	}
+	return d.run(func() error {
+		snapshot.Revision = d.server.revision
+		snapshot.Services = sub.filter(d.server.snapshot(args.Group))
 		return nil
 	})
 }
 
-func (d *Discovery) Snapshot(group string, snapshot *[]*ServiceDef) error {
+type WatchArgs struct {
+	// A group, or a prefix ending in "/" to watch every group under it.
+	Group string `json:"group"`
+	// When non-zero, resume watching after this revision.
+	Revision uint64 `json:"revision,omitempty"`
+	// When set, only changes to the services matching this Selector are sent.
+	// A service that stops matching after it joins again is sent as a leave,
+	// one that starts matching as a join.
+	Selector string `json:"selector,omitempty"`
+}
+
+// Start watching changes to args.Group and return the current members of the
+// group. Changes are sent as DiscoveryClient.Join and DiscoveryClient.Leave
+// requests over the same connection. The snapshot is taken at the same time
+// the watch is registered so no change is missed.
+//
+// When args.Revision is set and the server still holds every change since that
+// revision, those changes are sent as requests instead and the reply is marked
+// Resumed.
+func (d *Discovery) WatchGroup(args *WatchArgs, snapshot *Snapshot) error {
+	if err := d.authorize(opWatch, args.Group); err != nil {
+		return err
+	}
 	return d.run(func() error {
-		services := d.server.snapshot(group)
-		// TODO(pscott): Reuse an internal buffer, resizing if necessary. Might
-		// require locking as multiple snapshot requests can be sent in parallel.
-		*snapshot = make([]*ServiceDef, services.Len())
-		i := 0
-		for iter := services.Front(); iter != nil; iter = iter.Next() {
-			(*snapshot)[i] = iter.Value.(*ServiceDef)
-			i++
+		if d.client == nil {
+			return errors.New("Watch failed: connection does not accept requests")
 		}
-		return nil
+		if d.watcher == nil {
+			d.watcher = newWatcher(d.client, d.conn)
+		}
+		principal, _ := d.identity()
+		return d.server.startWatch(args, principal, d.watcher, snapshot)
 	})
 }
 
-// Start watching changes to the given group. Never returns an error.
+// Returns the members of group. Kept for the clients written before revisions,
+// which send a group name and expect a list of services. See SnapshotGroup.
+func (d *Discovery) Snapshot(group string, services *[]*ServiceDef) error {
+	var snapshot Snapshot
+	err := d.SnapshotGroup(&SnapshotArgs{Group: group}, &snapshot)
+	*services = snapshot.Services
+	return err
+}
+
+// Starts watching group. Kept for the clients written before revisions, which
+// send a group name and expect no reply. See WatchGroup.
 func (d *Discovery) Watch(group string, v *Void) error {
-	return d.run(func() error {
-		// Do the client check in the server event loop to avoid any locking or race
-		// conditions.
-		client := d.rpcClient()
-		success := client != nil
-		if success {
-			d.server.watch(group, client)
-			return nil
+	var snapshot Snapshot
+	return d.WatchGroup(&WatchArgs{Group: group}, &snapshot)
+}
+
+type ListGroupsArgs struct {
+	// When set, only groups whose name starts with Prefix are listed.
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// A group as listed by ListGroups.
+type GroupInfo struct {
+	Name string `json:"name"`
+	// Number of healthy services, the ones Snapshot returns, and of unhealthy
+	// ones.
+	Services  int `json:"services"`
+	Unhealthy int `json:"unhealthy,omitempty"`
+	// Revision of the last change to the group.
+	Revision uint64 `json:"revision"`
+}
+
+type GroupList struct {
+	Revision uint64       `json:"revision"`
+	Groups   []*GroupInfo `json:"groups"`
+}
+
+// Lists the groups with at least one service, sorted by name. Groups the
+// server's policy does not let the connection snapshot are left out.
+func (d *Discovery) ListGroups(args *ListGroupsArgs, list *GroupList) error {
+	if err := d.checkAuthenticated(); err != nil {
+		return err
+	}
+	var allow func(group string) bool
+	if policy := d.server.policy; policy != nil {
+		principal, _ := d.identity()
+		allow = func(group string) bool {
+			return policy.check(principal, opSnapshot, group) == nil
 		}
-		return errors.New("Watch failed: unable to connect to client")
+	}
+	return d.run(func() error {
+		list.Revision = d.server.revision
+		list.Groups = d.server.listGroups(args.Prefix, allow)
+		return nil
 	})
 }
 
 // Stop watching changes to the given group. Due to the asynchronous nature of
 // this method, changes in route to the connection may be sent after this method
-// is called. Never returns an error.
+// is called. Only fails if the connection has not authenticated.
 func (d *Discovery) Ignore(group string, v *Void) error {
+	if err := d.checkAuthenticated(); err != nil {
+		return err
+	}
 	return d.run(func() error {
-		if d.client != nil {
-			d.server.ignore(group, d.client)
+		if d.watcher != nil {
+			d.server.ignore(group, d.watcher)
 		}
 		return nil
 	})
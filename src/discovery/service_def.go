@@ -1,6 +1,11 @@
 package discovery
 
-import "fmt"
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
 
 // A ServiceDef is used when a service joins or leaves a group, an event is sent
 // to watchers of a group, or when a group snapshot is requested.
@@ -9,10 +14,63 @@ type ServiceDef struct {
 	Port  uint16 `json:"port"`
 	Group string `json:"group"`
 	// CustomData need not be present when a client calls Discovery.Leave.
+	// Prefer Labels and Tags for metadata that others need to read.
 	CustomData []byte `json:"custom_data,omitempty"`
+	// Key/value metadata, e.g. version or zone.
+	Labels map[string]string `json:"labels,omitempty"`
+	Tags   []string          `json:"tags,omitempty"`
+	// Lease duration in seconds. When non-zero, the service is removed unless it
+	// is renewed with Discovery.Heartbeat before the lease expires.
+	TTL uint32 `json:"ttl,omitempty"`
+	// Persistent services are not removed when the connection that joined them
+	// closes and are not owned by any connection. When the server has a store,
+	// they are also kept across restarts.
+	Persistent bool `json:"persistent,omitempty"`
+	// Revision of the change that produced this definition, i.e. the join or,
+	// in a leave event, the leave. Set by the server.
+	Revision uint64 `json:"revision,omitempty"`
+	// Optional check of the service. See HealthCheck.
+	Check *HealthCheck `json:"check,omitempty"`
+	// Set by the server while the check of the service fails. Unhealthy
+	// services are left out of snapshots.
+	Unhealthy bool `json:"unhealthy,omitempty"`
+	// One of StateActive, StateDraining or StateMaintenance. Empty means
+	// StateActive. Changed with Discovery.SetState.
+	State string `json:"state,omitempty"`
 
 	// Used internally to denote which connection the service is attached.
 	connId int32
+	// Used internally to denote when the lease expires. Zero if TTL is 0.
+	expires time.Time
+	// Used internally to identify each renewal of the lease. Identical on every
+	// member of a cluster.
+	lease uint64
+	// Used internally to identify the join of the service: the lease it
+	// joined with. Health checks only apply to the join they ran for.
+	joined uint64
+	// Used internally by the cluster leader to remember the lease it already
+	// asked to expire.
+	expiring uint64
+	// Used internally to schedule checks. Only set where checks run.
+	nextCheck time.Time
+	checking  bool
+}
+
+// Returns true if the connection may replace or remove this service.
+func (def *ServiceDef) ownedBy(connId int32) bool {
+	return def.Persistent || def.connId == connId
+}
+
+// Extends the lease of the service by its TTL starting at now.
+func (def *ServiceDef) renew(now time.Time) {
+	if def.TTL > 0 {
+		def.expires = now.Add(time.Duration(def.TTL) * time.Second)
+	}
+}
+
+// Returns true if the lease of the service has expired at the given time.
+func (def *ServiceDef) expired(now time.Time) bool {
+	return !def.expires.IsZero() && !now.Before(def.expires)
 }
 
 // Compare this service definition with b. Services are ordered by group, then
@@ -38,7 +96,27 @@ func (def *ServiceDef) toString() string {
 		def.Group, def.Host, def.Port, def.connId)
 }
 
+// Returns the keys of the labels of the service, sorted.
+func (def *ServiceDef) labelKeys() []string {
+	keys := make([]string, 0, len(def.Labels))
+	for key := range def.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func (def *ServiceDef) String() string {
-	return fmt.Sprintf("'%s' %s:%d %v",
+	s := fmt.Sprintf("'%s' %s:%d %v",
 		def.Group, def.Host, def.Port, def.CustomData)
+	for _, key := range def.labelKeys() {
+		s += fmt.Sprintf(" %s=%s", key, def.Labels[key])
+	}
+	if len(def.Tags) > 0 {
+		s += " tags=" + strings.Join(def.Tags, ",")
+	}
+	if def.State != "" {
+		s += " state=" + def.State
+	}
+	return s
 }
@@ -1,6 +1,9 @@
 package discovery
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestServiceDefCompare(t *testing.T) {
 	var a, b ServiceDef
@@ -30,3 +33,33 @@ func TestServiceDefCompare(t *testing.T) {
 		t.Error("a should be less than b: port")
 	}
 }
+
+func TestServiceDefExpired(t *testing.T) {
+	now := time.Now()
+	def := &ServiceDef{}
+	def.renew(now)
+	if def.expired(now.Add(time.Hour)) {
+		t.Error("Service without a TTL should not expire")
+	}
+
+	def.TTL = 2
+	def.renew(now)
+	if def.expired(now.Add(time.Second)) {
+		t.Error("Lease expired early")
+	}
+	if !def.expired(now.Add(2 * time.Second)) {
+		t.Error("Lease should have expired")
+	}
+}
+
+func TestServiceDefString(t *testing.T) {
+	def := &ServiceDef{Host: "h", Port: 80, Group: "g"}
+	if s := def.String(); s != "'g' h:80 []" {
+		t.Error("Wrong string", s)
+	}
+	def.Labels = map[string]string{"zone": "a", "version": "1.2"}
+	def.Tags = []string{"canary", "blue"}
+	if s := def.String(); s != "'g' h:80 [] version=1.2 zone=a tags=canary,blue" {
+		t.Error("Wrong string", s)
+	}
+}
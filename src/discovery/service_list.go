@@ -1,85 +1,239 @@
 package discovery
 
-import "container/list"
+import (
+	"sort"
+	"strings"
+)
 
-type serviceList list.List
+// serviceList holds every service known to the server. Services are kept in
+// ServiceDef.compare order in a sorted slice per group, so lookups are a binary
+// search within the group and snapshots a copy. Adding and removing move the
+// rest of the group, which stays cheap next to the cost of a change, e.g.
+// writing it to the store or the cluster log, up to groups of about 100000
+// services (see BenchmarkServiceListAddLargeGroup). Services are also indexed
+// by the connection that joined them so a disconnect only touches that
+// connection's services.
+//
+// The zero value is an empty list.
+type serviceList struct {
+	groups map[string][]*ServiceDef
+	// Names of the groups in groups, sorted.
+	names []string
+	conns map[int32]map[*ServiceDef]bool
+	size  int
+}
+
+// Returns the position of service in its group, or where it would be inserted,
+// and true if an equal service is already there.
+func (l *serviceList) search(service *ServiceDef) (int, bool) {
+	group := l.groups[service.Group]
+	i := sort.Search(len(group), func(i int) bool {
+		return service.compare(group[i]) <= 0
+	})
+	return i, i < len(group) && service.compare(group[i]) == 0
+}
+
+func (l *serviceList) indexConn(service *ServiceDef) {
+	if l.conns == nil {
+		l.conns = make(map[int32]map[*ServiceDef]bool)
+	}
+	services := l.conns[service.connId]
+	if services == nil {
+		services = make(map[*ServiceDef]bool)
+		l.conns[service.connId] = services
+	}
+	services[service] = true
+}
+
+func (l *serviceList) unindexConn(service *ServiceDef) {
+	services := l.conns[service.connId]
+	delete(services, service)
+	if len(services) == 0 {
+		delete(l.conns, service.connId)
+	}
+}
 
 // Add a new service definition to the list. If the definition is added or
 // updated, return true.
 func (l *serviceList) Add(service *ServiceDef) bool {
-	list := (*list.List)(l)
-	for iter := list.Front(); iter != nil; iter = iter.Next() {
-		e := iter.Value.(*ServiceDef)
-		res := service.compare(e)
-		if res > 0 {
-			continue
-		} else if res < 0 {
-			list.InsertBefore(service, iter)
-			return true
-		} else if e.connId == service.connId {
-			// Replace the definition if it is from the same connection.
-			iter.Value = service
-			return true
-		}
+	i, found := l.search(service)
+	group := l.groups[service.Group]
+	if found {
+		e := group[i]
 		// Equal entries but from a different connection.
-		return false
+		if !e.ownedBy(service.connId) {
+			return false
+		}
+		// Replace the definition if it is from the same connection.
+		l.unindexConn(e)
+		group[i] = service
+		l.indexConn(service)
+		return true
 	}
-	list.PushBack(service)
+
+	if group == nil {
+		if l.groups == nil {
+			l.groups = make(map[string][]*ServiceDef)
+		}
+		n := sort.SearchStrings(l.names, service.Group)
+		l.names = append(l.names, "")
+		copy(l.names[n+1:], l.names[n:])
+		l.names[n] = service.Group
+	}
+	group = append(group, nil)
+	copy(group[i+1:], group[i:])
+	group[i] = service
+	l.groups[service.Group] = group
+	l.indexConn(service)
+	l.size++
 	return true
 }
 
+// Removes the service at position i of its group.
+func (l *serviceList) removeAt(name string, i int) *ServiceDef {
+	group := l.groups[name]
+	service := group[i]
+	copy(group[i:], group[i+1:])
+	group[len(group)-1] = nil
+	group = group[:len(group)-1]
+	if len(group) == 0 {
+		delete(l.groups, name)
+		n := sort.SearchStrings(l.names, name)
+		l.names = append(l.names[:n], l.names[n+1:]...)
+	} else {
+		l.groups[name] = group
+	}
+	l.unindexConn(service)
+	l.size--
+	return service
+}
+
 // Remove a service definition from the list. If a service has been removed,
-// return true. Different connections cannot remove services they did not add.
+// return true. Different connections cannot remove services they did not add
+// unless the service is persistent.
 func (l *serviceList) Remove(service *ServiceDef) bool {
-	list := (*list.List)(l)
-	for iter := list.Front(); iter != nil; iter = iter.Next() {
-		e := iter.Value.(*ServiceDef)
-		res := service.compare(e)
-		if res > 0 {
-			continue
-		} else if res == 0 && e.connId == service.connId {
-			list.Remove(iter)
-			return true
-		}
-		// Did not find the service.
-		break
+	i, found := l.search(service)
+	if !found || !l.groups[service.Group][i].ownedBy(service.connId) {
+		return false
+	}
+	l.removeAt(service.Group, i)
+	return true
+}
+
+// Find the service definition equal to service regardless of the connection
+// it is attached to. Returns nil if the service is not in the list.
+func (l *serviceList) Find(service *ServiceDef) *ServiceDef {
+	if i, found := l.search(service); found {
+		return l.groups[service.Group][i]
 	}
-	return false
+	return nil
 }
 
 func (l *serviceList) Get(index int) *ServiceDef {
-	if index < 0 || index >= l.Len() {
+	if index < 0 || index >= l.size {
 		return nil
 	}
-	for iter := (*list.List)(l).Front(); iter != nil; iter = iter.Next() {
-		if index == 0 {
-			return iter.Value.(*ServiceDef)
+	for _, name := range l.names {
+		group := l.groups[name]
+		if index < len(group) {
+			return group[index]
 		}
-		index--
+		index -= len(group)
 	}
 	// Impossible to reach.
 	panic("Unreachable")
 }
 
-func (l *serviceList) Len() int { return (*list.List)(l).Len() }
-func (l *serviceList) Clear()   { (*list.List)(l).Init() }
+// Returns a copy of the services in group. When group is a prefix, returns the
+// services of every group under it, ordered by group. Use ForEach to only
+// iterate.
+func (l *serviceList) Group(group string) []*ServiceDef {
+	services := make([]*ServiceDef, 0, l.GroupLen(group))
+	l.ForEach(group, func(service *ServiceDef) {
+		services = append(services, service)
+	})
+	return services
+}
+
+// Calls f with each service in group, or in every group under the prefix group,
+// in order. The list must not change until it returns.
+func (l *serviceList) ForEach(group string, f func(service *ServiceDef)) {
+	names := []string{group}
+	if isPrefix(group) {
+		names = l.namesWithPrefix(group)
+	}
+	for _, name := range names {
+		for _, service := range l.groups[name] {
+			f(service)
+		}
+	}
+}
+
+// Returns the part of names that start with prefix.
+func (l *serviceList) namesWithPrefix(prefix string) []string {
+	n := sort.SearchStrings(l.names, prefix)
+	end := n
+	for end < len(l.names) && strings.HasPrefix(l.names[end], prefix) {
+		end++
+	}
+	return l.names[n:end]
+}
+
+// Returns the names of the groups with at least one service that start with
+// prefix, sorted.
+func (l *serviceList) Groups(prefix string) []string {
+	names := l.namesWithPrefix(prefix)
+	return append(make([]string, 0, len(names)), names...)
+}
+
+// Returns the number of services in group.
+func (l *serviceList) GroupLen(group string) int {
+	return len(l.groups[group])
+}
+
+// Returns the services joined on the connection, in no particular order.
+func (l *serviceList) Connection(connId int32) []*ServiceDef {
+	services := make([]*ServiceDef, 0, len(l.conns[connId]))
+	for service := range l.conns[connId] {
+		services = append(services, service)
+	}
+	return services
+}
+
+// Returns the ids of every connection with at least one service.
+func (l *serviceList) Connections() []int32 {
+	ids := make([]int32, 0, len(l.conns))
+	for id := range l.conns {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (l *serviceList) Len() int { return l.size }
+func (l *serviceList) Clear()   { *l = serviceList{} }
 
 type iterator struct {
-	list *list.List
-	iter *list.Element
-	curr *list.Element
+	list *serviceList
+	// Position of the next service.
+	name  int
+	index int
+	curr  *ServiceDef
 }
 
 // Returns the current *ServiceDef and increments the iterator.
 func (i *iterator) Next() *ServiceDef {
-	if i.iter == nil {
-		return nil
+	i.curr = nil
+	for i.name < len(i.list.names) {
+		group := i.list.groups[i.list.names[i.name]]
+		if i.index < len(group) {
+			i.curr = group[i.index]
+			i.index++
+			return i.curr
+		}
+		i.name++
+		i.index = 0
 	}
-
-	i.curr = i.iter
-	service := i.iter.Value.(*ServiceDef)
-	i.iter = i.iter.Next()
-	return service
+	return nil
 }
 
 // Removes the value returned by Next(). Does not increment the iterator.
@@ -88,13 +242,14 @@ func (i *iterator) Remove() *ServiceDef {
 		return nil
 	}
 
-	service := i.curr.Value.(*ServiceDef)
-	i.list.Remove(i.curr)
-	return service
+	service := i.curr
+	i.curr = nil
+	// When the group goes away, the next group takes its place.
+	i.index--
+	return i.list.removeAt(service.Group, i.index)
 }
 
 // Create a simple iterator over all services.
 func (l *serviceList) Iterator() *iterator {
-	ll := (*list.List)(l)
-	return &iterator{list: ll, iter: ll.Front()}
+	return &iterator{list: l}
 }
@@ -156,3 +156,139 @@ func TestServiceListIterator(t *testing.T) {
 		t.Error("Leftover entries are incorrect")
 	}
 }
+
+func TestServiceListFind(t *testing.T) {
+	var list serviceList
+	if list.Find(&ServiceDef{}) != nil {
+		t.Error("Empty list should return nil")
+	}
+
+	list.Add(&ServiceDef{Host: "host1"})
+	list.Add(&ServiceDef{Host: "host2", connId: 1})
+	if def := list.Find(&ServiceDef{Host: "host2"}); def == nil ||
+		def.connId != 1 {
+		t.Error("Wrong definition returned", def)
+	}
+	if list.Find(&ServiceDef{Host: "host3"}) != nil {
+		t.Error("Unknown definition found")
+	}
+}
+
+func TestServiceListIndexes(t *testing.T) {
+	var list serviceList
+	list.Add(&ServiceDef{Host: "b", Group: "g2", connId: 1})
+	list.Add(&ServiceDef{Host: "a", Group: "g2", connId: 2})
+	list.Add(&ServiceDef{Host: "c", Group: "g1", connId: 1})
+
+	group := list.Group("g2")
+	if len(group) != 2 || group[0].Host != "a" || group[1].Host != "b" {
+		t.Error("Wrong group", group)
+	}
+	if len(list.Group("g3")) != 0 {
+		t.Error("Unknown group is not empty")
+	}
+	if conn := list.Connection(1); len(conn) != 2 {
+		t.Error("Wrong connection services", conn)
+	}
+	if len(list.Connections()) != 2 {
+		t.Error("Wrong connections", list.Connections())
+	}
+
+	// Replacing a persistent service moves it to the new connection.
+	list.Add(&ServiceDef{Host: "d", Group: "g1", connId: 1, Persistent: true})
+	list.Add(&ServiceDef{Host: "d", Group: "g1", connId: 3, Persistent: true})
+	if len(list.Connection(1)) != 2 || len(list.Connection(3)) != 1 {
+		t.Error("Connection index not updated")
+	}
+
+	// Removing the last service of a group or connection drops it.
+	iter := list.Iterator()
+	for def := iter.Next(); def != nil; def = iter.Next() {
+		if def.Group == "g1" {
+			iter.Remove()
+		}
+	}
+	if list.Len() != 2 || list.Get(0).Host != "a" || list.Get(1).Host != "b" {
+		t.Error("Wrong services after removing g1", list.Len())
+	}
+	if len(list.Connections()) != 2 || len(list.Connection(3)) != 0 {
+		t.Error("Connection index not updated", list.Connections())
+	}
+}
+
+func TestServiceListPrefix(t *testing.T) {
+	var list serviceList
+	list.Add(&ServiceDef{Host: "a", Group: "prod/us/api"})
+	list.Add(&ServiceDef{Host: "b", Group: "prod/eu/api"})
+	list.Add(&ServiceDef{Host: "c", Group: "prod"})
+	list.Add(&ServiceDef{Host: "d", Group: "production/api"})
+	list.Add(&ServiceDef{Host: "e", Group: "prod/us/web"})
+
+	services := list.Group("prod/")
+	if len(services) != 3 || services[0].Group != "prod/eu/api" ||
+		services[1].Group != "prod/us/api" ||
+		services[2].Group != "prod/us/web" {
+		t.Error("Wrong services under prod/", services)
+	}
+	if services = list.Group("prod/us/"); len(services) != 2 {
+		t.Error("Wrong services under prod/us/", services)
+	}
+	if services = list.Group("dev/"); services == nil || len(services) != 0 {
+		t.Error("Unknown prefix is not empty", services)
+	}
+
+	var hosts string
+	list.ForEach("prod/", func(service *ServiceDef) { hosts += service.Host })
+	list.ForEach("prod", func(service *ServiceDef) { hosts += service.Host })
+	if hosts != "baec" {
+		t.Error("Wrong services iterated", hosts)
+	}
+}
+
+// Fills list with groups * size services spread over conns connections.
+func fillServiceList(list *serviceList, groups, size, conns int) {
+	for i := 0; i < groups; i++ {
+		for j := 0; j < size; j++ {
+			list.Add(&ServiceDef{
+				Host:   fmt.Sprintf("host%d", j),
+				Port:   uint16(j),
+				Group:  fmt.Sprintf("group%d", i),
+				connId: int32((i*size + j) % conns)})
+		}
+	}
+}
+
+func BenchmarkServiceListAdd(b *testing.B) {
+	var list serviceList
+	fillServiceList(&list, 100, 100, 100)
+	service := &ServiceDef{Host: "new", Group: "group50"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		list.Add(service)
+		list.Remove(service)
+	}
+}
+
+// Join and leave in the middle of a single group of 100000 services.
+func BenchmarkServiceListAddLargeGroup(b *testing.B) {
+	var list serviceList
+	fillServiceList(&list, 1, 100000, 100)
+	service := &ServiceDef{Host: "host5", Group: "group0"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		list.Add(service)
+		list.Remove(service)
+	}
+}
+
+func BenchmarkServiceListFind(b *testing.B) {
+	var list serviceList
+	fillServiceList(&list, 100, 100, 100)
+	service := &ServiceDef{Host: "host50", Port: 50, Group: "group99"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if list.Find(service) == nil {
+			b.Fatal("Service not found")
+		}
+	}
+}
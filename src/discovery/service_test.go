@@ -10,7 +10,7 @@ import (
 func initDiscoveryTest(server *Server, id int32) *Discovery {
 	read, _ := net.Pipe()
 	disc := newDiscoveryService(server)
-	disc.init(read, id)
+	disc.init(read, id, nil)
 	return disc
 }
 
@@ -143,7 +143,7 @@ func TestDiscoveryWatch(t *testing.T) {
 	if err == nil {
 		t.Error("Watching without a client should fail")
 	}
-	if disc.client != nil {
+	if disc.watcher != nil {
 		t.Error()
 	}
 	_, ok := server.watchers["group"]
@@ -159,7 +159,7 @@ func TestDiscoveryWatch(t *testing.T) {
 		t.Error(err)
 	}
 
-	if !server.watchers["group"][disc.client] {
+	if server.watchers["group"][disc.watcher] == nil {
 		t.Error("Watcher not added")
 	}
 }
@@ -172,12 +172,14 @@ func TestDiscoveryIgnore(t *testing.T) {
 	_, write := net.Pipe()
 	disc.client = jsonrpc.NewClient(write)
 	disc.Watch("group", &Void{})
-	if server.watchers["group"] == nil || !server.watchers["group"][disc.client] {
+	if server.watchers["group"] == nil ||
+		server.watchers["group"][disc.watcher] == nil {
 		t.Error("Watcher not registered")
 	}
 
 	disc.Ignore("diff_group", &Void{})
-	if server.watchers["group"] == nil || !server.watchers["group"][disc.client] {
+	if server.watchers["group"] == nil ||
+		server.watchers["group"][disc.watcher] == nil {
 		t.Error("Watcher removed")
 	}
 
@@ -198,3 +200,83 @@ func TestDiscoveryIgnore(t *testing.T) {
 		t.Error("Watcher group not deleted")
 	}
 }
+
+func TestDiscoverySnapshotGroup(t *testing.T) {
+	server := NewServer()
+	go server.processEvents()
+	disc := initDiscoveryTest(server, 0)
+
+	server.services.Add(&ServiceDef{Host: "host1", Port: 1, Group: "a"})
+	server.services.Add(&ServiceDef{Host: "host2", Port: 2, Group: "a"})
+	server.services.Add(&ServiceDef{Host: "host3", Port: 1, Group: "b"})
+
+	var snapshot Snapshot
+	err := disc.SnapshotGroup(&SnapshotArgs{Group: "a"}, &snapshot)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(snapshot.Services) != 2 {
+		t.Error("Snapshot length incorrect")
+	}
+	if def := snapshot.Services[0]; def.Host != "host1" || def.Port != 1 {
+		t.Error("Incorrect service", def)
+	}
+	if def := snapshot.Services[1]; def.Host != "host2" || def.Port != 2 {
+		t.Error("Incorrect service", def)
+	}
+
+	err = disc.SnapshotGroup(&SnapshotArgs{Group: "b"}, &snapshot)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(snapshot.Services) != 1 {
+		t.Error("Snapshot length incorrect")
+	}
+	if def := snapshot.Services[0]; def.Host != "host3" || def.Port != 1 {
+		t.Error("Incorrect service", def)
+	}
+
+	err = disc.SnapshotGroup(&SnapshotArgs{Group: "c"}, &snapshot)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(snapshot.Services) != 0 {
+		t.Error("Snapshot should be empty")
+	}
+}
+
+func TestDiscoveryWatchGroup(t *testing.T) {
+	server := NewServer()
+	go server.processEvents()
+	disc := initDiscoveryTest(server, 0)
+
+	var snapshot Snapshot
+	err := disc.WatchGroup(&WatchArgs{Group: "group"}, &snapshot)
+	if err == nil {
+		t.Error("Watching without a client should fail")
+	}
+	if disc.watcher != nil {
+		t.Error("Watcher should not be created")
+	}
+	_, ok := server.watchers["group"]
+	if ok {
+		t.Error("Watcher should not be added")
+	}
+
+	_, write := net.Pipe()
+	disc.client = jsonrpc.NewClient(write)
+	server.services.Add(&ServiceDef{Host: "host", Group: "group"})
+	server.services.Add(&ServiceDef{Host: "host", Group: "other"})
+
+	err = disc.WatchGroup(&WatchArgs{Group: "group"}, &snapshot)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if disc.watcher == nil || server.watchers["group"][disc.watcher] == nil {
+		t.Error("Watcher not added")
+	}
+	if len(snapshot.Services) != 1 || snapshot.Services[0].Host != "host" {
+		t.Error("Wrong watch snapshot", snapshot)
+	}
+}
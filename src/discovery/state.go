@@ -0,0 +1,84 @@
+package discovery
+
+import (
+	"errors"
+	"log"
+)
+
+// States of a service. Only active services should be sent new requests: a
+// draining service finishes the requests it has before it is stopped, e.g.
+// during a rolling restart, and a service in maintenance is not serving at
+// all. Watchers see every state, Balancer, Ring and DNS only use active
+// services.
+const (
+	StateActive      = "active"
+	StateDraining    = "draining"
+	StateMaintenance = "maintenance"
+)
+
+// Prefix of the requirements on the state in a Selector.
+const statePrefix = "state:"
+
+// Returns an error unless state is one of the states of a service. The empty
+// state stands for StateActive.
+func validateState(state string) error {
+	switch state {
+	case "", StateActive, StateDraining, StateMaintenance:
+		return nil
+	}
+	return errors.New("Invalid state: " + state)
+}
+
+// Returns the state of the service, StateActive when it is not set.
+func (def *ServiceDef) state() string {
+	if def.State == "" {
+		return StateActive
+	}
+	return def.State
+}
+
+// Returns true if the service should be sent new requests.
+func (def *ServiceDef) active() bool {
+	return def.state() == StateActive
+}
+
+// Validates the state of service and stores StateActive as the empty state so
+// active services look the same however they got there.
+func normalizeState(service *ServiceDef) error {
+	if err := validateState(service.State); err != nil {
+		return err
+	}
+	if service.State == StateActive {
+		service.State = ""
+	}
+	return nil
+}
+
+// Sets the state of the registered service equal to service. Unless admin is
+// set, the connection of service must own the registered one. Returns false if
+// the service is not found.
+func (s *Server) setState(service *ServiceDef, admin bool) bool {
+	e := s.services.Find(service)
+	if e == nil || !admin && !e.ownedBy(service.connId) {
+		return false
+	}
+	if e.State == service.State {
+		return true
+	}
+	// Snapshots already taken may still hold e, change a copy.
+	prev := e
+	updated := *e
+	updated.State = service.State
+	e = &updated
+	s.services.Add(e)
+	if e.Persistent {
+		s.persist(storeJoin, e)
+	}
+	log.Printf("State: %s %s\n", e.toString(), e.state())
+	// Watchers see the service join again in its new state. They do not see
+	// unhealthy services at all.
+	if !e.Unhealthy {
+		s.publish("DiscoveryClient.Join", e, prev)
+	}
+	return true
+}
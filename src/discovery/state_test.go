@@ -0,0 +1,172 @@
+package discovery
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func testClientState(t *testing.T, protocol Protocol) {
+	server := NewServer()
+	go server.processEvents()
+	owner := connectTestClient(server, protocol)
+	defer owner.Close()
+	watcher := connectTestClient(server, protocol)
+	defer watcher.Close()
+	a := &ServiceDef{Host: "a", Port: 80, Group: "g"}
+	if err := owner.Join(a); err != nil {
+		t.Fatal(err)
+	}
+	owner.Join(&ServiceDef{Host: "b", Port: 80, Group: "g"})
+	_, events, err := watcher.Watch("g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, active, err := owner.WatchSelector("g", "state:active")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = owner.SetState(a, StateDraining); err != nil {
+		t.Fatal(err)
+	}
+	event := nextEvent(t, events)
+	if event.Type != Joined || event.Service.Host != "a" ||
+		event.Service.State != StateDraining {
+		t.Error("Expected a to join again draining", event)
+	}
+	if event = nextEvent(t, active); event.Type != Left ||
+		event.Service.Host != "a" {
+		t.Error("Expected a to leave the active services", event)
+	}
+	snapshot, err := watcher.SnapshotSelector("g", "!state:active")
+	if err != nil || len(snapshot.Services) != 1 ||
+		snapshot.Services[0].State != StateDraining {
+		t.Error("Wrong snapshot", snapshot, err)
+	}
+	// The state is restored with the service after a reconnect.
+	if owner.services[keyOf(a)].State != StateDraining {
+		t.Error("State not kept by the client")
+	}
+
+	// Without a policy anyone may change the state.
+	if err = watcher.SetState(a, StateActive); err != nil {
+		t.Error(err)
+	}
+	if event = nextEvent(t, events); event.Service.State != "" {
+		t.Error("Expected a to be active", event)
+	}
+	if err = owner.SetState(a, "asleep"); err == nil {
+		t.Error("Expected an invalid state")
+	}
+	missing := &ServiceDef{Host: "c", Port: 80, Group: "g"}
+	if err = owner.SetState(missing, StateMaintenance); err == nil {
+		t.Error("Expected an unknown service")
+	}
+}
+
+func TestClientStateJSON(t *testing.T) {
+	testClientState(t, JSON)
+}
+
+func TestClientStateProtobuf(t *testing.T) {
+	testClientState(t, Protobuf)
+}
+
+// Connects a client authenticated with token.
+func connectTokenClient(t *testing.T, server *Server, token string) *Client {
+	client := connectTestClient(server, JSON)
+	client.Token = token
+	if err := client.authenticate(); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// Snapshots already returned are serialized outside the event loop, a change
+// of state must not modify them.
+func TestServerStateCopyOnWrite(t *testing.T) {
+	server := NewServer()
+	go server.processEvents()
+	var snapshot []*ServiceDef
+	server.run(func() error {
+		server.join(&ServiceDef{Host: "h", Port: 1, Group: "g"})
+		snapshot = server.snapshot("g")
+		server.setState(&ServiceDef{Host: "h", Port: 1, Group: "g",
+			State: StateDraining}, true)
+		return nil
+	})
+	if len(snapshot) != 1 || snapshot[0].State != "" {
+		t.Error("Snapshot changed", snapshot)
+	}
+	server.run(func() error {
+		if e := server.snapshot("g"); len(e) != 1 || e[0].State != StateDraining {
+			t.Error("State not changed", e)
+		}
+		return nil
+	})
+}
+
+func TestServerStatePolicy(t *testing.T) {
+	server := NewServer()
+	server.SetTokenVerifier(testTokens{"o": "owner", "n": "nobody", "x": "ops"})
+	server.SetPolicy(&Policy{Rules: []*Rule{
+		{Group: "g", Principals: []string{"owner", "nobody"},
+			Operations: []string{"join", "snapshot"}},
+		{Group: "g", Principals: []string{"ops"},
+			Operations: []string{"admin"}},
+	}})
+	go server.processEvents()
+	owner := connectTokenClient(t, server, "o")
+	defer owner.Close()
+	nobody := connectTokenClient(t, server, "n")
+	defer nobody.Close()
+	ops := connectTokenClient(t, server, "x")
+	defer ops.Close()
+	service := &ServiceDef{Host: "a", Port: 80, Group: "g"}
+	if err := owner.Join(service); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nobody.SetState(service, StateDraining); err == nil {
+		t.Error("Only the owner and operators may change the state")
+	}
+	if err := ops.SetState(service, StateMaintenance); err != nil {
+		t.Error(err)
+	}
+	if err := owner.SetState(service, StateDraining); err != nil {
+		t.Error(err)
+	}
+	snapshot, err := owner.Snapshot("g")
+	if err != nil || len(snapshot) != 1 ||
+		snapshot[0].State != StateDraining {
+		t.Error("Wrong snapshot", snapshot, err)
+	}
+}
+
+func TestHTTPState(t *testing.T) {
+	server := NewServer()
+	go server.processEvents()
+	httpRequest(server, "POST", "/groups/web", `{"host": "a", "port": 80}`, "")
+	w := httpRequest(server, "PUT",
+		"/groups/web?host=a&port=80&state=maintenance", "", "")
+	if w.Code != http.StatusNoContent {
+		t.Error("Expected the state to change", w.Code, w.Body)
+	}
+	w = httpRequest(server, "GET", "/groups/web", "", "")
+	var snapshot Snapshot
+	if err := json.Unmarshal(w.Body.Bytes(), &snapshot); err != nil ||
+		len(snapshot.Services) != 1 ||
+		snapshot.Services[0].State != StateMaintenance {
+		t.Error("Wrong snapshot", w.Body, err)
+	}
+	w = httpRequest(server, "PUT", "/groups/web?host=a&port=80&state=x", "", "")
+	if w.Code != http.StatusBadRequest {
+		t.Error("Expected a bad request", w.Code)
+	}
+	w = httpRequest(server, "PUT",
+		"/groups/web?host=b&port=80&state=active", "", "")
+	if w.Code != http.StatusNotFound {
+		t.Error("Expected an unknown service", w.Code)
+	}
+}
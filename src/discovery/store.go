@@ -0,0 +1,169 @@
+package discovery
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	snapshotFile = "snapshot.json"
+	logFile      = "wal.json"
+)
+
+// store persists persistent services so they survive a restart of the server.
+// Joins and leaves are appended to a write-ahead log which is periodically
+// compacted into a snapshot of all persistent services. Both files contain one
+// json encoded storeRecord per line.
+//
+// Replaying a log on top of the snapshot it was compacted into results in the
+// same services, so a crash between writing the snapshot and truncating the log
+// is harmless.
+type store struct {
+	dir     string
+	log     *os.File
+	encoder *json.Encoder
+	// Number of records in the log since the last compaction.
+	records int
+}
+
+const (
+	storeJoin  = "join"
+	storeLeave = "leave"
+)
+
+type storeRecord struct {
+	Op      string      `json:"op"`
+	Service *ServiceDef `json:"service"`
+}
+
+// Opens the store in dir, creating the directory if necessary. The services
+// recorded in the store are added to services.
+func openStore(dir string, services *serviceList) (*store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &store{dir: dir}
+	if _, err := s.replay(snapshotFile, services); err != nil {
+		return nil, err
+	}
+	size, err := s.replay(logFile, services)
+	if err != nil {
+		return nil, err
+	}
+
+	log, err := os.OpenFile(filepath.Join(dir, logFile),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// Drop a partially written record so that new records start on a line of
+	// their own.
+	if err = log.Truncate(size); err != nil {
+		log.Close()
+		return nil, err
+	}
+	s.log = log
+	s.encoder = json.NewEncoder(log)
+	return s, nil
+}
+
+// Applies the records in the named file to services and returns the size of
+// the complete records. A missing file is not an error. A partially written
+// record at the end of the file, e.g. after a crash, is ignored.
+func (s *store) replay(name string, services *serviceList) (int64, error) {
+	file, err := os.Open(filepath.Join(s.dir, name))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var size int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// Records end with a newline, anything after the last one is the
+			// start of a record that was never completed.
+			return size, nil
+		} else if err != nil {
+			return 0, err
+		}
+		var record storeRecord
+		if err = json.Unmarshal(line, &record); err != nil {
+			return 0, err
+		}
+		size += int64(len(line))
+		if record.Service == nil {
+			continue
+		}
+		record.Service.Persistent = true
+		switch record.Op {
+		case storeJoin:
+			services.Add(record.Service)
+		case storeLeave:
+			services.Remove(record.Service)
+		}
+		if name == logFile {
+			s.records++
+		}
+	}
+}
+
+// Appends a record to the log and waits for it to reach the disk.
+func (s *store) append(op string, service *ServiceDef) error {
+	if err := s.encoder.Encode(&storeRecord{op, service}); err != nil {
+		return err
+	}
+	s.records++
+	return s.log.Sync()
+}
+
+// Writes a snapshot of the persistent services and truncates the log.
+func (s *store) compact(services *serviceList) error {
+	if s.records == 0 {
+		return nil
+	}
+	path := filepath.Join(s.dir, snapshotFile)
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	iter := services.Iterator()
+	for def := iter.Next(); def != nil && err == nil; def = iter.Next() {
+		if def.Persistent {
+			err = encoder.Encode(&storeRecord{storeJoin, def})
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+
+	// The snapshot now holds every record in the log.
+	if err = s.log.Truncate(0); err != nil {
+		return err
+	}
+	s.records = 0
+	return s.log.Sync()
+}
+
+func (s *store) close() error {
+	return s.log.Close()
+}
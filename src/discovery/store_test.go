@@ -0,0 +1,122 @@
+package discovery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var services serviceList
+	s, err := openStore(dir, &services)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if services.Len() != 0 {
+		t.Error("New store should be empty")
+	}
+	s.append(storeJoin, &ServiceDef{Host: "host1", Group: "group"})
+	s.append(storeJoin, &ServiceDef{Host: "host2", Group: "group"})
+	s.append(storeLeave, &ServiceDef{Host: "host1", Group: "group"})
+	s.close()
+
+	services.Clear()
+	s, err = openStore(dir, &services)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if services.Len() != 1 || services.Get(0).Host != "host2" ||
+		!services.Get(0).Persistent {
+		t.Error("Wrong services after replay", services.Len(), services.Get(0))
+	}
+	if s.records != 3 {
+		t.Error("Wrong number of log records", s.records)
+	}
+	s.close()
+}
+
+func TestStoreCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var services serviceList
+	s, err := openStore(dir, &services)
+	if err != nil {
+		t.Fatal(err)
+	}
+	persistent := &ServiceDef{Host: "host1", Group: "group", Persistent: true}
+	services.Add(persistent)
+	services.Add(&ServiceDef{Host: "host2", Group: "group"})
+	s.append(storeJoin, persistent)
+	if err = s.compact(&services); err != nil {
+		t.Fatal(err)
+	}
+	if s.records != 0 {
+		t.Error("Compaction did not reset the log")
+	}
+	info, err := os.Stat(filepath.Join(dir, logFile))
+	if err != nil || info.Size() != 0 {
+		t.Error("Log was not truncated", err)
+	}
+
+	// Records after the compaction are replayed on top of the snapshot.
+	s.append(storeJoin, &ServiceDef{Host: "host3", Group: "group"})
+	s.close()
+
+	services.Clear()
+	s, err = openStore(dir, &services)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if services.Len() != 2 || services.Get(0).Host != "host1" ||
+		services.Get(1).Host != "host3" {
+		t.Error("Wrong services after compaction", services.Len())
+	}
+}
+
+func TestStoreIgnoresPartialRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := `{"op":"join","service":{"host":"host","port":1,"group":"g"}}
+{"op":"join","serv`
+	err = ioutil.WriteFile(filepath.Join(dir, logFile), []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var services serviceList
+	s, err := openStore(dir, &services)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if services.Len() != 1 || services.Get(0).Port != 1 {
+		t.Error("Wrong services", services.Len())
+	}
+
+	// Records appended after the partial one are not lost on the next replay.
+	s.append(storeJoin, &ServiceDef{Host: "host", Port: 2, Group: "g"})
+	s.close()
+	services.Clear()
+	s, err = openStore(dir, &services)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if services.Len() != 2 || services.Get(1).Port != 2 || s.records != 2 {
+		t.Error("Wrong services after a partial record", services.Len())
+	}
+}
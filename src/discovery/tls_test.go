@@ -0,0 +1,159 @@
+package discovery
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Creates a certificate signed by parent, or a self-signed CA if parent is nil,
+// and writes it to dir/name.pem and its key to dir/name.key.
+func writeTestCert(t *testing.T, dir, name string, template *x509.Certificate,
+	parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (
+	*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	} else {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	}
+	der, err := x509.CreateCertificate(
+		rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(filepath.Join(dir, name+".pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+		0600)
+	return cert, key
+}
+
+// Writes a CA, a server certificate for 127.0.0.1 and a client certificate for
+// the host svc.example to dir.
+func writeTestCerts(t *testing.T, dir string) {
+	ca, caKey := writeTestCert(t, dir, "ca", &x509.Certificate{}, nil, nil)
+	writeTestCert(t, dir, "server",
+		&x509.Certificate{IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}},
+		ca, caKey)
+	writeTestCert(t, dir, "client",
+		&x509.Certificate{DNSNames: []string{"svc.example"}}, ca, caKey)
+}
+
+// Starts a server accepting TLS connections on a local port.
+func startTLSServer(t *testing.T, dir string, verifyHost bool) uint16 {
+	config, err := NewServerTLSConfig(filepath.Join(dir, "server.pem"),
+		filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer()
+	server.SetVerifyHost(verifyHost)
+	go server.ServeListener(
+		context.Background(), tls.NewListener(listener, config))
+	return uint16(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func TestTLSVerifyHost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestCerts(t, dir)
+	port := startTLSServer(t, dir, true)
+
+	config, err := NewClientTLSConfig(filepath.Join(dir, "client.pem"),
+		filepath.Join(dir, "client.key"), filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, protocol := range []Protocol{JSON, Protobuf} {
+		group := []string{"json", "protobuf"}[i]
+		client := &Client{Protocol: protocol, TLSConfig: config}
+		if err = client.Connect("127.0.0.1", port); err != nil {
+			t.Fatal(err)
+		}
+		if err = client.Join(
+			&ServiceDef{Host: "svc.example", Group: group}); err != nil {
+			t.Error(err)
+		}
+		err = client.Join(&ServiceDef{Host: "other.example", Group: group})
+		if err == nil || !strings.Contains(err.Error(), "not valid for host") {
+			t.Error("Expected host verification to fail", err)
+		}
+		snapshot, err := client.Snapshot(group)
+		if err != nil || len(snapshot) != 1 {
+			t.Error("Wrong snapshot", snapshot, err)
+		}
+		client.Close()
+	}
+}
+
+func TestTLSRequiresClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestCerts(t, dir)
+	port := startTLSServer(t, dir, false)
+
+	config, err := NewClientTLSConfig("", "", filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{TLSConfig: config}
+	// Depending on the TLS version the handshake fails during Connect or on
+	// the first call.
+	if err = client.Connect("127.0.0.1", port); err == nil {
+		_, err = client.Snapshot("g")
+		client.Close()
+	}
+	if err == nil {
+		t.Error("Connecting without a client certificate should fail")
+	}
+}
+
+func TestServerVerifyHostWithoutTLS(t *testing.T) {
+	server := NewServer()
+	server.SetVerifyHost(true)
+	go server.processEvents()
+	client := connectTestClient(server, JSON)
+	defer client.Close()
+	err := client.Join(&ServiceDef{Host: "host", Group: "g"})
+	if err == nil || err.Error() != "Client certificate required" {
+		t.Error("Expected a certificate error", err)
+	}
+}
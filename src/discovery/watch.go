@@ -0,0 +1,205 @@
+package discovery
+
+import "sync"
+
+// Number of events buffered for each watched group, both in its channel and in
+// the queue of events received from the server. Once both are full, the server
+// waits for the application to receive events.
+const eventBufferSize = 64
+
+// Identifies a service within the registry.
+type serviceKey struct {
+	group, host string
+	port        uint16
+}
+
+func keyOf(def *ServiceDef) serviceKey {
+	return serviceKey{def.Group, def.Host, def.Port}
+}
+
+// watch delivers the events of a watched group to the application. It tracks
+// the members of the group so that after a reconnect it can resume from the
+// last revision it saw or, when the server no longer has the changes since
+// then, turn a new snapshot into the events that were missed.
+type watch struct {
+	events chan *Event
+	// Selector the watch was started with, if any.
+	selector string
+	// Closed by close to stop the delivery of events.
+	done chan bool
+
+	lock    sync.Mutex
+	changed *sync.Cond
+	// Signaled when an item leaves the queue.
+	drained *sync.Cond
+	queue   []watchItem
+	// Set while the watch is established with the server. Items are not
+	// delivered until the reply arrives since events may arrive first.
+	hold bool
+	// Index of the first item queued while holding.
+	mark   int
+	closed bool
+	// Revision of the last change delivered.
+	revision uint64
+
+	// Members of the group as of revision. nil when unknown, i.e. after a
+	// watch resumed without a snapshot. Only accessed by run.
+	members map[serviceKey]*ServiceDef
+}
+
+type watchItem struct {
+	event *Event
+	// Set instead of event once the watch is established.
+	snapshot *Snapshot
+	// True if the snapshot was returned to the application.
+	initial bool
+}
+
+func newWatch() *watch {
+	w := &watch{
+		events: make(chan *Event, eventBufferSize),
+		done:   make(chan bool)}
+	w.changed = sync.NewCond(&w.lock)
+	w.drained = sync.NewCond(&w.lock)
+	go w.run()
+	return w
+}
+
+// Queues an event received from the server. Blocks while the queue is full,
+// which keeps the server from sending the next event.
+func (w *watch) push(event *Event) {
+	w.lock.Lock()
+	for !w.closed && len(w.queue) >= eventBufferSize {
+		w.drained.Wait()
+	}
+	w.queue = append(w.queue, watchItem{event: event})
+	w.changed.Signal()
+	w.lock.Unlock()
+}
+
+// Called before asking the server to watch the group.
+func (w *watch) begin() {
+	w.lock.Lock()
+	w.hold = true
+	w.mark = len(w.queue)
+	w.lock.Unlock()
+}
+
+// Called with the reply of the server. The snapshot goes before any event that
+// arrived ahead of it.
+func (w *watch) established(snapshot *Snapshot, initial bool) {
+	w.lock.Lock()
+	item := watchItem{snapshot: snapshot, initial: initial}
+	w.queue = append(w.queue, watchItem{})
+	copy(w.queue[w.mark+1:], w.queue[w.mark:])
+	w.queue[w.mark] = item
+	w.hold = false
+	w.changed.Signal()
+	w.lock.Unlock()
+}
+
+func (w *watch) lastRevision() uint64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.revision
+}
+
+func (w *watch) close() {
+	w.lock.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.done)
+		w.changed.Signal()
+		w.drained.Broadcast()
+	}
+	w.lock.Unlock()
+}
+
+// Delivers queued items in order until the watch is closed.
+func (w *watch) run() {
+	defer close(w.events)
+	for {
+		w.lock.Lock()
+		for !w.closed && (w.hold || len(w.queue) == 0) {
+			w.changed.Wait()
+		}
+		if w.closed {
+			w.lock.Unlock()
+			return
+		}
+		item := w.queue[0]
+		w.queue = w.queue[1:]
+		w.drained.Signal()
+		w.lock.Unlock()
+
+		var events []*Event
+		if item.snapshot != nil {
+			events = w.sync(item.snapshot, item.initial)
+		} else if event := w.apply(item.event); event != nil {
+			events = []*Event{event}
+		}
+		for _, event := range events {
+			select {
+			case w.events <- event:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+func (w *watch) setRevision(revision uint64) {
+	w.lock.Lock()
+	w.revision = revision
+	w.lock.Unlock()
+}
+
+// Updates the members with an event. Returns nil if the event was already
+// delivered.
+func (w *watch) apply(event *Event) *Event {
+	revision := event.Service.Revision
+	if revision != 0 && revision <= w.lastRevision() {
+		return nil
+	}
+	if w.members != nil {
+		if event.Type == Joined {
+			w.members[keyOf(event.Service)] = event.Service
+		} else {
+			delete(w.members, keyOf(event.Service))
+		}
+	}
+	w.setRevision(revision)
+	return event
+}
+
+// Updates the members with a snapshot. Returns the events that turn the
+// previous members into the snapshot.
+func (w *watch) sync(snapshot *Snapshot, initial bool) []*Event {
+	if snapshot.Resumed {
+		// The missed changes follow as events.
+		return nil
+	}
+	members := make(map[serviceKey]*ServiceDef, len(snapshot.Services))
+	for _, def := range snapshot.Services {
+		members[keyOf(def)] = def
+	}
+	var events []*Event
+	if !initial {
+		for key, def := range w.members {
+			if _, ok := members[key]; !ok {
+				left := *def
+				left.Revision = snapshot.Revision
+				events = append(events, &Event{Left, &left})
+			}
+		}
+		for _, def := range snapshot.Services {
+			old, ok := w.members[keyOf(def)]
+			if !ok || old.Revision != def.Revision {
+				events = append(events, &Event{Joined, def})
+			}
+		}
+	}
+	w.members = members
+	w.setRevision(snapshot.Revision)
+	return events
+}
@@ -0,0 +1,225 @@
+package discovery
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// Maximum number of events queued for a watcher.
+const watcherQueueSize = 4096
+
+// Maximum time a watching client has to acknowledge an event. Variable so tests
+// can shorten it.
+var watcherCallTimeout = 30 * time.Second
+
+// A watcher sends events to a single watching client, one at a time, in the
+// order they were queued. The rpc server on the other end of a connection
+// handles each request in its own go routine so each event waits for the
+// previous one to be acknowledged.
+//
+// A watcher that cannot deliver an event, or falls queueSize events behind,
+// stops and calls failed so the client can be told to watch again.
+type watcher struct {
+	// Delivers an event. An error stops the watcher.
+	deliver func(event *watchEvent) error
+	// Called once if the watcher stops because events are lost. May be nil.
+	failed    func()
+	queueSize int
+	lock      sync.Mutex
+	pending   []*watchEvent
+	closed    bool
+	wake      chan bool
+}
+
+// A subscription tells which changes to a group, or to the groups under a
+// prefix, a watcher is sent.
+type subscription struct {
+	selector *Selector
+	// Returns false for the groups whose changes may not be sent. nil allows
+	// every group.
+	allow func(group string) bool
+}
+
+// Returns the method the watcher is sent change c with, or false if it is not
+// sent. A nil subscription is sent every change.
+func (sub *subscription) change(c *change) (string, bool) {
+	if sub == nil {
+		return c.method, true
+	}
+	if sub.allow != nil && !sub.allow(c.service.Group) {
+		return "", false
+	}
+	return sub.selector.change(c)
+}
+
+// Removes the services the subscription does not concern from services, in
+// place.
+func (sub *subscription) filter(services []*ServiceDef) []*ServiceDef {
+	if sub == nil {
+		return services
+	}
+	if sub.allow != nil {
+		allowed := services[:0]
+		for _, service := range services {
+			if sub.allow(service.Group) {
+				allowed = append(allowed, service)
+			}
+		}
+		services = allowed
+	}
+	return sub.selector.filter(services)
+}
+
+type watchEvent struct {
+	method  string
+	service *ServiceDef
+	// When set, the event is not delivered. The channel is closed instead once
+	// the events queued before it are.
+	flushed chan bool
+}
+
+// Returns a watcher sending events as requests over client. conn, the
+// connection of client, is closed once an event is lost so that the client
+// reconnects and watches again.
+func newWatcher(client *rpc.Client, conn io.Closer) *watcher {
+	timeout := watcherCallTimeout
+	return newEventWatcher(func(event *watchEvent) error {
+		call := client.Go(event.method, event.service, &Void{},
+			make(chan *rpc.Call, 1))
+		var err error
+		select {
+		case <-call.Done:
+			err = call.Error
+		case <-time.After(timeout):
+			return errors.New("Timeout sending " + event.method)
+		}
+		if _, ok := err.(rpc.ServerError); ok {
+			// The client failed to handle the event but is still there.
+			return nil
+		}
+		return err
+	}, func() { conn.Close() })
+}
+
+// Returns a watcher passing events to deliver, one at a time, in the order they
+// were queued. failed, if not nil, is called once events are lost.
+func newEventWatcher(deliver func(event *watchEvent) error,
+	failed func()) *watcher {
+	w := &watcher{deliver: deliver, failed: failed,
+		queueSize: watcherQueueSize, wake: make(chan bool, 1)}
+	go w.run()
+	return w
+}
+
+// Queues a request to be sent to the watcher. Never blocks so it is safe to
+// call from the event loop.
+func (w *watcher) send(method string, service *ServiceDef) {
+	// Copy the definition since it is serialized outside of the event loop.
+	def := *service
+	w.lock.Lock()
+	full := !w.closed && len(w.pending) >= w.queueSize
+	if !w.closed && !full {
+		w.pending = append(w.pending,
+			&watchEvent{method: method, service: &def})
+	}
+	w.lock.Unlock()
+	if full {
+		log.Println("Watcher fell too far behind")
+		w.fail()
+		return
+	}
+	w.signal()
+}
+
+// Stops the watcher after events were lost.
+func (w *watcher) fail() {
+	if w.close() && w.failed != nil {
+		w.failed()
+	}
+}
+
+// Returns a channel closed once the events queued so far are delivered, or
+// the watcher is closed.
+func (w *watcher) flushed() <-chan bool {
+	flushed := make(chan bool)
+	w.lock.Lock()
+	if w.closed {
+		close(flushed)
+	} else {
+		w.pending = append(w.pending, &watchEvent{flushed: flushed})
+	}
+	w.lock.Unlock()
+	w.signal()
+	return flushed
+}
+
+// Stops sending events. Pending events are dropped. Returns false if the
+// watcher was already closed.
+func (w *watcher) close() bool {
+	w.lock.Lock()
+	wasOpen := !w.closed
+	if wasOpen {
+		for _, event := range w.pending {
+			if event.flushed != nil {
+				close(event.flushed)
+			}
+		}
+	}
+	w.closed = true
+	w.pending = nil
+	w.lock.Unlock()
+	w.signal()
+	return wasOpen
+}
+
+func (w *watcher) signal() {
+	select {
+	case w.wake <- true:
+	default:
+		// Already signaled.
+	}
+}
+
+// Returns the next event to send, or nil if there is nothing to send. ok is
+// false once the watcher is closed.
+func (w *watcher) next() (event *watchEvent, ok bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return nil, false
+	}
+	if len(w.pending) > 0 {
+		event = w.pending[0]
+		w.pending[0] = nil
+		w.pending = w.pending[1:]
+	}
+	return event, true
+}
+
+func (w *watcher) run() {
+	for <-w.wake {
+		for {
+			event, ok := w.next()
+			if !ok {
+				return
+			}
+			if event == nil {
+				break
+			}
+			if event.flushed != nil {
+				close(event.flushed)
+				continue
+			}
+			if err := w.deliver(event); err != nil {
+				// The connection is gone or stuck, no other events can be
+				// delivered.
+				w.fail()
+				return
+			}
+		}
+	}
+}